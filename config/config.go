@@ -29,6 +29,12 @@ type Config struct {
 	User     string `yaml:"user"`
 	Password string `yaml:"password"`
 
+	AdminUser     string `yaml:"admin_user"`     //可以执行修改节点的admin命令的用户, 为空时不允许这些命令
+	AdminPassword string `yaml:"admin_password"`
+
+	ReadConsistency       string `yaml:"read_consistency"`        //所有连接(包括admin_user)的默认读一致性: none, window, gtid, 会话可以用SET brother_read_consistency修改
+	ReadConsistencyWindow int    `yaml:"read_consistency_window"` //window模式写后读主库的时间, gtid模式等待从库的超时, 单位毫秒
+
 	WebAddr     string `yaml:"web_addr"`
 	WebUser     string `yaml:"web_user"`
 	WebPassword string `yaml:"web_password"`
@@ -42,6 +48,9 @@ type Config struct {
 	Charset     string       `yaml:"proxy_charset"`
 	Nodes       []NodeConfig `yaml:"nodes"`
 
+	XAMode    bool   `yaml:"xa_mode"`     //跨节点的事务使用XA两阶段提交
+	XALogPath string `yaml:"xa_log_path"` //XA恢复日志, 默认在log_path下
+
 	Schema SchemaConfig `yaml:"schema"`
 }
 
@@ -50,6 +59,27 @@ type NodeConfig struct {
 	Name             string `yaml:"name"`
 	DownAfterNoAlive int    `yaml:"down_after_noalive"`
 	MaxConnNum       int    `yaml:"max_conns_limit"`
+	CheckInterval    int    `yaml:"check_interval"` //健康检查间隔, 单位秒
+	CheckTimeout     int    `yaml:"check_timeout"`  //健康检查ping的超时, 单位秒
+	MaxSlaveLag      int    `yaml:"max_slave_lag"`  //从库允许的最大复制延迟, 单位秒, 0表示不检查
+	Balancer         string `yaml:"balancer"`       //从库负载均衡: round_robin(默认), least_conn, latency
+
+	BreakerFailures    int     `yaml:"breaker_failures"`     //连续失败次数达到时熔断, 0表示不按连续失败熔断
+	BreakerErrorRatio  float64 `yaml:"breaker_error_ratio"`  //窗口内的错误比例达到时熔断, 0表示不按比例熔断
+	BreakerWindow      int     `yaml:"breaker_window"`       //统计错误比例的窗口, 单位秒, 默认10
+	BreakerMinRequests int     `yaml:"breaker_min_requests"` //窗口内的请求数不少于该值时才按比例熔断, 默认20
+	BreakerCooldown    int     `yaml:"breaker_cooldown"`     //熔断之后放过探测请求的时间, 单位秒, 默认30
+
+	MinIdleConns    int `yaml:"min_idle_conns"`    //每个DB保持的最少空闲连接, 默认16, 不超过max_conns_limit
+	MaxIdleTime     int `yaml:"max_idle_time"`     //空闲超过该时间的连接被关闭, 单位秒, 默认600
+	MaxConnLifetime int `yaml:"max_conn_lifetime"` //连接的最长使用时间, 应小于MySQL的wait_timeout, 单位秒, 默认3600
+	ConnWaitTimeout int `yaml:"conn_wait_timeout"` //连接数达到max_conns_limit时等待的时间, 单位毫秒, 默认3000
+
+	ConnReset string `yaml:"conn_reset"` //复用后端连接时清理会话状态: none(默认), reset, change_user
+
+	AutoFailover     bool `yaml:"auto_failover"`           //主库宕机时自动提升最新的从库
+	RepointSlaves    bool `yaml:"failover_repoint_slaves"` //切换后把其他从库指向新主库, 需要开启GTID
+	FailoverCooldown int  `yaml:"failover_cooldown"`       //两次自动切换的最小间隔, 单位秒, 默认300
 
 	User     string `yaml:"user"`
 	Password string `yaml:"password"`
@@ -60,12 +90,13 @@ type NodeConfig struct {
 
 //schema对应的结构体
 type SchemaConfig struct {
-	Nodes     []string      `yaml:"nodes"`
-	Default   string        `yaml:"default"` //default node
-	ShardRule []ShardConfig `yaml:"shard"`   //route rule
+	Nodes     []string         `yaml:"nodes"`
+	Default   string           `yaml:"default"`   //default node
+	ShardRule []ShardConfig    `yaml:"shard"`     //route rule
+	Sequences []SequenceConfig `yaml:"sequences"` //global sequence
 }
 
-//range,hash or date
+//range,hash,date or global
 type ShardConfig struct {
 	DB            string   `yaml:"db"`
 	Table         string   `yaml:"table"`
@@ -75,6 +106,18 @@ type ShardConfig struct {
 	Type          string   `yaml:"type"`
 	TableRowLimit int      `yaml:"table_row_limit"`
 	DateRange     []string `yaml:"date_range"`
+	Sequence      string   `yaml:"sequence"` //insert没有给出key时用该序列生成
+}
+
+//全局序列: segment从node上的序列表按段分配, snowflake按worker_id生成
+type SequenceConfig struct {
+	Name     string `yaml:"name"`
+	Type     string `yaml:"type"`
+	Node     string `yaml:"node"`
+	DB       string `yaml:"db"`
+	Table    string `yaml:"table"`
+	Step     int64  `yaml:"step"`
+	WorkerId int64  `yaml:"worker_id"`
 }
 
 func ParseConfigData(data []byte) (*Config, error) {
@@ -71,4 +71,38 @@ var (
 	ErrBlackSqlNotExist = errors.New("black sql has not exist")
 	ErrInsertTooComplex = errors.New("insert is too complex")
 	ErrSQLNULL          = errors.New("sql is null")
+
+	ErrAggrTooComplex   = errors.New("aggregate function is too complex in multi shard")
+	ErrAggrWithStar     = errors.New("select * with aggregate in multi shard not allowed")
+	ErrHavingTooComplex = errors.New("having is too complex in multi shard")
+	ErrOrderByColumn    = errors.New("order by column not found in select list")
+
+	ErrHintIllegal     = errors.New("routing hint format illegal")
+	ErrHintNodeUnknown = errors.New("routing hint node not in schema")
+	ErrHintSlaveWrite  = errors.New("routing hint slave not allowed for write")
+
+	ErrDDLRename  = errors.New("rename sharded table not allowed")
+	ErrDDLNoTable = errors.New("table name not found in ddl")
+
+	ErrFailoverRunning     = errors.New("failover is already running")
+	ErrFailoverCooldown    = errors.New("failover is in cooldown")
+	ErrFailoverMasterAlive = errors.New("master is reachable, failover aborted")
+	ErrNoFailoverSlave     = errors.New("no slave available for failover")
+	ErrFailoverSQLStopped  = errors.New("slave sql thread is not running")
+	ErrFailoverTimeout     = errors.New("slave relay log not applied in time")
+	ErrCmdIllegal          = errors.New("admin command illegal")
+
+	ErrReadConsistency = errors.New("read consistency must be none, window or gtid with a positive window")
+	ErrReadOnMaster    = errors.New("read must go to master for consistency")
+
+	ErrBalancerType = errors.New("balancer must be round_robin, least_conn or latency")
+	ErrResetMode    = errors.New("conn_reset must be none, reset or change_user")
+	ErrAuthPlugin   = errors.New("backend auth plugin is not mysql_native_password")
+
+	ErrStmtRoute = errors.New("prepared statement only supports tables on the default node without node hint")
+
+	ErrNodeExist    = errors.New("node has exist")
+	ErrNodeNotExist = errors.New("node has not exist")
+	ErrNodeInUse    = errors.New("node is used by schema or sequence")
+	ErrSlaveWeight  = errors.New("slave weight must be a positive integer")
 )
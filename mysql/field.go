@@ -117,6 +117,20 @@ func (p FieldData) Parse() (f *Field, err error) {
 	return
 }
 
+func (f *Field) IsNumeric() bool {
+	switch f.Type {
+	case MYSQL_TYPE_TINY, MYSQL_TYPE_SHORT, MYSQL_TYPE_LONG,
+		MYSQL_TYPE_INT24, MYSQL_TYPE_LONGLONG, MYSQL_TYPE_YEAR,
+		MYSQL_TYPE_FLOAT, MYSQL_TYPE_DOUBLE:
+		return true
+	}
+	return f.IsDecimal()
+}
+
+func (f *Field) IsDecimal() bool {
+	return f.Type == MYSQL_TYPE_DECIMAL || f.Type == MYSQL_TYPE_NEWDECIMAL
+}
+
 func (f *Field) Dump() []byte {
 	if f.Data != nil {
 		return []byte(f.Data)
@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"math"
+	"math/big"
 	"strconv"
 	"brother/core/hack"
 )
@@ -42,7 +43,7 @@ func (p RowData) ParseText(f []*Field) ([]interface{}, error) {
 
 			switch f[i].Type {
 			case MYSQL_TYPE_TINY, MYSQL_TYPE_SHORT, MYSQL_TYPE_INT24,
-				MYSQL_TYPE_LONGLONG, MYSQL_TYPE_YEAR:
+				MYSQL_TYPE_LONG, MYSQL_TYPE_LONGLONG, MYSQL_TYPE_YEAR:
 				if isUnsigned {
 					data[i], err = strconv.ParseUint(string(v), 10, 64)
 				} else {
@@ -217,6 +218,41 @@ func (p RowData) ParseBinary(f []*Field) ([]interface{}, error) {
 	return data, nil
 }
 
+//text of a parsed value, as it is sent in a text row
+func FormatValue(value interface{}) []byte {
+	switch v := value.(type) {
+	case int64:
+		return strconv.AppendInt(nil, v, 10)
+	case uint64:
+		return strconv.AppendUint(nil, v, 10)
+	case float64:
+		return strconv.AppendFloat(nil, v, 'f', -1, 64)
+	case []byte:
+		return v
+	case string:
+		return hack.Slice(v)
+	}
+	return []byte(fmt.Sprintf("%v", value))
+}
+
+//exact number of a parsed value, decimal is kept as []byte
+func ValueToRat(value interface{}) (*big.Rat, bool) {
+	switch v := value.(type) {
+	case int64:
+		return new(big.Rat).SetInt64(v), true
+	case uint64:
+		return new(big.Rat).SetUint64(v), true
+	case float64:
+		r := new(big.Rat).SetFloat64(v)
+		return r, r != nil
+	case []byte:
+		return new(big.Rat).SetString(hack.String(v))
+	case string:
+		return new(big.Rat).SetString(v)
+	}
+	return nil, false
+}
+
 type Resultset struct {
 	Fields     []*Field
 	FieldNames map[string]int
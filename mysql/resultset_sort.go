@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"fmt"
 	"sort"
-	"brother/core/hack"
 )
 
 const (
@@ -13,13 +12,16 @@ const (
 )
 
 type SortKey struct {
-	//name of the field
+	//name of the field, sort by Column if empty
 	Name string
 
 	Direction string
 
 	//column index of the field
-	column int
+	Column int
+
+	//compare as number
+	numeric bool
 }
 
 type resultsetSorter struct {
@@ -34,11 +36,16 @@ func newResultsetSorter(r *Resultset, sk []SortKey) (*resultsetSorter, error) {
 	s.Resultset = r
 
 	for i, k := range sk {
-		if column, ok := r.FieldNames[k.Name]; ok {
-			sk[i].column = column
-		} else {
-			return nil, fmt.Errorf("key %s not in resultset fields, can not sort", k.Name)
+		if len(k.Name) != 0 {
+			column, ok := r.FieldNames[k.Name]
+			if !ok {
+				return nil, fmt.Errorf("key %s not in resultset fields, can not sort", k.Name)
+			}
+			sk[i].Column = column
+		} else if k.Column < 0 || k.Column >= len(r.Fields) {
+			return nil, fmt.Errorf("column %d not in resultset fields, can not sort", k.Column)
 		}
+		sk[i].numeric = r.Fields[sk[i].Column].IsNumeric()
 	}
 
 	s.sk = sk
@@ -55,7 +62,7 @@ func (r *resultsetSorter) Less(i, j int) bool {
 	v2 := r.Values[j]
 
 	for _, k := range r.sk {
-		v := cmpValue(v1[k.column], v2[k.column])
+		v := CompareValue(v1[k.Column], v2[k.Column], k.numeric)
 
 		if k.Direction == SortDesc {
 			v = -v
@@ -73,8 +80,9 @@ func (r *resultsetSorter) Less(i, j int) bool {
 	return false
 }
 
-//compare value using asc
-func cmpValue(v1 interface{}, v2 interface{}) int {
+//compare value using asc, nil is the smallest.
+//compare as number if numeric or both values are numbers, otherwise compare the text
+func CompareValue(v1 interface{}, v2 interface{}, numeric bool) int {
 	if v1 == nil && v2 == nil {
 		return 0
 	} else if v1 == nil {
@@ -83,50 +91,31 @@ func cmpValue(v1 interface{}, v2 interface{}) int {
 		return 1
 	}
 
-	switch v := v1.(type) {
-	case string:
-		s := v2.(string)
-		return bytes.Compare(hack.Slice(v), hack.Slice(s))
-	case []byte:
-		s := v2.([]byte)
-		return bytes.Compare(v, s)
-	case int64:
-		s := v2.(int64)
-		if v < s {
-			return -1
-		} else if v > s {
-			return 1
-		} else {
-			return 0
-		}
-	case uint64:
-		s := v2.(uint64)
-		if v < s {
-			return -1
-		} else if v > s {
-			return 1
-		} else {
-			return 0
+	if numeric || (isNumber(v1) && isNumber(v2)) {
+		x, ok1 := ValueToRat(v1)
+		y, ok2 := ValueToRat(v2)
+		if ok1 && ok2 {
+			return x.Cmp(y)
 		}
-	case float64:
-		s := v2.(float64)
-		if v < s {
-			return -1
-		} else if v > s {
-			return 1
-		} else {
-			return 0
-		}
-	default:
-		//can not go here
-		panic(fmt.Sprintf("invalid type %T", v))
 	}
+	return bytes.Compare(FormatValue(v1), FormatValue(v2))
+}
+
+func isNumber(v interface{}) bool {
+	switch v.(type) {
+	case int64, uint64, float64:
+		return true
+	}
+	return false
 }
 
 func (r *resultsetSorter) Swap(i, j int) {
 	r.Values[i], r.Values[j] = r.Values[j], r.Values[i]
 
-	r.RowDatas[i], r.RowDatas[j] = r.RowDatas[j], r.RowDatas[i]
+	//RowDatas may be rebuilt from Values later
+	if len(r.RowDatas) == len(r.Values) {
+		r.RowDatas[i], r.RowDatas[j] = r.RowDatas[j], r.RowDatas[i]
+	}
 }
 
 func (r *Resultset) Sort(sk []SortKey) error {
@@ -136,7 +125,8 @@ func (r *Resultset) Sort(sk []SortKey) error {
 		return err
 	}
 
-	sort.Sort(s)
+	//keep the order of equal rows
+	sort.Stable(s)
 
 	return nil
 }
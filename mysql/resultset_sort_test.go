@@ -28,7 +28,7 @@ func TestResultsetSort(t *testing.T) {
 	s.Resultset = r1
 
 	s.sk = []SortKey{
-		SortKey{column: 0, Direction: SortDesc},
+		SortKey{Column: 0, Direction: SortDesc},
 	}
 
 	sort.Sort(s)
@@ -50,8 +50,8 @@ func TestResultsetSort(t *testing.T) {
 	}
 
 	s.sk = []SortKey{
-		SortKey{column: 1, Direction: SortAsc},
-		SortKey{column: 2, Direction: SortDesc},
+		SortKey{Column: 1, Direction: SortAsc},
+		SortKey{Column: 2, Direction: SortDesc},
 	}
 
 	sort.Sort(s)
@@ -73,8 +73,8 @@ func TestResultsetSort(t *testing.T) {
 	}
 
 	s.sk = []SortKey{
-		SortKey{column: 1, Direction: SortAsc},
-		SortKey{column: 2, Direction: SortAsc},
+		SortKey{Column: 1, Direction: SortAsc},
+		SortKey{Column: 2, Direction: SortAsc},
 	}
 
 	sort.Sort(s)
@@ -96,3 +96,57 @@ func TestResultsetSort(t *testing.T) {
 	}
 
 }
+
+func TestResultsetSortByColumn(t *testing.T) {
+	r := &Resultset{
+		Fields: []*Field{
+			&Field{Name: []byte("price"), Type: MYSQL_TYPE_NEWDECIMAL},
+			&Field{Name: []byte("name"), Type: MYSQL_TYPE_VAR_STRING},
+		},
+		Values: [][]interface{}{
+			[]interface{}{[]byte("9.5"), []byte("b")},
+			[]interface{}{[]byte("10.25"), []byte("a")},
+			[]interface{}{nil, []byte("c")},
+			[]interface{}{[]byte("9.5"), []byte("a")},
+		},
+	}
+
+	//decimal sorts as number and nil is the smallest, equal rows keep their order, only Values without RowDatas
+	if err := r.Sort([]SortKey{SortKey{Column: 0, Direction: SortDesc}}); err != nil {
+		t.Fatal(err)
+	}
+
+	values := [][]interface{}{
+		[]interface{}{[]byte("10.25"), []byte("a")},
+		[]interface{}{[]byte("9.5"), []byte("b")},
+		[]interface{}{[]byte("9.5"), []byte("a")},
+		[]interface{}{nil, []byte("c")},
+	}
+	if !reflect.DeepEqual(r.Values, values) {
+		t.Fatal(fmt.Sprintf("%v", r.Values))
+	}
+
+	if err := r.Sort([]SortKey{SortKey{Column: 2}}); err == nil {
+		t.Fatal("column out of range must fail")
+	}
+}
+
+func TestCompareValue(t *testing.T) {
+	cases := []struct {
+		v1, v2  interface{}
+		numeric bool
+		cmp     int
+	}{
+		{nil, nil, false, 0},
+		{nil, int64(1), false, -1},
+		{int64(10), uint64(9), false, 1},
+		{[]byte("10"), []byte("9"), true, 1},
+		{[]byte("10"), []byte("9"), false, -1},
+		{[]byte("1.50"), float64(1.5), true, 0},
+	}
+	for _, c := range cases {
+		if cmp := CompareValue(c.v1, c.v2, c.numeric); cmp != c.cmp {
+			t.Fatal(c.v1, c.v2, c.numeric, cmp)
+		}
+	}
+}
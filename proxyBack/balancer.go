@@ -6,6 +6,35 @@ import (
 	"brother/core/errors"
 )
 
+const (
+	//按addr@weight的权重轮询
+	RoundRobinBalancer	=	"round_robin"
+	//借出连接数/权重最小的从库
+	LeastConnBalancer	=	"least_conn"
+	//最近查询延迟(EWMA)/权重最小的从库
+	LatencyBalancer		=	"latency"
+)
+
+//从库的负载均衡策略, 调用方持有Node的锁
+type Balancer interface {
+	//从库列表或权重变化之后重新初始化
+	Init(weights []int)
+	//在可用的从库中选择一个, 返回下标, 没有可用的从库时返回-1; peek为true时不改变轮询位置
+	Next(slaves []*DB, weights []int, usable func(db *DB) bool, peek bool) int
+}
+
+func NewBalancer(name string) (Balancer, error) {
+	switch name {
+	case "", RoundRobinBalancer:
+		return new(roundRobin), nil
+	case LeastConnBalancer:
+		return new(leastConn), nil
+	case LatencyBalancer:
+		return new(latency), nil
+	}
+	return nil, errors.ErrBalancerType
+}
+
 func GCD(ary []int) int {
 	var i int
 	min := ary[0]
@@ -35,52 +64,201 @@ func GCD(ary []int) int {
 	return min
 }
 
+//设置节点的负载均衡策略, 需要在ParseSlave之前调用
+func (n *Node) SetBalancer(name string) error {
+	b, err := NewBalancer(name)
+	if err != nil {
+		return err
+	}
+	n.Lock()
+	n.BalancerType = name
+	n.balancer = b
+	n.balancer.Init(n.SlaveWeights)
+	n.Unlock()
+	return nil
+}
+
 func (n *Node) InitBalancer() {
+	if n.balancer == nil {
+		n.balancer = new(roundRobin)
+	}
+	n.balancer.Init(n.SlaveWeights)
+}
+
+//选择下一个可用的从库, 调用方持有n.Lock
+func (n *Node) GetNextSlave() (*DB, error) {
+	if len(n.Slave) == 0 {
+		return nil, errors.ErrNoDatabase
+	}
+	//半开的从库可能同时被其他节点的请求选中, 没有占到探测位置时它不再可读, 重新选择
+	for i := 0; i <= len(n.Slave); i++ {
+		index := n.balancer.Next(n.Slave, n.SlaveWeights, (*DB).Readable, false)
+		if index < 0 || len(n.Slave) <= index {
+			break
+		}
+		if n.Slave[index].breakerTryAcquire() {
+			return n.Slave[index], nil
+		}
+	}
+	return nil, errors.ErrSlaveDown
+}
+
+//负载均衡下一次会选择的从库, 不改变轮询位置, 没有可用的从库时返回nil
+func (n *Node) PeekSlave() *DB {
+	n.Lock()
+	defer n.Unlock()
+	if n.balancer == nil {
+		return nil
+	}
+	index := n.balancer.Next(n.Slave, n.SlaveWeights, (*DB).Readable, true)
+	if index < 0 || len(n.Slave) <= index {
+		return nil
+	}
+	return n.Slave[index]
+}
+
+/**
+ * ################################### round robin ###########################################
+ */
+
+type roundRobin struct {
+	queue				[]int
+	index				int
+}
+
+func (b *roundRobin) Init(weights []int) {
 	var sum int
-	n.LastSlaveIndex = 0
-	gcd := GCD(n.SlaveWeights)
+	b.index = 0
+	b.queue = nil
+	if len(weights) == 0 {
+		return
+	}
+	gcd := GCD(weights)
 
-	for _, weight := range n.SlaveWeights {
+	for _, weight := range weights {
 		sum += weight / gcd
 	}
 
-	n.RoundRobinQ = make([]int, 0, sum)
-	for index, weight := range n.SlaveWeights {
+	b.queue = make([]int, 0, sum)
+	for index, weight := range weights {
 		for j := 0; j < weight / gcd; j++ {
-			n.RoundRobinQ = append(n.RoundRobinQ, index)
+			b.queue = append(b.queue, index)
 		}
 	}
 	//random order
-	if len(n.SlaveWeights) > 1 {
+	if len(weights) > 1 {
 		r := rand.New(rand.NewSource(time.Now().UnixNano()))
 		for i := 0; i < sum; i ++ {
 			x := r.Intn(sum)
-			tmp := n.RoundRobinQ[x]
+			tmp := b.queue[x]
 			other := sum % (x + 1)
-			n.RoundRobinQ[x] = n.RoundRobinQ[other]
-			n.RoundRobinQ[other] = tmp
+			b.queue[x] = b.queue[other]
+			b.queue[other] = tmp
 		}
 	}
 }
 
-func (n *Node) GetNextSlave() (*DB, error) {
-	var index int
-	queueLen := len(n.RoundRobinQ)
-	if queueLen == 0 {
-		return nil, errors.ErrNoDatabase
+//从当前位置开始跳过不可用的从库
+func (b *roundRobin) Next(slaves []*DB, weights []int, usable func(db *DB) bool, peek bool) int {
+	queueLen := len(b.queue)
+	for i := 0; i < queueLen; i++ {
+		pos := (b.index + i) % queueLen
+		index := b.queue[pos]
+		if len(slaves) <= index || !usable(slaves[index]) {
+			continue
+		}
+		if !peek {
+			b.index = (pos + 1) % queueLen
+		}
+		return index
 	}
-	if queueLen == 1 {
-		index = n.RoundRobinQ[0]
-		return n.Slave[index], nil
+	return -1
+}
+
+/**
+ * ################################### least connections ###########################################
+ */
+
+type leastConn struct{}
+
+func (b *leastConn) Init(weights []int) {}
+
+//借出连接数相同时权重大的优先, 多出的+1使空闲的从库也按权重区分
+func (b *leastConn) Next(slaves []*DB, weights []int, usable func(db *DB) bool, peek bool) int {
+	best := -1
+	var bestScore float64
+	for i, db := range slaves {
+		if !usable(db) {
+			continue
+		}
+		score := float64(db.Borrowed()+1) / float64(weights[i])
+		if best < 0 || score < bestScore {
+			best, bestScore = i, score
+		}
 	}
+	return best
+}
 
-	n.LastSlaveIndex = n.LastSlaveIndex % queueLen
-	index = n.RoundRobinQ[n.LastSlaveIndex]
-	if len(n.Slave) <= index {
-		return nil, errors.ErrNoDatabase
+/**
+ * ################################### EWMA latency ###########################################
+ */
+
+type latency struct{}
+
+func (b *latency) Init(weights []int) {}
+
+//还没有延迟数据的从库优先, 以便尽快得到它的延迟
+func (b *latency) Next(slaves []*DB, weights []int, usable func(db *DB) bool, peek bool) int {
+	best := -1
+	var bestScore float64
+	for i, db := range slaves {
+		if !usable(db) {
+			continue
+		}
+		score := float64(db.Latency()) * float64(db.Borrowed()+1) / float64(weights[i])
+		if best < 0 || score < bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+/**
+ * ################################### status ###########################################
+ */
+
+//从库在负载均衡中的状态, 用于admin查看
+type SlaveBalance struct {
+	Addr				string
+	Weight				int
+	Borrowed			int64
+	Latency				time.Duration
+	//是否是策略当前会选择的从库
+	Next				bool
+}
+
+func (n *Node) BalancerStatus() (string, []SlaveBalance) {
+	n.Lock()
+	defer n.Unlock()
+
+	name := n.BalancerType
+	if len(name) == 0 {
+		name = RoundRobinBalancer
+	}
+	next := -1
+	if n.balancer != nil {
+		next = n.balancer.Next(n.Slave, n.SlaveWeights, (*DB).Readable, true)
+	}
+
+	status := make([]SlaveBalance, 0, len(n.Slave))
+	for i, db := range n.Slave {
+		status = append(status, SlaveBalance{
+			Addr:     db.Addr(),
+			Weight:   n.SlaveWeights[i],
+			Borrowed: db.Borrowed(),
+			Latency:  db.Latency(),
+			Next:     i == next,
+		})
 	}
-	db := n.Slave[index]
-	n.LastSlaveIndex++
-	n.LastSlaveIndex = n.LastSlaveIndex % queueLen
-	return db, nil
+	return name, status
 }
@@ -0,0 +1,42 @@
+package proxyBack
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDecayLatency(t *testing.T) {
+	if d := decayLatency(0, time.Minute); d != 0 {
+		t.Fatal(d)
+	}
+	if d := decayLatency(int64(time.Second), 0); d != time.Second {
+		t.Fatal(d)
+	}
+	if d := decayLatency(int64(time.Second), latencyHalfLife); d != time.Second/2 {
+		t.Fatal(d)
+	}
+}
+
+func TestLatencyBalancerRecover(t *testing.T) {
+	now := time.Now().UnixNano()
+	fast := &DB{latency: int64(10 * time.Millisecond), latencyTime: now}
+	slow := &DB{latency: int64(time.Second), latencyTime: now}
+	slaves := []*DB{slow, fast}
+	weights := []int{1, 1}
+	usable := func(db *DB) bool { return true }
+
+	b := new(latency)
+	if i := b.Next(slaves, weights, usable, false); i != 1 {
+		t.Fatal(i)
+	}
+
+	//慢的从库很久没有被选中, 延迟衰减之后重新参与选择
+	slow.latencyTime = now - int64(10*latencyHalfLife)
+	if i := b.Next(slaves, weights, usable, false); i != 0 {
+		t.Fatal(i)
+	}
+	slow.observeLatency(5 * time.Millisecond)
+	if d := slow.Latency(); d > 10*time.Millisecond {
+		t.Fatal(d)
+	}
+}
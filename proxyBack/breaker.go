@@ -0,0 +1,274 @@
+package proxyBack
+
+import (
+	"sync"
+	"time"
+
+	"brother/core/errors"
+	"brother/core/golog"
+	"brother/mysql"
+)
+
+const (
+	BreakerClosed	= iota
+	//熔断中, 不参与读的负载均衡
+	BreakerOpen
+	//冷却之后放过一个探测请求, 成功则关闭, 失败则重新熔断
+	BreakerHalfOpen
+)
+
+const (
+	DefaultBreakerWindow		= 10 * time.Second
+	DefaultBreakerMinRequests	= 20
+	DefaultBreakerCooldown		= 30 * time.Second
+)
+
+var breakerStateNames = map[int32]string{
+	BreakerClosed:   "closed",
+	BreakerOpen:     "open",
+	BreakerHalfOpen: "half_open",
+}
+
+//Failures和ErrorRatio都为0时不熔断
+type BreakerConfig struct {
+	//连续失败次数
+	Failures			int
+	//Window内的错误比例, 请求数不少于MinRequests时才判断
+	ErrorRatio			float64
+	Window				time.Duration
+	MinRequests			int
+	//熔断之后进入半开的时间
+	Cooldown			time.Duration
+}
+
+func (cfg BreakerConfig) Enabled() bool {
+	return cfg.Failures > 0 || cfg.ErrorRatio > 0
+}
+
+//每秒一个桶的滑动窗口
+type breakerBucket struct {
+	sec				int64
+	total				int64
+	failed				int64
+}
+
+type breaker struct {
+	sync.Mutex
+	addr				string
+	cfg				BreakerConfig
+
+	state				int32
+	consecutive			int
+	buckets				[]breakerBucket
+	openedAt			time.Time
+	probeAt				time.Time
+}
+
+func newBreaker(addr string, cfg BreakerConfig) *breaker {
+	if cfg.Window <= 0 {
+		cfg.Window = DefaultBreakerWindow
+	}
+	if cfg.MinRequests <= 0 {
+		cfg.MinRequests = DefaultBreakerMinRequests
+	}
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = DefaultBreakerCooldown
+	}
+	seconds := int(cfg.Window / time.Second)
+	if seconds < 1 {
+		seconds = 1
+	}
+	return &breaker{addr: addr, cfg: cfg, buckets: make([]breakerBucket, seconds)}
+}
+
+//不改变状态, 判断是否可以发送请求; 探测请求超过冷却时间没有结果时允许再次探测
+func (b *breaker) ready() bool {
+	b.Lock()
+	defer b.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		return b.cfg.Cooldown <= time.Since(b.openedAt)
+	case BreakerHalfOpen:
+		return b.cfg.Cooldown <= time.Since(b.probeAt)
+	}
+	return true
+}
+
+//请求被选中之后调用, 检查并占用探测的位置在同一次加锁中完成, 半开状态只放过一个探测请求
+//熔断中的DB转为半开并记录探测开始的时间, 返回false说明探测已经被其他请求占用
+func (b *breaker) tryAcquire() bool {
+	b.Lock()
+	defer b.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if time.Since(b.openedAt) < b.cfg.Cooldown {
+			return false
+		}
+		b.setState(BreakerHalfOpen)
+	case BreakerHalfOpen:
+		if time.Since(b.probeAt) < b.cfg.Cooldown {
+			return false
+		}
+	default:
+		return true
+	}
+	b.probeAt = time.Now()
+	return true
+}
+
+func (b *breaker) record(failed bool) {
+	b.Lock()
+	defer b.Unlock()
+
+	now := time.Now()
+	bucket := &b.buckets[now.Unix()%int64(len(b.buckets))]
+	if bucket.sec != now.Unix() {
+		*bucket = breakerBucket{sec: now.Unix()}
+	}
+	bucket.total++
+
+	if !failed {
+		b.consecutive = 0
+		if b.state == BreakerHalfOpen {
+			b.resetWindow()
+			b.setState(BreakerClosed)
+		}
+		return
+	}
+
+	bucket.failed++
+	b.consecutive++
+	switch b.state {
+	case BreakerHalfOpen:
+		b.open(now)
+	case BreakerClosed:
+		if b.cfg.Failures > 0 && b.consecutive >= b.cfg.Failures {
+			b.open(now)
+			return
+		}
+		total, errs := b.window(now)
+		if b.cfg.ErrorRatio > 0 && int(total) >= b.cfg.MinRequests &&
+			float64(errs)/float64(total) >= b.cfg.ErrorRatio {
+			b.open(now)
+		}
+	}
+}
+
+func (b *breaker) open(now time.Time) {
+	b.openedAt = now
+	b.setState(BreakerOpen)
+}
+
+func (b *breaker) setState(state int32) {
+	if b.state == state {
+		return
+	}
+	total, errs := b.window(time.Now())
+	golog.Warn("DB", "breaker", "state changed", 0, "db.Addr", b.addr,
+		"from", breakerStateNames[b.state], "to", breakerStateNames[state],
+		"consecutive_failures", b.consecutive, "window_requests", total, "window_errors", errs)
+	b.state = state
+}
+
+func (b *breaker) window(now time.Time) (int64, int64) {
+	var total, failed int64
+	start := now.Unix() - int64(len(b.buckets))
+	for _, bucket := range b.buckets {
+		if start < bucket.sec {
+			total += bucket.total
+			failed += bucket.failed
+		}
+	}
+	return total, failed
+}
+
+func (b *breaker) resetWindow() {
+	for i := range b.buckets {
+		b.buckets[i] = breakerBucket{}
+	}
+}
+
+//服务端返回的sql错误说明连接正常, 只有连接、超时等错误计为失败
+func isBreakerFailure(err error) bool {
+	if err == nil {
+		return false
+	}
+	_, ok := err.(*mysql.SqlError)
+	return !ok
+}
+
+//DB已经关闭或者等待连接池超时
+func isPoolError(err error) bool {
+	if err == errors.ErrDatabaseClose {
+		return true
+	}
+	e, ok := err.(*mysql.SqlError)
+	return ok && e.Code == mysql.ER_CON_COUNT_ERROR
+}
+
+/**
+ * ################################### DB breaker ###########################################
+ */
+
+//熔断器的状态, 用于admin查看
+type BreakerStatus struct {
+	State				string
+	Consecutive			int
+	Requests			int64
+	Errors				int64
+	OpenedAt			time.Time
+}
+
+func (db *DB) SetBreaker(cfg BreakerConfig) {
+	var b *breaker
+	if cfg.Enabled() {
+		b = newBreaker(db.addr, cfg)
+	}
+	db.Lock()
+	db.breaker = b
+	db.Unlock()
+}
+
+func (db *DB) getBreaker() *breaker {
+	db.RLock()
+	defer db.RUnlock()
+	return db.breaker
+}
+
+func (db *DB) breakerReady() bool {
+	if b := db.getBreaker(); b != nil {
+		return b.ready()
+	}
+	return true
+}
+
+func (db *DB) breakerTryAcquire() bool {
+	if b := db.getBreaker(); b != nil {
+		return b.tryAcquire()
+	}
+	return true
+}
+
+func (db *DB) breakerRecord(err error) {
+	if b := db.getBreaker(); b != nil {
+		b.record(isBreakerFailure(err))
+	}
+}
+
+//没有配置熔断时返回nil
+func (db *DB) Breaker() *BreakerStatus {
+	b := db.getBreaker()
+	if b == nil {
+		return nil
+	}
+	b.Lock()
+	defer b.Unlock()
+	total, errs := b.window(time.Now())
+	return &BreakerStatus{
+		State:       breakerStateNames[b.state],
+		Consecutive: b.consecutive,
+		Requests:    total,
+		Errors:      errs,
+		OpenedAt:    b.openedAt,
+	}
+}
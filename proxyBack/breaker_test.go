@@ -0,0 +1,124 @@
+package proxyBack
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	brerrors "brother/core/errors"
+	"brother/mysql"
+)
+
+var errTestNetwork = errors.New("connection reset by peer")
+
+func TestBreakerConsecutiveFailures(t *testing.T) {
+	b := newBreaker("127.0.0.1:3306", BreakerConfig{Failures: 3, Cooldown: time.Minute})
+
+	b.record(true)
+	b.record(true)
+	b.record(false)
+	b.record(true)
+	b.record(true)
+	if b.state != BreakerClosed || !b.ready() {
+		t.Fatal("success must reset consecutive failures")
+	}
+	b.record(true)
+	if b.state != BreakerOpen || b.ready() {
+		t.Fatal("breaker must be open after 3 consecutive failures")
+	}
+
+	//冷却之后放过一个探测请求, 失败则重新熔断
+	b.openedAt = time.Now().Add(-2 * time.Minute)
+	if !b.ready() {
+		t.Fatal("breaker must be ready after cooldown")
+	}
+	if !b.tryAcquire() {
+		t.Fatal("first probe must be acquired after cooldown")
+	}
+	if b.state != BreakerHalfOpen || b.ready() || b.tryAcquire() {
+		t.Fatal("only one probe is allowed in half open state")
+	}
+	b.record(true)
+	if b.state != BreakerOpen || b.ready() {
+		t.Fatal("failed probe must open the breaker again")
+	}
+
+	//探测成功则关闭
+	b.openedAt = time.Now().Add(-2 * time.Minute)
+	b.tryAcquire()
+	b.record(false)
+	if b.state != BreakerClosed || !b.ready() {
+		t.Fatal("succeeded probe must close the breaker")
+	}
+	if total, errs := b.window(time.Now()); total != 0 || errs != 0 {
+		t.Fatal(total, errs)
+	}
+
+	//探测超过冷却时间没有结果时允许再次探测
+	b.open(time.Now().Add(-2 * time.Minute))
+	b.tryAcquire()
+	b.probeAt = time.Now().Add(-2 * time.Minute)
+	if !b.ready() {
+		t.Fatal("probe without result must be retried after cooldown")
+	}
+}
+
+func TestBreakerSingleProbe(t *testing.T) {
+	b := newBreaker("127.0.0.1:3306", BreakerConfig{Failures: 1, Cooldown: time.Minute})
+	b.open(time.Now().Add(-2 * time.Minute))
+
+	//冷却之后同时到达的请求只有一个成为探测请求
+	var acquired int32
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < 64; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			if b.ready() && b.tryAcquire() {
+				atomic.AddInt32(&acquired, 1)
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if acquired != 1 || b.state != BreakerHalfOpen {
+		t.Fatal("exactly one probe must be acquired", acquired)
+	}
+}
+
+func TestBreakerErrorRatio(t *testing.T) {
+	b := newBreaker("127.0.0.1:3306", BreakerConfig{ErrorRatio: 0.5, MinRequests: 10})
+
+	for i := 0; i < 4; i++ {
+		b.record(false)
+		b.record(true)
+	}
+	if b.state != BreakerClosed {
+		t.Fatal("breaker must not open before MinRequests")
+	}
+	b.record(false)
+	b.record(true)
+	if b.state != BreakerOpen {
+		t.Fatal("breaker must open when error ratio reached")
+	}
+}
+
+func TestBreakerFailure(t *testing.T) {
+	if isBreakerFailure(nil) || isBreakerFailure(mysql.NewDefaultError(mysql.ER_NO_SUCH_TABLE, "db", "t")) {
+		t.Fatal("sql error is not breaker failure")
+	}
+	if !isBreakerFailure(errTestNetwork) {
+		t.Fatal("network error is breaker failure")
+	}
+
+	if !isPoolError(brerrors.ErrDatabaseClose) || !isPoolError(mysql.NewError(mysql.ER_CON_COUNT_ERROR, "Too many connections")) {
+		t.Fatal("local pool error must not be recorded")
+	}
+	if isPoolError(errTestNetwork) {
+		t.Fatal(errTestNetwork)
+	}
+}
@@ -6,10 +6,16 @@ import (
 	"strings"
 	"errors"
 	f"fmt"
+	brerrors "brother/core/errors"
 	"bytes"
 	"encoding/binary"
+	"sort"
+	"time"
 )
 
+//建立到mysql server的TCP连接的超时时间
+var DialTimeout = 3 * time.Second
+
 //proxy <-> mysql server
 type Conn struct {
 	conn 				net.Conn // 与mysql server之间真正的TCP长连接
@@ -27,9 +33,15 @@ type Conn struct {
 
 	collation			mysql.CollationId
 	charset				string
+	sysVars				map[string]string //当前连接上已设置的会话变量
 	salt				[]byte
 
-	pushTimestamp			int64
+	createdAt			time.Time
+	pushTimestamp			int64 //归还连接池的时间
+	dirty				bool  //借出过, 复用前需要清理会话状态
+	//复用的prepare语句, 见stmt.go
+	stmtCache			map[string]*Stmt
+	stmtOrder			[]string
 	pkgErr				error
 }
 
@@ -50,13 +62,15 @@ func (c *Conn) ReConnect() error {
 	if c.conn != nil {
 		c.conn.Close()
 	}
+	c.sysVars = nil
+	c.clearStmtCache()
 	//三种连接 mysql数据库 的方法 这里默认使用tcp
 	n := "tcp"
 	if strings.Contains(c.addr, "/") {
 		n = "unix"
 	}
 
-	netConn, err := net.Dial(n, c.addr)
+	netConn, err := net.DialTimeout(n, c.addr, DialTimeout)
 	if err != nil {
 		return err
 	}
@@ -72,6 +86,10 @@ func (c *Conn) ReConnect() error {
 	c.conn = tcpConn
 	c.pkg = mysql.NewPacketIO(tcpConn)
 
+	//握手阶段也使用连接超时, 避免后端不响应时一直阻塞
+	tcpConn.SetDeadline(time.Now().Add(DialTimeout))
+	defer tcpConn.SetDeadline(time.Time{})
+
 	if err := c.readInitialHandshake(); err != nil {
 		c.conn.Close()
 		return err
@@ -314,6 +332,14 @@ func (c *Conn) writeCommandStrStr(command byte, arg1, arg2 string) error {
 	return c.writePacket(data)
 }
 
+//t为零值时取消超时
+func (c *Conn) SetDeadline(t time.Time) error {
+	if c.conn == nil {
+		return mysql.ErrBadConn
+	}
+	return c.conn.SetDeadline(t)
+}
+
 func (c *Conn) Ping() error {
 	if err := c.writeCommand(mysql.COM_PING); err != nil{
 		return err
@@ -325,6 +351,102 @@ func (c *Conn) Ping() error {
 	return nil
 }
 
+//COM_RESET_CONNECTION(MySQL 5.7.3+): 清除临时表、用户变量、prepare、GET_LOCK等会话状态, 不重新认证
+//会话变量恢复为全局值, 字符集需要重新设置
+func (c *Conn) ResetConnection() error {
+	if err := c.writeCommand(mysql.COM_RESET_CONNECTION); err != nil {
+		return err
+	}
+	if _, err := c.readOK(); err != nil {
+		return err
+	}
+
+	c.charset = ""
+	c.sysVars = nil
+	c.clearStmtCache()
+	return nil
+}
+
+//COM_CHANGE_USER: 以当前用户重新认证, 会话状态与新建的连接相同
+func (c *Conn) ChangeUser() error {
+	auth := mysql.CalcPassword(c.salt, []byte(c.passwd))
+
+	data := make([]byte, 4, 4 + 1 + len(c.user) + 1 + 1 + len(auth) + len(c.db) + 1 + 2)
+	data = append(data, mysql.COM_CHANGE_USER)
+	//user [null terminated string]
+	data = append(data, c.user...)
+	data = append(data, 0)
+	//auth [length encoded]
+	data = append(data, byte(len(auth)))
+	data = append(data, auth...)
+	//db [null terminated string]
+	data = append(data, c.db...)
+	data = append(data, 0)
+	//charset [2 bytes]
+	data = append(data, byte(c.collation), 0)
+
+	c.pkg.Sequence = 0
+	if err := c.writePacket(data); err != nil {
+		return err
+	}
+	if err := c.readChangeUserOK(); err != nil {
+		return err
+	}
+
+	c.sysVars = nil
+	c.clearStmtCache()
+	return nil
+}
+
+//服务端可能回复AuthSwitchRequest: 0xfe + 插件名[null terminated] + 新的salt
+//只支持切换到mysql_native_password, 只有0xfe时是要求切换到mysql_old_password
+func (c *Conn) readChangeUserOK() error {
+	data, err := c.readPacket()
+	if err != nil {
+		return err
+	}
+	switch data[0] {
+	case mysql.OK_HEADER:
+		_, err = c.handleOKPacket(data)
+		return err
+	case mysql.ERR_HEADER:
+		return c.handleErrorPacket(data)
+	case mysql.EOF_HEADER:
+	default:
+		return errors.New("invalid ok packet.")
+	}
+
+	plugin, salt, ok := parseAuthSwitch(data)
+	if !ok || plugin != mysql.AUTH_NAME {
+		return brerrors.ErrAuthPlugin
+	}
+	if err = c.writePacket(mysql.CalcPassword(salt, []byte(c.passwd))); err != nil {
+		return err
+	}
+	if _, err = c.readOK(); err != nil {
+		return err
+	}
+	c.salt = salt
+	return nil
+}
+
+func parseAuthSwitch(data []byte) (string, []byte, bool) {
+	if len(data) < 2 {
+		return "", nil, false
+	}
+	end := bytes.IndexByte(data[1:], 0x00)
+	if end < 0 {
+		return "", nil, false
+	}
+	plugin := string(data[1 : 1+end])
+	salt := data[1+end+1:]
+	//salt以0x00结尾
+	if n := len(salt); 0 < n && salt[n-1] == 0x00 {
+		salt = salt[:n-1]
+	}
+	return plugin, append([]byte(nil), salt...), true
+}
+
 func (c *Conn) UseDB(dbName string) error {
 	if c.db == dbName || len(dbName) == 0 {
 		return nil
@@ -384,6 +506,77 @@ func (c *Conn) Rollback() error {
 	return err
 }
 
+/**
+ * ################################### XA transaction ###########################################
+ */
+
+//XA事务的标识: gtrid标识全局事务, bqual标识事务在某个节点上的分支
+type XID struct {
+	Gtrid string
+	Bqual string
+}
+
+func (x XID) String() string {
+	return f.Sprintf("'%s','%s'",
+		strings.Replace(x.Gtrid, "'", "''", -1),
+		strings.Replace(x.Bqual, "'", "''", -1))
+}
+
+func (c *Conn) XAStart(xid XID) error {
+	_, err := c.exec("XA START " + xid.String())
+	return err
+}
+
+func (c *Conn) XAEnd(xid XID) error {
+	_, err := c.exec("XA END " + xid.String())
+	return err
+}
+
+func (c *Conn) XAPrepare(xid XID) error {
+	_, err := c.exec("XA PREPARE " + xid.String())
+	return err
+}
+
+//只有一个分支时不需要prepare, 直接one phase提交
+func (c *Conn) XACommit(xid XID, onePhase bool) error {
+	sql := "XA COMMIT " + xid.String()
+	if onePhase {
+		sql += " ONE PHASE"
+	}
+	_, err := c.exec(sql)
+	return err
+}
+
+func (c *Conn) XARollback(xid XID) error {
+	_, err := c.exec("XA ROLLBACK " + xid.String())
+	return err
+}
+
+//返回该mysql上所有处于prepared状态的XA事务
+func (c *Conn) XARecover() ([]XID, error) {
+	r, err := c.exec("XA RECOVER")
+	if err != nil {
+		return nil, err
+	}
+
+	xids := make([]XID, 0, r.RowNumber())
+	for i := 0; i < r.RowNumber(); i++ {
+		gtridLen, err := r.GetIntByName(i, "gtrid_length")
+		if err != nil {
+			return nil, err
+		}
+		data, err := r.GetStringByName(i, "data")
+		if err != nil {
+			return nil, err
+		}
+		if int(gtridLen) > len(data) {
+			return nil, f.Errorf("invalid xa recover data %s", data)
+		}
+		xids = append(xids, XID{Gtrid: data[:gtridLen], Bqual: data[gtridLen:]})
+	}
+	return xids, nil
+}
+
 func (c *Conn) SetAutoCommit(n uint8) error {
 	if n == 0 {
 		if _, err := c.exec("set autocommit = 0"); err != nil {
@@ -417,7 +610,7 @@ func (c *Conn) SetCharset(charset string, collation mysql.CollationId) error {
 	
 	_, ok = mysql.Collations[collation]
 	if !ok {
-		return f.Errorf("Invalid collation %s.", collation)
+		return f.Errorf("Invalid collation %d.", collation)
 	}
 
 	if _, err := c.exec(f.Sprintf("SET NAMES %s COLLATE %s", charset, mysql.Collations[collation])); err != nil{
@@ -429,6 +622,52 @@ func (c *Conn) SetCharset(charset string, collation mysql.CollationId) error {
 	}
 }
 
+//只执行与当前连接不同的部分, 客户端没有设置的变量恢复成默认值
+func (c *Conn) SetSysVars(vars map[string]string) error {
+	sql := sysVarsSql(c.sysVars, vars)
+	if len(sql) == 0 {
+		return nil
+	}
+	if _, err := c.exec(sql); err != nil {
+		return err
+	}
+
+	c.sysVars = make(map[string]string, len(vars))
+	for k, v := range vars {
+		c.sysVars[k] = v
+	}
+	return nil
+}
+
+//从cur变成vars需要执行的SET语句, 没有变化时为空
+func sysVarsSql(cur map[string]string, vars map[string]string) string {
+	names := make([]string, 0, len(vars))
+	for k, v := range vars {
+		if old, ok := cur[k]; !ok || old != v {
+			names = append(names, k)
+		}
+	}
+	for k := range cur {
+		if _, ok := vars[k]; !ok {
+			names = append(names, k)
+		}
+	}
+	if len(names) == 0 {
+		return ""
+	}
+	sort.Strings(names)
+
+	sets := make([]string, 0, len(names))
+	for _, k := range names {
+		if v, ok := vars[k]; ok {
+			sets = append(sets, f.Sprintf("@@session.%s = %s", k, v))
+		} else {
+			sets = append(sets, f.Sprintf("@@session.%s = DEFAULT", k))
+		}
+	}
+	return "SET " + strings.Join(sets, ", ")
+}
+
 func (c *Conn) FieldList(table string, wildcard string) ([]*mysql.Field, error) {
 	if err := c.writeCommandStrStr(mysql.COM_FIELD_LIST, table, wildcard); err != nil {
 		return nil, err
@@ -460,8 +699,6 @@ func (c *Conn) FieldList(table string, wildcard string) ([]*mysql.Field, error)
 			fs = append(fs, fd)
 		}
 	}
-
-	return nil, f.Errorf("field list error")
 }
 
 func (c *Conn) readOK() (*mysql.Result, error) {
@@ -605,7 +842,6 @@ func (c *Conn) readUntilEOF() (err error) {
 			return
 		}
 	}
-	return
 }
 
 func (c *Conn) handleOKPacket(data []byte) (*mysql.Result, error) {
@@ -0,0 +1,50 @@
+package proxyBack
+
+import (
+	"bytes"
+	"testing"
+
+	"brother/mysql"
+)
+
+func TestParseAuthSwitch(t *testing.T) {
+	salt := []byte("0123456789abcdefghij")
+	data := append([]byte{mysql.EOF_HEADER}, mysql.AUTH_NAME...)
+	data = append(data, 0)
+	data = append(data, salt...)
+	data = append(data, 0)
+
+	plugin, s, ok := parseAuthSwitch(data)
+	if !ok || plugin != mysql.AUTH_NAME || !bytes.Equal(s, salt) {
+		t.Fatal(plugin, s, ok)
+	}
+
+	//只有0xfe时是切换到mysql_old_password
+	if _, _, ok := parseAuthSwitch([]byte{mysql.EOF_HEADER}); ok {
+		t.Fatal("old password auth switch must fail")
+	}
+
+	data = append([]byte{mysql.EOF_HEADER}, "caching_sha2_password"...)
+	data = append(data, 0)
+	if plugin, _, ok := parseAuthSwitch(data); !ok || plugin != "caching_sha2_password" {
+		t.Fatal(plugin, ok)
+	}
+}
+
+func TestSysVarsSql(t *testing.T) {
+	cur := map[string]string{"sql_mode": "''", "time_zone": "'+08:00'"}
+	if sql := sysVarsSql(cur, map[string]string{"sql_mode": "''", "time_zone": "'+08:00'"}); sql != "" {
+		t.Fatal(sql)
+	}
+
+	//只设置变化的变量, 客户端没有设置的恢复成默认值
+	vars := map[string]string{"time_zone": "'+00:00'", "sql_safe_updates": "1"}
+	if sql := sysVarsSql(cur, vars); sql != "SET @@session.sql_mode = DEFAULT, "+
+		"@@session.sql_safe_updates = 1, @@session.time_zone = '+00:00'" {
+		t.Fatal(sql)
+	}
+
+	if sql := sysVarsSql(nil, map[string]string{"sql_mode": "'ANSI'"}); sql != "SET @@session.sql_mode = 'ANSI'" {
+		t.Fatal(sql)
+	}
+}
@@ -1,6 +1,7 @@
 package proxyBack
 
 import (
+	"math"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -13,10 +14,14 @@ const (
 	Down
 	ManualDown
 	Unknown
+	//从库复制延迟超过max_slave_lag, 暂时不参与读的负载均衡
+	Lagging
 
 	InitConnCount			= 16
 	DefaultMaxConnNum		= 1024
 	PingPeroid		int64	= 4
+
+	DefaultPingTimeout		= 3 * time.Second
 )
 
 type DB struct {
@@ -28,80 +33,91 @@ type DB struct {
 	db				string
 	state				int32
 
-	maxConnNum			int
-	InitConnNum			int
-	idleConns			chan *Conn
-	cacheConns			chan *Conn
+	//连接池, 见pool.go
+	pool				PoolConfig
+	poolLock			sync.Mutex
+	idle				[]*Conn
+	numOpen				int
+	waiters				[]chan connRequest
+	closed				bool
+	stopCh				chan struct{}
+	waitCount			int64
+	waitDuration			int64
+	waitTimeouts			int64
+	closedIdle			int64
+	closedLifetime			int64
+	//服务端不支持COM_RESET_CONNECTION时为1
+	noResetConn			int32
+	//用户的认证插件不是mysql_native_password, 不能使用COM_CHANGE_USER
+	noChangeUser			int32
+
 	checkConn			*Conn
 	lastPing			int64
+
+	//健康检查: checkLock保证同一时间只有一个ping使用checkConn
+	checkLock			sync.Mutex
+	pingTimeout			time.Duration
+	lastCheckTime			time.Time
+	lastCheckLatency		time.Duration
+	lastCheckErr			error
+	replication			*ReplicationStatus
+
+	//负载均衡: 借出的连接数和查询延迟的EWMA(纳秒)
+	borrowed			int64
+	latency				int64
+	latencyTime			int64	//最近一次记录延迟的时间(UnixNano)
+	//没有配置熔断时为nil
+	breaker				*breaker
 }
 
-func Open(addr, user, passwd, dbName string, maxConnNum int) (*DB, error) {
+//只同步建立checkConn, 连接池由后台预热
+func Open(addr, user, passwd, dbName string, pool PoolConfig) (*DB, error) {
 	var err error
 	db := new(DB)
 	db.addr = addr
 	db.user = user
 	db.passwd = passwd
 	db.db = dbName
+	db.pingTimeout = DefaultPingTimeout
+
+	pool.setDefault()
+	db.pool = pool
+	db.stopCh = make(chan struct{})
 
-	if maxConnNum > 0 {
-		db.maxConnNum = maxConnNum
-		if db.maxConnNum < 16 {
-			db.InitConnNum = db.maxConnNum
-		} else {
-			db.InitConnNum = db.maxConnNum / 4
-		}
-	} else {
-		db.maxConnNum = DefaultMaxConnNum
-		db.InitConnNum = InitConnCount
-	}
 	//check connection 建立与mysql 数据库的真正连接
 	db.checkConn, err = db.newConn()
 	if err != nil {
-		db.Close()
 		return nil, err
 	}
-
-	db.idleConns = make(chan *Conn, db.maxConnNum)
-	db.cacheConns = make(chan *Conn, db.maxConnNum)
 	atomic.StoreInt32(&(db.state), Unknown)
-
-	for i := 0; i < db.maxConnNum ; i++ {
-		if i < db.InitConnNum {
-			conn, err := db.newConn()
-			if err != nil {
-				db.Close()
-				return nil, err
-			}
-			conn.pushTimestamp = time.Now().Unix()
-			db.cacheConns <- conn
-		} else {
-			conn := new(Conn)
-			db.idleConns <- conn
-		}
-	}
 	db.SetLastPing()
 
+	go db.maintainPool()
 	return db, nil
 }
 
+//关闭空闲连接, 使用中的连接归还时关闭, 等待中的请求返回ErrDatabaseClose
 func (db *DB) Close() error {
-	db.RLock()
-	idleChannel := db.idleConns
-	cacheChannel := db.cacheConns
-	db.cacheConns = nil
-	db.idleConns = nil
-	db.RUnlock()
-	if cacheChannel == nil || idleChannel == nil {
+	db.poolLock.Lock()
+	if db.closed {
+		db.poolLock.Unlock()
 		return nil
 	}
-
-	close(cacheChannel)
-	for conn := range cacheChannel{
-		db.closeConn(conn)
+	db.closed = true
+	idle := db.idle
+	db.idle = nil
+	db.numOpen -= len(idle)
+	waiters := db.waiters
+	db.waiters = nil
+	close(db.stopCh)
+	db.poolLock.Unlock()
+
+	for _, co := range idle {
+		co.Close()
+	}
+	for _, req := range waiters {
+		req <- connRequest{err: errors.ErrDatabaseClose}
 	}
-	close(idleChannel)
-
 	return nil
 }
 
@@ -112,35 +128,80 @@ func (db *DB) Addr() string {
 	return db.addr
 }
 
-func (db *DB) getConns() (chan *Conn, chan *Conn) {
-	db.RLock()
-	cacheConns := db.cacheConns
-	idleConns := db.idleConns
-	db.RUnlock()
-	return cacheConns, idleConns
+func (db *DB) State() int32 {
+	return atomic.LoadInt32(&(db.state))
 }
 
-func (db *DB) getCacheConns() chan *Conn {
-	db.RLock()
-	conns := db.cacheConns
-	db.RUnlock()
-	return conns
+func (db *DB) SetPingTimeout(timeout time.Duration) {
+	if timeout > 0 {
+		db.pingTimeout = timeout
+	}
 }
 
-func (db *DB) getIdleConns() chan *Conn {
+//最近一次健康检查的时间、耗时和错误
+func (db *DB) LastCheck() (time.Time, time.Duration, error) {
 	db.RLock()
-	conns := db.idleConns
-	db.RUnlock()
-	return conns
+	defer db.RUnlock()
+	return db.lastCheckTime, db.lastCheckLatency, db.lastCheckErr
 }
 
 /**
  * ########################################## DB Conn Managment #############################################
  */
 
+//通过专用的checkConn发送COM_PING, 连接断开时重连一次
 func (db *DB) Ping() error {
+	db.checkLock.Lock()
+	defer db.checkLock.Unlock()
 
-	return nil
+	start := time.Now()
+	err := db.pingCheckConn()
+	if err != nil {
+		if db.checkConn != nil {
+			db.checkConn.Close()
+		}
+		db.checkConn = nil
+		err = db.pingCheckConn()
+	}
+
+	if err == nil {
+		db.observeLatency(time.Since(start))
+	}
+
+	db.Lock()
+	db.lastCheckTime = start
+	db.lastCheckLatency = time.Since(start)
+	db.lastCheckErr = err
+	db.Unlock()
+	return err
+}
+
+//DB被替换之后关闭它的checkConn
+func (db *DB) closeCheckConn() {
+	db.checkLock.Lock()
+	defer db.checkLock.Unlock()
+	if db.checkConn != nil {
+		db.checkConn.Close()
+		db.checkConn = nil
+	}
+}
+
+func (db *DB) pingCheckConn() error {
+	if db.checkConn == nil {
+		co, err := db.newConn()
+		if err != nil {
+			return err
+		}
+		db.checkConn = co
+	}
+
+	if err := db.checkConn.SetDeadline(time.Now().Add(db.pingTimeout)); err != nil {
+		return err
+	}
+	if err := db.checkConn.Ping(); err != nil {
+		return err
+	}
+	return db.checkConn.SetDeadline(time.Time{})
 }
 
 func (db *DB) newConn() (*Conn, error) {
@@ -149,27 +210,19 @@ func (db *DB) newConn() (*Conn, error) {
 	if err := co.Connect(db.addr, db.user, db.passwd, db.db); err != nil {
 		return nil, err
 	}
+	co.createdAt = time.Now()
 	return co, nil
 }
 
-func (db *DB) closeConn(co *Conn) error {
-	if co != nil {
-		co.Close()
-		conns := db.getIdleConns()
-		if conns != nil {
-			select {
-			case conns <- co:
-				return nil
-			default:
-				return nil
-			}
+func (db *DB) tryReuse(co *Conn) error {
+	var err error
+	if co.dirty && db.pool.Reset != ResetNone {
+		if err = db.resetConn(co); err != nil {
+			return err
 		}
+		co.dirty = false
 	}
-	return nil
-}
 
-func (db *DB) tryReuse(co *Conn) error {
-	var err error
 	//reuse Connection
 	if co.IsInTransaction() {
 		//we can not reuse a connection in transaction status
@@ -200,100 +253,33 @@ func (db *DB) tryReuse(co *Conn) error {
 }
 
 func (db *DB) PopConn() (*Conn, error) {
-	var co *Conn
-	var err error
-
-	cacheConns, idleConns := db.getConns()
-	if cacheConns == nil || idleConns == nil {
-		return nil, errors.ErrDatabaseClose
-	}
-	co = db.GetConnFromCache(cacheConns)
-	if co == nil {
-		co, err = db.GetConnFromIdle(cacheConns, idleConns)
-		if err != nil {
-			return nil, err
-		}
-	}
-
-	err = db.tryReuse(co)
+	co, err := db.getConn()
 	if err != nil {
-		db.closeConn(co)
 		return nil, err
 	}
-	return co, nil
-}
 
-func (db *DB) GetConnFromCache(cacheConns chan *Conn) (*Conn) {
-	var co *Conn
-	var err error
-	for len(cacheConns) > 0 {
-		co = <- cacheConns
-		if co != nil && PingPeroid < time.Now().Unix()-co.pushTimestamp {
-			err = co.Ping()
-			if err != nil {
-				db.closeConn(co)
-				co = nil
-			}
-		}
-		if co != nil {
-			break
-		}
-	}
-	return co
-}
-
-func (db *DB) GetConnFromIdle(cacheConns, idleConns chan *Conn) (*Conn, error) {
-	var co *Conn
-	var err error
-	select {
-	case co = <- idleConns:
-		err = co.Connect(db.addr, db.user, db.passwd, db.db)
-		if err != nil {
-			db.closeConn(co)
+	err = db.tryReuse(co)
+	if err == errors.ErrAuthPlugin {
+		//认证切换失败的连接已经不可用, 之后不再使用COM_CHANGE_USER, 换一个连接
+		db.putConn(co, true)
+		if co, err = db.getConn(); err != nil {
 			return nil, err
 		}
-		return co, nil
-	case co = <- cacheConns:
-		if co == nil {
-			return nil, errors.ErrConnIsNil
-		}
-		if co != nil && PingPeroid < time.Now().Unix()-co.pushTimestamp {
-			err = co.Ping()
-			if err != nil {
-				db.closeConn(co)
-				return nil, errors.ErrBadConn
-			}
-		}
+		err = db.tryReuse(co)
 	}
+	if err != nil {
+		db.putConn(co, true)
+		return nil, err
+	}
+	co.dirty = true
 	return co, nil
 }
 
+//err不为nil时连接被关闭, 否则放回连接池
 func (db *DB) PushConn(co *Conn, err error) {
-	if co == nil {
-		return
-	}
-
-	conns := db.getCacheConns()
-	if conns == nil {
-		co.Close()
-		return
-	}
-	if err != nil {
-		db.closeConn(co)
-		return
-	}
-
-	co.pushTimestamp = time.Now().Unix()
-	select {
-	case conns <- co:
-		return
-	default:
-		db.closeConn(co)
-		return
-	}
+	db.putConn(co, err != nil)
 }
 
-
 /**
  * ################################# BackConn Struct ################################################
  */
@@ -305,11 +291,8 @@ type BackendConn struct {
 
 func (p *BackendConn) Close()  {
 	if p != nil && p.Conn != nil {
-		if p.Conn.pkgErr != nil {
-			p.db.closeConn(p.Conn)
-		} else {
-
-		}
+		atomic.AddInt64(&(p.db.borrowed), -1)
+		p.db.PushConn(p.Conn, p.Conn.pkgErr)
 		p.Conn = nil
 	}
 }
@@ -325,7 +308,59 @@ func (db *DB) GetLastPing() int64 {
 func (db *DB) GetConn() (*BackendConn, error) {
 	c, err := db.PopConn()
 	if err != nil {
+		//连接池本地的错误不说明后端不可用
+		if !isPoolError(err) {
+			db.breakerRecord(err)
+		}
 		return nil, err
 	}
+	atomic.AddInt64(&(db.borrowed), 1)
 	return &BackendConn{c, db}, nil
+}
+
+//记录查询耗时和结果, 用于按延迟的负载均衡和熔断
+func (p *BackendConn) Execute(command string, args ...interface{}) (*mysql.Result, error) {
+	start := time.Now()
+	r, err := p.Conn.Execute(command, args...)
+	if err == nil {
+		p.db.observeLatency(time.Since(start))
+	}
+	p.db.breakerRecord(err)
+	return r, err
+}
+
+//权重为1/latencyDecay的指数加权移动平均
+const latencyDecay = 5
+
+//没有新的查询时延迟按半衰期衰减, 慢过的从库过一段时间会重新被选中, 从而刷新延迟
+const latencyHalfLife = 10 * time.Second
+
+func (db *DB) observeLatency(d time.Duration) {
+	old := int64(db.Latency())
+	now := time.Now().UnixNano()
+	atomic.StoreInt64(&(db.latencyTime), now)
+	if old == 0 {
+		atomic.StoreInt64(&(db.latency), int64(d))
+		return
+	}
+	atomic.StoreInt64(&(db.latency), old+(int64(d)-old)/latencyDecay)
+}
+
+//当前借出的连接数
+func (db *DB) Borrowed() int64 {
+	return atomic.LoadInt64(&(db.borrowed))
+}
+
+//最近查询延迟的EWMA, 没有数据时为0
+func (db *DB) Latency() time.Duration {
+	latency := atomic.LoadInt64(&(db.latency))
+	elapsed := time.Now().UnixNano() - atomic.LoadInt64(&(db.latencyTime))
+	return decayLatency(latency, time.Duration(elapsed))
+}
+
+func decayLatency(latency int64, elapsed time.Duration) time.Duration {
+	if latency == 0 || elapsed <= 0 {
+		return time.Duration(latency)
+	}
+	return time.Duration(float64(latency) * math.Exp2(-float64(elapsed)/float64(latencyHalfLife)))
 }
\ No newline at end of file
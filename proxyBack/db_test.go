@@ -0,0 +1,172 @@
+package proxyBack
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"brother/mysql"
+)
+
+//只完成握手和回复COM_PING的mysql, hang为1时不回复COM_PING
+type testMysql struct {
+	l		net.Listener
+	accepted	int32
+	hang		int32
+
+	lock		sync.Mutex
+	conns		[]net.Conn
+}
+
+func newTestMysql(t *testing.T) *testMysql {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &testMysql{l: l}
+	go func() {
+		for {
+			co, err := l.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&m.accepted, 1)
+			m.lock.Lock()
+			m.conns = append(m.conns, co)
+			m.lock.Unlock()
+			go m.serve(co)
+		}
+	}()
+	return m
+}
+
+func (m *testMysql) Addr() string {
+	return m.l.Addr().String()
+}
+
+func (m *testMysql) Accepted() int32 {
+	return atomic.LoadInt32(&m.accepted)
+}
+
+//断开已经建立的连接, 模拟连接被mysql关闭
+func (m *testMysql) CloseConns() {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	for _, co := range m.conns {
+		co.Close()
+	}
+	m.conns = nil
+}
+
+func (m *testMysql) Close() {
+	m.l.Close()
+	m.CloseConns()
+}
+
+func (m *testMysql) serve(co net.Conn) {
+	defer co.Close()
+	pkg := mysql.NewPacketIO(co)
+	status := uint16(mysql.SERVER_STATUS_AUTOCOMMIT)
+	capability := uint32(mysql.CLIENT_PROTOCOL_41 | mysql.CLIENT_SECURE_CONNECTION | mysql.CLIENT_LONG_PASSWORD |
+		mysql.CLIENT_TRANSACTIONS | mysql.CLIENT_LONG_FLAG)
+	ok := []byte{0, 0, 0, 0, mysql.OK_HEADER, 0, 0, byte(status), byte(status >> 8), 0, 0}
+
+	//protocol version, server version, connection id, salt, capability, charset, status
+	data := make([]byte, 4, 128)
+	data = append(data, 10)
+	data = append(data, "5.7.0-test"...)
+	data = append(data, 0, 1, 0, 0, 0)
+	data = append(data, "12345678"...)
+	data = append(data, 0, byte(capability), byte(capability>>8), 33, byte(status), byte(status>>8))
+	data = append(data, byte(capability>>16), byte(capability>>24), 21)
+	data = append(data, make([]byte, 10)...)
+	data = append(data, "123456789012"...)
+	data = append(data, 0)
+	if pkg.WritePacket(data) != nil {
+		return
+	}
+	if _, err := pkg.ReadPacket(); err != nil {
+		return
+	}
+	if pkg.WritePacket(ok) != nil {
+		return
+	}
+
+	for {
+		pkg.Sequence = 0
+		data, err := pkg.ReadPacket()
+		if err != nil || data[0] == mysql.COM_QUIT {
+			return
+		}
+		if data[0] == mysql.COM_PING && atomic.LoadInt32(&m.hang) == 1 {
+			continue
+		}
+		if pkg.WritePacket(ok) != nil {
+			return
+		}
+	}
+}
+
+//不启动连接池的维护, 连接都由健康检查建立
+func newTestDB(addr string) *DB {
+	return &DB{addr: addr, user: "root", state: Unknown, pingTimeout: DefaultPingTimeout, stopCh: make(chan struct{})}
+}
+
+func TestPingTimeout(t *testing.T) {
+	m := newTestMysql(t)
+	defer m.Close()
+	db := newTestDB(m.Addr())
+	defer db.closeCheckConn()
+
+	//mysql不回复COM_PING时在pingTimeout之后返回, 重连之后再等一次
+	atomic.StoreInt32(&m.hang, 1)
+	db.SetPingTimeout(100 * time.Millisecond)
+	start := time.Now()
+	if err := db.Ping(); err == nil {
+		t.Fatal("ping must time out")
+	}
+	if d := time.Since(start); d < 100*time.Millisecond || time.Second < d {
+		t.Fatal("ping must honour the timeout", d)
+	}
+
+	checkTime, latency, err := db.LastCheck()
+	if err == nil || checkTime.Before(start) || latency < 100*time.Millisecond {
+		t.Fatal(checkTime, latency, err)
+	}
+}
+
+func TestPingReconnect(t *testing.T) {
+	m := newTestMysql(t)
+	defer m.Close()
+	db := newTestDB(m.Addr())
+	defer db.closeCheckConn()
+
+	start := time.Now()
+	if err := db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if n := m.Accepted(); n != 1 {
+		t.Fatal("accepted", n)
+	}
+	checkTime, latency, err := db.LastCheck()
+	if err != nil || checkTime.Before(start) || latency <= 0 {
+		t.Fatal(checkTime, latency, err)
+	}
+
+	//checkConn被断开之后只重连一次
+	m.CloseConns()
+	if err := db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if n := m.Accepted(); n != 2 {
+		t.Fatal("accepted", n)
+	}
+	if err := db.Ping(); err != nil {
+		t.Fatal(err)
+	}
+	if n := m.Accepted(); n != 2 {
+		t.Fatal("accepted", n)
+	}
+}
@@ -0,0 +1,399 @@
+package proxyBack
+
+import (
+	f "fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"brother/core/errors"
+	"brother/core/golog"
+	"brother/mysql"
+)
+
+const (
+	DefaultFailoverCooldown	= 300 * time.Second
+	//提升之前等待候选从库的SQL线程执行完relay log的最长时间
+	FailoverCatchUpTimeout	= 30 * time.Second
+
+	maxFailoverEvents	= 128
+)
+
+//故障切换的每一步都记录一个事件, 通过admin查看
+type FailoverEvent struct {
+	Time				time.Time
+	Node				string
+	Step				string
+	Message				string
+}
+
+var (
+	stopSlaveSqls	= []string{"STOP SLAVE", "STOP REPLICA"}
+	resetSlaveSqls	= []string{"RESET SLAVE ALL", "RESET REPLICA ALL"}
+	startSlaveSqls	= []string{"START SLAVE", "START REPLICA"}
+)
+
+func (n *Node) addFailoverEvent(step, message string) {
+	golog.Warn("Node", "Failover", message, 0, "node", n.String(), "step", step)
+
+	n.eventLock.Lock()
+	defer n.eventLock.Unlock()
+	n.failoverEvents = append(n.failoverEvents, FailoverEvent{time.Now(), n.String(), step, message})
+	if len(n.failoverEvents) > maxFailoverEvents {
+		n.failoverEvents = n.failoverEvents[len(n.failoverEvents)-maxFailoverEvents:]
+	}
+}
+
+//最近的故障切换事件, 按时间顺序
+func (n *Node) FailoverEvents() []FailoverEvent {
+	n.eventLock.Lock()
+	defer n.eventLock.Unlock()
+	events := make([]FailoverEvent, len(n.failoverEvents))
+	copy(events, n.failoverEvents)
+	return events
+}
+
+//把最新的可用从库提升为主库:
+//1. 冷却时间内不重复切换, 同一时间只有一个切换在进行
+//2. 再次确认旧主库不可达, 避免网络抖动造成双主
+//3. 选择执行位置最新的从库, 等待它执行完已经拉取的relay log
+//4. 停止复制并关闭read_only, 替换Node的主库
+//5. 旧主库被隔离, 恢复之后只会被设置为只读, 不会自动重新成为主库
+//6. 开启GTID时可以把其他从库指向新主库
+func (n *Node) Failover() error {
+	if !atomic.CompareAndSwapInt32(&n.failing, 0, 1) {
+		return errors.ErrFailoverRunning
+	}
+	defer atomic.StoreInt32(&n.failing, 0)
+
+	cooldown := n.FailoverCooldown
+	if cooldown <= 0 {
+		cooldown = DefaultFailoverCooldown
+	}
+	n.RLock()
+	last := n.lastFailover
+	old := n.master
+	n.RUnlock()
+	if !last.IsZero() && time.Since(last) < cooldown {
+		n.addFailoverEvent("cooldown", f.Sprintf("last failover at %s, skip until %s",
+			last.Format(time.RFC3339), last.Add(cooldown).Format(time.RFC3339)))
+		return errors.ErrFailoverCooldown
+	}
+
+	if old == nil {
+		return errors.ErrNoMasterDB
+	}
+	n.addFailoverEvent("start", f.Sprintf("master %s is down", old.Addr()))
+
+	if err := old.Ping(); err == nil {
+		n.addFailoverEvent("fence", f.Sprintf("master %s is reachable again, abort", old.Addr()))
+		return errors.ErrFailoverMasterAlive
+	}
+
+	candidate, err := n.chooseCandidate()
+	if err != nil {
+		n.addFailoverEvent("choose", err.Error())
+		return err
+	}
+	n.addFailoverEvent("choose", f.Sprintf("candidate %s", candidate.Addr()))
+
+	if err = candidate.waitRelayApplied(FailoverCatchUpTimeout); err != nil {
+		n.addFailoverEvent("catchup", f.Sprintf("candidate %s: %s", candidate.Addr(), err.Error()))
+		return err
+	}
+
+	//等待期间旧主库可能已经恢复
+	if n.GetMaster() != old || old.State() != Down {
+		n.addFailoverEvent("fence", f.Sprintf("master %s is back or replaced, abort", old.Addr()))
+		return errors.ErrFailoverMasterAlive
+	}
+	if err = candidate.promote(); err != nil {
+		n.addFailoverEvent("promote", f.Sprintf("candidate %s: %s", candidate.Addr(), err.Error()))
+		return err
+	}
+	n.addFailoverEvent("promote", f.Sprintf("%s stopped replication and is writable", candidate.Addr()))
+
+	//提升期间主库可能被UpMaster或者admin替换, 放弃切换并让候选从库恢复复制
+	if err = n.swapMaster(old, candidate); err != nil {
+		n.addFailoverEvent("switch", f.Sprintf("master %s is back or replaced, abort", old.Addr()))
+		if err := candidate.demote(); err != nil {
+			n.addFailoverEvent("demote", f.Sprintf("candidate %s: %s", candidate.Addr(), err.Error()))
+		} else {
+			n.addFailoverEvent("demote", f.Sprintf("%s is read only and replicating again", candidate.Addr()))
+		}
+		return err
+	}
+	n.addFailoverEvent("switch", f.Sprintf("master %s -> %s, old master fenced", old.Addr(), candidate.Addr()))
+
+	//切换之后才清除复制配置, 在此之前放弃切换还可以恢复复制
+	if _, err = candidate.execCheck(resetSlaveSqls); err != nil {
+		n.addFailoverEvent("reset", f.Sprintf("new master %s: %s", candidate.Addr(), err.Error()))
+	}
+
+	if n.RepointSlaves {
+		n.repointSlaves(candidate)
+	}
+
+	if n.OnFailover != nil {
+		if err = n.OnFailover(n); err != nil {
+			n.addFailoverEvent("save", "save config: "+err.Error())
+		} else {
+			n.addFailoverEvent("save", "config saved")
+		}
+	}
+	n.addFailoverEvent("done", f.Sprintf("master is %s", candidate.Addr()))
+	return nil
+}
+
+//从不是Down/ManualDown的从库中选择: 都开启了GTID时比较已执行的事务数, 否则比较执行到的主库binlog位置
+func (n *Node) chooseCandidate() (*DB, error) {
+	var best *DB
+	var bestStatus *ReplicationStatus
+	for _, db := range n.GetSlaves() {
+		if state := db.State(); state == Down || state == ManualDown {
+			continue
+		}
+		status, err := db.CheckReplication()
+		if err != nil {
+			n.addFailoverEvent("choose", f.Sprintf("slave %s: %s", db.Addr(), err.Error()))
+			continue
+		}
+		if !status.IsSlave {
+			continue
+		}
+		if best == nil || newerThan(status, bestStatus) {
+			best, bestStatus = db, status
+		}
+	}
+	if best == nil {
+		return nil, errors.ErrNoFailoverSlave
+	}
+	return best, nil
+}
+
+func newerThan(a, b *ReplicationStatus) bool {
+	ac, aok := gtidCount(a.ExecutedGtidSet)
+	bc, bok := gtidCount(b.ExecutedGtidSet)
+	if aok && bok && ac != bc {
+		return ac > bc
+	}
+
+	if c := comparePosition(a.RelayMasterLogFile, a.ExecMasterLogPos, b.RelayMasterLogFile, b.ExecMasterLogPos); c != 0 {
+		return c > 0
+	}
+	return comparePosition(a.MasterLogFile, a.ReadMasterLogPos, b.MasterLogFile, b.ReadMasterLogPos) > 0
+}
+
+//binlog文件名的序号是定长的, 可以直接比较字符串
+func comparePosition(fileA string, posA uint64, fileB string, posB uint64) int {
+	switch {
+	case fileA > fileB:
+		return 1
+	case fileA < fileB:
+		return -1
+	case posA > posB:
+		return 1
+	case posA < posB:
+		return -1
+	}
+	return 0
+}
+
+//GTID集合中的事务数, 如 uuid1:1-5:7,uuid2:1-3 为 9
+func gtidCount(set string) (uint64, bool) {
+	set = strings.TrimSpace(set)
+	if len(set) == 0 {
+		return 0, false
+	}
+
+	var count uint64
+	for _, item := range strings.Split(set, ",") {
+		parts := strings.Split(strings.TrimSpace(item), ":")
+		if len(parts) < 2 {
+			return 0, false
+		}
+		for _, interval := range parts[1:] {
+			bounds := strings.SplitN(interval, "-", 2)
+			start, err := strconv.ParseUint(bounds[0], 10, 64)
+			if err != nil {
+				return 0, false
+			}
+			end := start
+			if len(bounds) == 2 {
+				if end, err = strconv.ParseUint(bounds[1], 10, 64); err != nil || end < start {
+					return 0, false
+				}
+			}
+			count += end - start + 1
+		}
+	}
+	return count, true
+}
+
+//等待SQL线程执行到IO线程已经读取的位置
+func (db *DB) waitRelayApplied(timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		status, err := db.CheckReplication()
+		if err != nil {
+			return err
+		}
+		if !status.SQLRunning {
+			return errors.ErrFailoverSQLStopped
+		}
+		if comparePosition(status.RelayMasterLogFile, status.ExecMasterLogPos,
+			status.MasterLogFile, status.ReadMasterLogPos) >= 0 {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return errors.ErrFailoverTimeout
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+}
+
+//停止复制, 打开写; 复制配置在切换成功之后才清除(避免重启之后重新连接旧主库)
+func (db *DB) promote() error {
+	if _, err := db.execCheck(stopSlaveSqls); err != nil {
+		return err
+	}
+	_, err := db.execCheck([]string{"SET GLOBAL read_only = 0"})
+	return err
+}
+
+//放弃切换时撤销promote: 重新设置为只读并启动复制
+func (db *DB) demote() error {
+	if _, err := db.execCheck([]string{"SET GLOBAL read_only = 1"}); err != nil {
+		return err
+	}
+	_, err := db.execCheck(startSlaveSqls)
+	return err
+}
+
+//依次尝试sqls, 语法错误时尝试下一个(SLAVE和REPLICA两种语法)
+func (db *DB) execCheck(sqls []string) (*mysql.Result, error) {
+	db.checkLock.Lock()
+	defer db.checkLock.Unlock()
+
+	if db.checkConn == nil {
+		co, err := db.newConn()
+		if err != nil {
+			return nil, err
+		}
+		db.checkConn = co
+	}
+	if err := db.checkConn.SetDeadline(time.Now().Add(db.pingTimeout)); err != nil {
+		return nil, err
+	}
+	defer db.checkConn.SetDeadline(time.Time{})
+
+	var r *mysql.Result
+	var err error
+	for _, sql := range sqls {
+		if r, err = db.checkConn.exec(sql); !isParseError(err) {
+			break
+		}
+	}
+	return r, err
+}
+
+//新主库从从库列表中移除, 旧主库不再被健康检查, 只记录下来等待恢复之后设置为只读
+//加锁之后再次确认主库还是old并且是Down, 否则说明主库已经被替换或恢复, 不能覆盖
+func (n *Node) swapMaster(old, master *DB) error {
+	n.Lock()
+	if n.master != old || old.State() != Down {
+		n.Unlock()
+		return errors.ErrFailoverMasterAlive
+	}
+	for i, db := range n.Slave {
+		if db == master {
+			n.Slave = append(n.Slave[:i], n.Slave[i+1:]...)
+			n.SlaveWeights = append(n.SlaveWeights[:i], n.SlaveWeights[i+1:]...)
+			break
+		}
+	}
+	n.InitBalancer()
+	atomic.StoreInt32(&(master.state), Up)
+	master.SetLastPing()
+	n.master = master
+	n.fencedMaster = old
+	n.lastFailover = time.Now()
+	n.Unlock()
+
+	old.Close()
+	old.closeCheckConn()
+	return nil
+}
+
+func (n *Node) repointSlaves(master *DB) {
+	status := master.Replication()
+	if status == nil || len(status.ExecutedGtidSet) == 0 {
+		n.addFailoverEvent("repoint", "gtid is not enabled, slaves must be repointed manually")
+		return
+	}
+	host, port, err := net.SplitHostPort(master.Addr())
+	if err != nil {
+		n.addFailoverEvent("repoint", err.Error())
+		return
+	}
+	changeSqls := []string{
+		f.Sprintf("CHANGE MASTER TO MASTER_HOST = '%s', MASTER_PORT = %s, MASTER_AUTO_POSITION = 1", host, port),
+		f.Sprintf("CHANGE REPLICATION SOURCE TO SOURCE_HOST = '%s', SOURCE_PORT = %s, SOURCE_AUTO_POSITION = 1", host, port),
+	}
+
+	for _, db := range n.GetSlaves() {
+		if state := db.State(); state == Down || state == ManualDown {
+			n.addFailoverEvent("repoint", f.Sprintf("slave %s is down, skipped", db.Addr()))
+			continue
+		}
+		for _, sqls := range [][]string{stopSlaveSqls, changeSqls, startSlaveSqls} {
+			if _, err = db.execCheck(sqls); err != nil {
+				break
+			}
+		}
+		if err != nil {
+			n.addFailoverEvent("repoint", f.Sprintf("slave %s: %s", db.Addr(), err.Error()))
+		} else {
+			n.addFailoverEvent("repoint", f.Sprintf("slave %s now replicates from %s", db.Addr(), master.Addr()))
+		}
+	}
+}
+
+//被隔离的旧主库恢复之后设置为只读, 防止仍连接着它的客户端继续写入
+func (n *Node) checkFencedMaster() {
+	n.RLock()
+	old := n.fencedMaster
+	n.RUnlock()
+	if old == nil {
+		return
+	}
+	if err := old.Ping(); err != nil {
+		return
+	}
+
+	_, err := old.execCheck([]string{"SET GLOBAL read_only = 1"})
+	old.closeCheckConn()
+	if err != nil {
+		n.addFailoverEvent("fence", f.Sprintf("old master %s is back, set read_only: %s", old.Addr(), err.Error()))
+		return
+	}
+	n.addFailoverEvent("fence", f.Sprintf("old master %s is back and set read only", old.Addr()))
+	n.Lock()
+	if n.fencedMaster == old {
+		n.fencedMaster = nil
+	}
+	n.Unlock()
+}
+
+//从库配置, 格式与配置文件中的slave相同: addr@weight,addr@weight
+func (n *Node) SlaveString() string {
+	n.RLock()
+	defer n.RUnlock()
+	items := make([]string, 0, len(n.Slave))
+	for i, db := range n.Slave {
+		items = append(items, db.Addr()+WeightSplit+strconv.Itoa(n.SlaveWeights[i]))
+	}
+	return strings.Join(items, SlaveSplit)
+}
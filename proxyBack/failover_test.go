@@ -0,0 +1,90 @@
+package proxyBack
+
+import (
+	"testing"
+
+	"brother/core/errors"
+)
+
+func TestGtidCount(t *testing.T) {
+	tests := []struct {
+		set   string
+		count uint64
+		ok    bool
+	}{
+		{"3e11fa47-71ca-11e1-9e33-c80aa9429562:1-5:7,\n4e11fa47-71ca-11e1-9e33-c80aa9429562:1-3", 9, true},
+		{"3e11fa47-71ca-11e1-9e33-c80aa9429562:23", 1, true},
+		{"", 0, false},
+		{"3e11fa47-71ca-11e1-9e33-c80aa9429562", 0, false},
+		{"3e11fa47-71ca-11e1-9e33-c80aa9429562:5-3", 0, false},
+		{"3e11fa47-71ca-11e1-9e33-c80aa9429562:a-3", 0, false},
+	}
+	for _, test := range tests {
+		if count, ok := gtidCount(test.set); count != test.count || ok != test.ok {
+			t.Fatalf("%q: %d %v", test.set, count, ok)
+		}
+	}
+}
+
+func TestNewerThan(t *testing.T) {
+	//GTID执行的事务多的更新
+	a := &ReplicationStatus{ExecutedGtidSet: "uuid1:1-10", RelayMasterLogFile: "mysql-bin.000001", ExecMasterLogPos: 100}
+	b := &ReplicationStatus{ExecutedGtidSet: "uuid1:1-9", RelayMasterLogFile: "mysql-bin.000002", ExecMasterLogPos: 100}
+	if !newerThan(a, b) || newerThan(b, a) {
+		t.Fatal("more executed gtid must be newer")
+	}
+
+	//没有GTID时先比较执行到的位置, 再比较读取到的位置
+	a = &ReplicationStatus{RelayMasterLogFile: "mysql-bin.000002", ExecMasterLogPos: 4}
+	b = &ReplicationStatus{RelayMasterLogFile: "mysql-bin.000001", ExecMasterLogPos: 1000}
+	if !newerThan(a, b) || newerThan(b, a) {
+		t.Fatal("later exec binlog file must be newer")
+	}
+
+	a = &ReplicationStatus{RelayMasterLogFile: "mysql-bin.000002", ExecMasterLogPos: 4,
+		MasterLogFile: "mysql-bin.000003", ReadMasterLogPos: 200}
+	b = &ReplicationStatus{RelayMasterLogFile: "mysql-bin.000002", ExecMasterLogPos: 4,
+		MasterLogFile: "mysql-bin.000003", ReadMasterLogPos: 100}
+	if !newerThan(a, b) || newerThan(b, a) {
+		t.Fatal("later read position must be newer")
+	}
+	if newerThan(a, a) {
+		t.Fatal("same position is not newer")
+	}
+}
+
+func TestSwapMasterReplaced(t *testing.T) {
+	old := newTestSlave("127.0.0.1:3306")
+	old.state = Down
+	candidate := newTestSlave("127.0.0.1:3307")
+	n := new(Node)
+	n.master = old
+	n.Slave = []*DB{candidate}
+	n.SlaveWeights = []int{1}
+	n.InitBalancer()
+
+	//检查之后切换之前UpMaster换上了新的主库
+	up := newTestSlave("127.0.0.1:3306")
+	n.master = up
+	if err := n.swapMaster(old, candidate); err != errors.ErrFailoverMasterAlive {
+		t.Fatal(err)
+	}
+	if n.master != up || len(n.Slave) != 1 || n.Slave[0] != candidate || n.fencedMaster != nil {
+		t.Fatal("master replaced during failover must not be overwritten")
+	}
+
+	//旧主库恢复为Up也不能切换
+	n.master = old
+	old.state = Up
+	if err := n.swapMaster(old, candidate); err != errors.ErrFailoverMasterAlive {
+		t.Fatal(err)
+	}
+
+	old.state = Down
+	if err := n.swapMaster(old, candidate); err != nil {
+		t.Fatal(err)
+	}
+	if n.master != candidate || len(n.Slave) != 0 || n.fencedMaster != old || !old.closed {
+		t.Fatal("candidate must replace the down master")
+	}
+}
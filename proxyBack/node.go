@@ -22,18 +22,46 @@ type Node struct {
 	Cfg				config.NodeConfig
 
 	sync.RWMutex
-	Master				*DB
+	//故障切换时会被替换, 通过GetMaster读取
+	master				*DB
 
 	Slave				[]*DB
-	LastSlaveIndex			int
-	RoundRobinQ			[]int
 	SlaveWeights			[]int
+	//从库负载均衡策略, 见balancer.go
+	BalancerType			string
+	balancer			Balancer
 
 	DownAfterNoAlive		time.Duration
+	CheckInterval			time.Duration
+	CheckTimeout			time.Duration
+	//大于0时检查从库的复制延迟, 单位秒
+	MaxSlaveLag			int64
+	//每个DB的熔断配置
+	Breaker				BreakerConfig
+	//每个DB的连接池配置
+	Pool				PoolConfig
+
+	//主库宕机时自动提升从库, 见Failover
+	AutoFailover			bool
+	RepointSlaves			bool
+	FailoverCooldown		time.Duration
+	//切换成功之后调用, 用于保存配置
+	OnFailover			func(n *Node) error
+
+	failing				int32
+	lastFailover			time.Time	//持有n.Lock读写
+	fencedMaster			*DB
+	eventLock			sync.Mutex
+	failoverEvents			[]FailoverEvent
+
+	//节点被移除之后为1, 停止健康检查
+	closed				int32
 }
 
+const DefaultCheckInterval = 16 * time.Second
+
 func (n *Node) checkMaster() {
-	db := n.Master
+	db := n.GetMaster()
 	if db == nil {
 		golog.Error("Node", "checkMaster", "Master is no alive", 0)
 		return 
@@ -44,7 +72,13 @@ func (n *Node) checkMaster() {
 	} else {
 		if atomic.LoadInt32(&(db.state)) == Down {
 			golog.Info("Node", "checkMaster", "Master up", 0, "db.Addr", db.Addr())
-			n.UpMaster(db.addr)
+			if err := n.UpMaster(db.addr); err != nil {
+				return
+			}
+			//UpMaster替换了DB, 之后的状态记录在新的DB上
+			if db = n.GetMaster(); db == nil {
+				return
+			}
 		}
 		db.SetLastPing()
 		if atomic.LoadInt32(&(db.state)) != ManualDown {
@@ -57,6 +91,14 @@ func (n *Node) checkMaster() {
 			"db.Addr", db.Addr(),
 			"Master_down_time", int64(n.DownAfterNoAlive/time.Second))
 		n.DownMaster(db.addr, Down)
+		//切换需要等待从库执行relay log, 在后台进行以免阻塞健康检查
+		if n.AutoFailover && atomic.LoadInt32(&n.failing) == 0 {
+			go func() {
+				if err := n.Failover(); err != nil {
+					golog.Error("Node", "checkMaster", "Failover", 0, "db.Addr", db.Addr(), "error", err.Error())
+				}
+			}()
+		}
 	}
 }
 
@@ -74,13 +116,20 @@ func (n *Node) CheckSlave() {
 		if err := slaves[i].Ping(); err != nil {
 			golog.Error("Node", "checkSlave", "Ping", 0, "db.Addr", slaves[i].Addr(), "error", err.Error())
 		} else {
-			if atomic.LoadInt32(&(slaves[i].state)) == Down {
-				golog.Info("Node", "checkSlave", "Slave up", 0, "db.Addr", slaves[i].Addr())
-				n.UpSlave(slaves[i].addr)
+			db := slaves[i]
+			if atomic.LoadInt32(&(db.state)) == Down {
+				golog.Info("Node", "checkSlave", "Slave up", 0, "db.Addr", db.Addr())
+				if err := n.UpSlave(db.addr); err != nil {
+					continue
+				}
+				//UpSlave替换了DB, 延迟检查的结果记录在新的DB上
+				if db = n.GetSlave(db.addr); db == nil {
+					continue
+				}
 			}
-			slaves[i].SetLastPing()
-			if atomic.LoadInt32(&(slaves[i].state)) != ManualDown {
-				atomic.StoreInt32(&(slaves[i].state), Up)
+			db.SetLastPing()
+			if atomic.LoadInt32(&(db.state)) != ManualDown {
+				atomic.StoreInt32(&(db.state), n.checkSlaveLag(db))
 			}
 			continue
 		}
@@ -95,12 +144,46 @@ func (n *Node) CheckSlave() {
 	}
 }
 
+//复制延迟超过MaxSlaveLag或者复制线程停止时返回Lagging, 恢复之后重新回到Up
+func (n *Node) checkSlaveLag(db *DB) int32 {
+	if n.MaxSlaveLag <= 0 {
+		return Up
+	}
+
+	status, err := db.CheckReplication()
+	if err != nil {
+		//查询不到复制状态时不改变延迟判断
+		golog.Error("Node", "checkSlaveLag", err.Error(), 0, "db.Addr", db.Addr())
+		if atomic.LoadInt32(&(db.state)) == Lagging {
+			return Lagging
+		}
+		return Up
+	}
+
+	lagging := !status.CaughtUp(n.MaxSlaveLag)
+	state := atomic.LoadInt32(&(db.state))
+	if lagging && state != Lagging {
+		golog.Warn("Node", "checkSlaveLag", "Slave lagging", 0, "db.Addr", db.Addr(),
+			"lag", status.Lag, "io_running", status.IORunning, "sql_running", status.SQLRunning)
+	} else if !lagging && state == Lagging {
+		golog.Info("Node", "checkSlaveLag", "Slave caught up", 0, "db.Addr", db.Addr(), "lag", status.Lag)
+	}
+	if lagging {
+		return Lagging
+	}
+	return Up
+}
+
 func (n *Node) CheckNode()  {
-	//TODO check connection alive
-	for {
+	interval := n.CheckInterval
+	if interval <= 0 {
+		interval = DefaultCheckInterval
+	}
+	for atomic.LoadInt32(&n.closed) == 0 {
 		n.checkMaster()
 		n.CheckSlave()
-		time.Sleep(16 * time.Second)
+		n.checkFencedMaster()
+		time.Sleep(interval)
 	}
 }
 
@@ -108,8 +191,14 @@ func (n *Node) String() string {
 	return n.Cfg.Name
 }
 
+func (n *Node) GetMaster() *DB {
+	n.RLock()
+	defer n.RUnlock()
+	return n.master
+}
+
 func (n *Node) GetMasterConn() (*BackendConn, error) {
-	db := n.Master
+	db := n.GetMaster()
 	if db == nil {
 		return nil, errors.ErrNoMasterConn
 	}
@@ -121,6 +210,7 @@ func (n *Node) GetMasterConn() (*BackendConn, error) {
 	return db.GetConn()
 }
 
+//跳过不可用和延迟过大的从库, 都不可用时返回错误, 由调用方回退到主库
 func (n *Node) GetSlaveConn() (*BackendConn, error) {
 	n.Lock()
 	db, err := n.GetNextSlave()
@@ -132,7 +222,42 @@ func (n *Node) GetSlaveConn() (*BackendConn, error) {
 	if db == nil {
 		return nil, errors.ErrNoSlaveDB
 	}
-	if atomic.LoadInt32(&(db.state)) == Down {
+
+	return db.GetConn()
+}
+
+//可以参与读负载均衡的从库: 没有宕机、延迟没有超过限制、没有熔断
+func (db *DB) Readable() bool {
+	state := atomic.LoadInt32(&(db.state))
+	return state != Down && state != ManualDown && state != Lagging && db.breakerReady()
+}
+
+func (n *Node) GetSlaves() []*DB {
+	n.RLock()
+	defer n.RUnlock()
+	slaves := make([]*DB, len(n.Slave))
+	copy(slaves, n.Slave)
+	return slaves
+}
+
+func (n *Node) GetSlave(addr string) *DB {
+	n.RLock()
+	defer n.RUnlock()
+	for _, db := range n.Slave {
+		if db.addr == addr {
+			return db
+		}
+	}
+	return nil
+}
+
+//路由提示指定的从库, 不经过负载均衡
+func (n *Node) GetSlaveConnByAddr(addr string) (*BackendConn, error) {
+	db := n.GetSlave(addr)
+	if db == nil {
+		return nil, errors.ErrSlaveNotExist
+	}
+	if state := atomic.LoadInt32(&(db.state)); state == Down || state == ManualDown {
 		return nil, errors.ErrSlaveDown
 	}
 
@@ -144,8 +269,13 @@ func (n *Node) GetSlaveConn() (*BackendConn, error) {
  */
 
 func (n *Node) OpenDB(addr string) (*DB, error) {
-	db, err := Open(addr, n.Cfg.User, n.Cfg.Password, "", n.Cfg.MaxConnNum)
-	return db, err
+	db, err := Open(addr, n.Cfg.User, n.Cfg.Password, "", n.Pool)
+	if err != nil {
+		return nil, err
+	}
+	db.SetPingTimeout(n.CheckTimeout)
+	db.SetBreaker(n.Breaker)
+	return db, nil
 }
 
 func (n *Node) UpDB(addr string) (*DB, error) {
@@ -166,32 +296,50 @@ func (n *Node) UpMaster(addr string) error {
 	db, err := n.UpDB(addr)
 	if err != nil {
 		golog.Error("Node", "UpMaster", err.Error(), 0)
+		return err
 	}
-	n.Master = db
-	return err
+	n.Lock()
+	old := n.master
+	//检查期间主库已经被切换
+	if old != nil && old.addr != addr {
+		n.Unlock()
+		db.Close()
+		db.closeCheckConn()
+		return errors.ErrNoMasterDB
+	}
+	n.master = db
+	n.Unlock()
+	if old != nil {
+		old.closeCheckConn()
+	}
+	return nil
 }
 
 func (n *Node) UpSlave(addr string) error {
 	db, err := n.UpDB(addr)
 	if err != nil {
 		golog.Error("Node", "UpSlave", err.Error(), 0)
+		return err
 	}
 	n.Lock()
 	for k, slave := range n.Slave {
 		if slave.addr == addr {
+			slave.closeCheckConn()
 			n.Slave[k] = db
 			n.Unlock()
 			return nil
 		}
 	}
-	n.Slave = append(n.Slave, db)
 	n.Unlock()
 
-	return err
+	//从库已经被移除, 新增从库使用AddSlave以便同时设置权重
+	db.Close()
+	db.closeCheckConn()
+	return errors.ErrSlaveNotExist
 }
 
 func (n *Node) DownMaster(addr string, state int32) error {
-	db := n.Master
+	db := n.GetMaster()
 	if db == nil || db.addr != addr {
 		return errors.ErrNoMasterDB
 	}
@@ -222,18 +370,24 @@ func (n *Node) DownSlave(addr string, state int32) error {
 }
 
 func (n *Node) ParseMaster(masterStr string) error {
-	var err error
 	if len(masterStr) == 0 {
 		return errors.ErrNoMasterDB
 	}
 
-	n.Master, err = n.OpenDB(masterStr)
-	return err
+	db, err := n.OpenDB(masterStr)
+	if err != nil {
+		return err
+	}
+	n.Lock()
+	n.master = db
+	n.Unlock()
+	return nil
 }
 
 //slavesStr(127.0.0.1:3306@2,192.168.10.12:3306)
 func (n *Node) ParseSlave(slaveStr string) error {
 	var db *DB
+	var addr string
 	var weight int
 	var err error
 	if len(slaveStr) == 0 {
@@ -247,17 +401,12 @@ func (n *Node) ParseSlave(slaveStr string) error {
 
 	//parse addr and port
 	for i := 0; i < count; i ++ {
-		addrAndWeight := strings.Split(slaveArray[i], WeightSplit)
-		if len(addrAndWeight) == 2 {
-			weight, err = strconv.Atoi(addrAndWeight[1])
-			if err != nil {
-				return err
-			}
-		} else {
-			weight = 1
+		addr, weight, err = ParseSlaveWeight(slaveArray[i])
+		if err != nil {
+			return err
 		}
 		n.SlaveWeights = append(n.SlaveWeights, weight)
-		if db, err = n.OpenDB(addrAndWeight[0]); err != nil {
+		if db, err = n.OpenDB(addr); err != nil {
 			return err
 		}
 		n.Slave = append(n.Slave, db)
@@ -266,36 +415,168 @@ func (n *Node) ParseSlave(slaveStr string) error {
 	return nil
 }
 
-func (n *Node) AddSlave(addr string) error {
-	var db *DB
-	var weight int
-	var err error
-	if len(addr) == 0 {
+//addr或者addr@weight, 没有权重时为1
+func ParseSlaveWeight(slaveStr string) (string, int, error) {
+	addrAndWeight := strings.Split(slaveStr, WeightSplit)
+	if len(addrAndWeight) != 2 {
+		return addrAndWeight[0], 1, nil
+	}
+	weight, err := strconv.Atoi(addrAndWeight[1])
+	if err != nil || weight <= 0 {
+		return "", 0, errors.ErrSlaveWeight
+	}
+	return addrAndWeight[0], weight, nil
+}
+
+//slaveStr(127.0.0.1:3306@2), 连接在锁外建立
+func (n *Node) AddSlave(slaveStr string) error {
+	if len(slaveStr) == 0 {
 		return errors.ErrAddressNull
 	}
+	addr, weight, err := ParseSlaveWeight(slaveStr)
+	if err != nil {
+		return err
+	}
+	if n.GetSlave(addr) != nil {
+		return errors.ErrSlaveExist
+	}
+
+	db, err := n.OpenDB(addr)
+	if err != nil {
+		return err
+	}
+	n.Lock()
+	if n.getSlaveIndex(addr) >= 0 {
+		n.Unlock()
+		db.Close()
+		db.closeCheckConn()
+		return errors.ErrSlaveExist
+	}
+	n.Slave = append(n.Slave, db)
+	n.SlaveWeights = append(n.SlaveWeights, weight)
+	n.InitBalancer()
+	n.Unlock()
+	return nil
+}
+
+//调用方持有n.Lock, 不存在时返回-1
+func (n *Node) getSlaveIndex(addr string) int {
+	for i, db := range n.Slave {
+		if db.addr == addr {
+			return i
+		}
+	}
+	return -1
+}
+
+//从负载均衡中移除之后关闭, 使用中的连接归还时关闭
+func (n *Node) RemoveSlave(addr string) error {
+	n.Lock()
+	index := n.getSlaveIndex(addr)
+	if index < 0 {
+		n.Unlock()
+		return errors.ErrSlaveNotExist
+	}
+	db := n.Slave[index]
+	n.Slave = append(n.Slave[:index:index], n.Slave[index+1:]...)
+	n.SlaveWeights = append(n.SlaveWeights[:index:index], n.SlaveWeights[index+1:]...)
+	n.InitBalancer()
+	n.Unlock()
+
+	db.Close()
+	db.closeCheckConn()
+	golog.Info("Node", "RemoveSlave", "Slave removed", 0, "node", n.String(), "db.Addr", addr)
+	return nil
+}
+
+func (n *Node) SetSlaveWeight(addr string, weight int) error {
+	if weight <= 0 {
+		return errors.ErrSlaveWeight
+	}
 	n.Lock()
 	defer n.Unlock()
-	for _, v := range n.Slave {
-		if strings.Split(v.addr, WeightSplit)[0] == strings.Split(addr, WeightSplit)[0] {
-			return errors.ErrSlaveExist
+	index := n.getSlaveIndex(addr)
+	if index < 0 {
+		return errors.ErrSlaveNotExist
+	}
+	n.SlaveWeights[index] = weight
+	n.InitBalancer()
+	return nil
+}
+
+//手动恢复主库或从库, 只有Down和ManualDown的DB需要重新连接
+func (n *Node) SetDBUp(addr string) error {
+	if db := n.GetMaster(); db != nil && db.addr == addr {
+		if !isDown(db) {
+			return nil
 		}
+		return n.UpMaster(addr)
 	}
-	addrAndWeight := strings.Split(addr, WeightSplit)
-	if len(addrAndWeight) == 2 {
-		weight, err = strconv.Atoi(addrAndWeight[1])
-		if err != nil {
-			 return err
+	db := n.GetSlave(addr)
+	if db == nil {
+		return errors.ErrSlaveNotExist
+	}
+	if !isDown(db) {
+		return nil
+	}
+	return n.UpSlave(addr)
+}
+
+func isDown(db *DB) bool {
+	state := db.State()
+	return state == Down || state == ManualDown
+}
+
+//手动下线的DB不会被健康检查恢复, 需要调用SetDBUp
+func (n *Node) SetDBManualDown(addr string) error {
+	if db := n.GetMaster(); db != nil && db.addr == addr {
+		return n.DownMaster(addr, ManualDown)
+	}
+	if n.GetSlave(addr) == nil {
+		return errors.ErrSlaveNotExist
+	}
+	return n.DownSlave(addr, ManualDown)
+}
+
+const nodeDrainInterval = 100 * time.Millisecond
+
+//移除节点: 停止健康检查, 等待借出的连接归还之后关闭所有DB, 超过timeout时直接关闭
+func (n *Node) Close(timeout time.Duration) {
+	if !atomic.CompareAndSwapInt32(&n.closed, 0, 1) {
+		return
+	}
+
+	n.RLock()
+	dbs := make([]*DB, 0, len(n.Slave)+2)
+	if n.master != nil {
+		dbs = append(dbs, n.master)
+	}
+	dbs = append(dbs, n.Slave...)
+	if n.fencedMaster != nil {
+		dbs = append(dbs, n.fencedMaster)
+	}
+	n.RUnlock()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		var borrowed int64
+		for _, db := range dbs {
+			borrowed += db.Borrowed()
 		}
-	} else {
-		weight = 1
+		if borrowed == 0 {
+			break
+		}
+		if time.Now().After(deadline) {
+			golog.Warn("Node", "Close", "drain timeout, in use connections are closed when released", 0,
+				"node", n.String(), "borrowed", borrowed)
+			break
+		}
+		time.Sleep(nodeDrainInterval)
 	}
 
-	n.SlaveWeights = append(n.SlaveWeights, weight)
-	if db, err = n.OpenDB(addrAndWeight[0]); err != nil {
-		return err
-	} else {
-		n.Slave = append(n.Slave, db)
-		n.InitBalancer()
-		return nil
+	for _, db := range dbs {
+		db.Close()
+		db.closeCheckConn()
 	}
-}
\ No newline at end of file
+	golog.Info("Node", "Close", "Node closed", 0, "node", n.String())
+}
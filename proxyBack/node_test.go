@@ -0,0 +1,101 @@
+package proxyBack
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"brother/core/errors"
+)
+
+func TestParseSlaveWeight(t *testing.T) {
+	if addr, weight, err := ParseSlaveWeight("127.0.0.1:3307@3"); err != nil || addr != "127.0.0.1:3307" || weight != 3 {
+		t.Fatal(addr, weight, err)
+	}
+	if addr, weight, err := ParseSlaveWeight("127.0.0.1:3307"); err != nil || addr != "127.0.0.1:3307" || weight != 1 {
+		t.Fatal(addr, weight, err)
+	}
+	for _, s := range []string{"127.0.0.1:3307@0", "127.0.0.1:3307@x", "127.0.0.1:3307@-1"} {
+		if _, _, err := ParseSlaveWeight(s); err != errors.ErrSlaveWeight {
+			t.Fatal(s, err)
+		}
+	}
+}
+
+func newTestSlave(addr string) *DB {
+	return &DB{addr: addr, stopCh: make(chan struct{})}
+}
+
+func TestNodeSlaveWeightAndRemove(t *testing.T) {
+	n := new(Node)
+	n.Slave = []*DB{newTestSlave("127.0.0.1:3307"), newTestSlave("127.0.0.1:3308"), newTestSlave("127.0.0.1:3309")}
+	n.SlaveWeights = []int{1, 1, 1}
+	n.InitBalancer()
+
+	if err := n.SetSlaveWeight("127.0.0.1:3308", 5); err != nil || !reflect.DeepEqual(n.SlaveWeights, []int{1, 5, 1}) {
+		t.Fatal(n.SlaveWeights, err)
+	}
+	if err := n.SetSlaveWeight("127.0.0.1:3308", 0); err != errors.ErrSlaveWeight {
+		t.Fatal(err)
+	}
+	if err := n.SetSlaveWeight("127.0.0.1:3310", 2); err != errors.ErrSlaveNotExist {
+		t.Fatal(err)
+	}
+
+	//权重和从库一起移除, 移除的DB被关闭
+	removed := n.Slave[1]
+	if err := n.RemoveSlave("127.0.0.1:3308"); err != nil {
+		t.Fatal(err)
+	}
+	if len(n.Slave) != 2 || n.GetSlave("127.0.0.1:3308") != nil || !reflect.DeepEqual(n.SlaveWeights, []int{1, 1}) {
+		t.Fatal(n.Slave, n.SlaveWeights)
+	}
+	if !removed.closed {
+		t.Fatal("removed slave must be closed")
+	}
+	if err := n.RemoveSlave("127.0.0.1:3308"); err != errors.ErrSlaveNotExist {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckNodeDown(t *testing.T) {
+	master, slave := newTestMysql(t), newTestMysql(t)
+	defer master.Close()
+	defer slave.Close()
+
+	n := new(Node)
+	n.master = newTestDB(master.Addr())
+	n.Slave = []*DB{newTestDB(slave.Addr())}
+	n.SlaveWeights = []int{1}
+	n.InitBalancer()
+	n.CheckInterval = 10 * time.Millisecond
+	n.DownAfterNoAlive = time.Second
+	go n.CheckNode()
+	defer n.Close(0)
+
+	waitState := func(db *DB, state int32, timeout time.Duration) {
+		for deadline := time.Now().Add(timeout); db.State() != state && time.Now().Before(deadline); {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if s := db.State(); s != state {
+			t.Fatal(db.Addr(), "state", s)
+		}
+	}
+
+	//能ping通时标记为Up
+	waitState(n.GetMaster(), Up, time.Second)
+	waitState(n.GetSlaves()[0], Up, time.Second)
+
+	//ping不通时先保持原来的状态, 超过DownAfterNoAlive之后标记为Down
+	master.Close()
+	slave.Close()
+	time.Sleep(200 * time.Millisecond)
+	if s := n.GetMaster().State(); s != Up {
+		t.Fatal("master must stay up within DownAfterNoAlive", s)
+	}
+	if _, _, err := n.GetMaster().LastCheck(); err == nil {
+		t.Fatal("last check must record the ping error")
+	}
+	waitState(n.GetMaster(), Down, 3*time.Second)
+	waitState(n.GetSlaves()[0], Down, 3*time.Second)
+}
@@ -0,0 +1,380 @@
+package proxyBack
+
+import (
+	f "fmt"
+	"sync/atomic"
+	"time"
+
+	"brother/core/errors"
+	"brother/core/golog"
+	"brother/mysql"
+)
+
+const (
+	DefaultMaxIdleTime	= 10 * time.Minute
+	DefaultMaxLifetime	= time.Hour
+	DefaultWaitTimeout	= 3 * time.Second
+
+	//后台预热和回收连接的间隔
+	poolMaintainInterval	= time.Second
+)
+
+//复用连接时清理会话状态的方式
+const (
+	//只回滚事务, 恢复autocommit和字符集; 临时表、用户变量、GET_LOCK等会留给下一个客户端
+	ResetNone	= "none"
+	//COM_RESET_CONNECTION, 服务端不支持时改用COM_CHANGE_USER
+	ResetConnection	= "reset"
+	//COM_CHANGE_USER, 需要重新认证, 比COM_RESET_CONNECTION慢
+	ResetChangeUser	= "change_user"
+)
+
+//连接池配置, 为0时使用默认值
+type PoolConfig struct {
+	//后台保持的最少空闲连接, 默认min(MaxOpen, InitConnCount)
+	MinIdle				int
+	//最多打开的连接(空闲+使用中), 默认DefaultMaxConnNum
+	MaxOpen				int
+	//空闲超过该时间的连接被关闭, 但保留MinIdle个
+	MaxIdleTime			time.Duration
+	//连接建立超过该时间之后不再复用, 避免被MySQL的wait_timeout断开
+	MaxLifetime			time.Duration
+	//连接数达到MaxOpen时等待归还的最长时间
+	WaitTimeout			time.Duration
+	//复用连接时清理会话状态的方式, 默认ResetNone
+	Reset				string
+}
+
+func CheckResetMode(mode string) error {
+	switch mode {
+	case "", ResetNone, ResetConnection, ResetChangeUser:
+		return nil
+	}
+	return errors.ErrResetMode
+}
+
+func (cfg *PoolConfig) setDefault() {
+	if cfg.MaxOpen <= 0 {
+		cfg.MaxOpen = DefaultMaxConnNum
+	}
+	if cfg.MinIdle <= 0 {
+		cfg.MinIdle = InitConnCount
+	}
+	if cfg.MinIdle > cfg.MaxOpen {
+		cfg.MinIdle = cfg.MaxOpen
+	}
+	if cfg.MaxIdleTime <= 0 {
+		cfg.MaxIdleTime = DefaultMaxIdleTime
+	}
+	if cfg.MaxLifetime <= 0 {
+		cfg.MaxLifetime = DefaultMaxLifetime
+	}
+	if cfg.WaitTimeout <= 0 {
+		cfg.WaitTimeout = DefaultWaitTimeout
+	}
+	if len(cfg.Reset) == 0 {
+		cfg.Reset = ResetNone
+	}
+}
+
+//等待连接的请求, 由putConn交给归还的连接或者新建的连接
+type connRequest struct {
+	co				*Conn
+	err				error
+}
+
+//连接池的统计, 用于admin查看
+type PoolStats struct {
+	MaxOpen				int
+	Open				int
+	Idle				int
+	InUse				int
+	Waiting				int
+
+	WaitCount			int64
+	WaitDuration			time.Duration
+	WaitTimeouts			int64
+	ClosedIdle			int64
+	ClosedLifetime			int64
+}
+
+func (db *DB) PoolStats() PoolStats {
+	db.poolLock.Lock()
+	s := PoolStats{
+		MaxOpen: db.pool.MaxOpen,
+		Open:    db.numOpen,
+		Idle:    len(db.idle),
+		InUse:   db.numOpen - len(db.idle),
+		Waiting: len(db.waiters),
+	}
+	db.poolLock.Unlock()
+
+	s.WaitCount = atomic.LoadInt64(&db.waitCount)
+	s.WaitDuration = time.Duration(atomic.LoadInt64(&db.waitDuration))
+	s.WaitTimeouts = atomic.LoadInt64(&db.waitTimeouts)
+	s.ClosedIdle = atomic.LoadInt64(&db.closedIdle)
+	s.ClosedLifetime = atomic.LoadInt64(&db.closedLifetime)
+	return s
+}
+
+//优先复用最近归还的空闲连接, 没有时在MaxOpen之内新建, 否则排队等待
+func (db *DB) getConn() (*Conn, error) {
+	for {
+		db.poolLock.Lock()
+		if db.closed {
+			db.poolLock.Unlock()
+			return nil, errors.ErrDatabaseClose
+		}
+
+		if n := len(db.idle); n > 0 {
+			co := db.idle[n-1]
+			db.idle[n-1] = nil
+			db.idle = db.idle[:n-1]
+			db.poolLock.Unlock()
+
+			if db.expired(co) {
+				atomic.AddInt64(&db.closedLifetime, 1)
+				db.putConn(co, true)
+				continue
+			}
+			//空闲一段时间的连接可能已经被服务端断开
+			if PingPeroid < time.Now().Unix()-co.pushTimestamp {
+				if err := co.Ping(); err != nil {
+					db.putConn(co, true)
+					continue
+				}
+			}
+			return co, nil
+		}
+
+		if db.numOpen < db.pool.MaxOpen {
+			db.numOpen++
+			db.poolLock.Unlock()
+			co, err := db.newConn()
+			if err != nil {
+				db.poolLock.Lock()
+				db.numOpen--
+				db.poolLock.Unlock()
+				return nil, err
+			}
+			return co, nil
+		}
+
+		req := make(chan connRequest, 1)
+		db.waiters = append(db.waiters, req)
+		db.poolLock.Unlock()
+		return db.waitConn(req)
+	}
+}
+
+func (db *DB) waitConn(req chan connRequest) (*Conn, error) {
+	start := time.Now()
+	atomic.AddInt64(&db.waitCount, 1)
+	defer func() {
+		atomic.AddInt64(&db.waitDuration, int64(time.Since(start)))
+	}()
+
+	timer := time.NewTimer(db.pool.WaitTimeout)
+	defer timer.Stop()
+
+	select {
+	case r := <-req:
+		return r.co, r.err
+	case <-timer.C:
+	}
+
+	db.poolLock.Lock()
+	removed := db.removeWaiter(req)
+	db.poolLock.Unlock()
+	if !removed {
+		//超时的同时已经有连接交给了这个请求
+		r := <-req
+		return r.co, r.err
+	}
+
+	atomic.AddInt64(&db.waitTimeouts, 1)
+	golog.Warn("DB", "getConn", "wait connection timeout", 0, "db.Addr", db.addr,
+		"max_open", db.pool.MaxOpen, "wait_timeout", db.pool.WaitTimeout.String())
+	return nil, mysql.NewError(mysql.ER_CON_COUNT_ERROR,
+		f.Sprintf("Too many connections to %s: all %d connections are in use, waited %v",
+			db.addr, db.pool.MaxOpen, db.pool.WaitTimeout))
+}
+
+//调用方持有poolLock
+func (db *DB) removeWaiter(req chan connRequest) bool {
+	for i, w := range db.waiters {
+		if w == req {
+			copy(db.waiters[i:], db.waiters[i+1:])
+			db.waiters[len(db.waiters)-1] = nil
+			db.waiters = db.waiters[:len(db.waiters)-1]
+			return true
+		}
+	}
+	return false
+}
+
+//调用方持有poolLock
+func (db *DB) popWaiter() chan connRequest {
+	if len(db.waiters) == 0 {
+		return nil
+	}
+	req := db.waiters[0]
+	copy(db.waiters, db.waiters[1:])
+	db.waiters[len(db.waiters)-1] = nil
+	db.waiters = db.waiters[:len(db.waiters)-1]
+	return req
+}
+
+//归还连接: 有等待的请求时直接交给它, 否则放回空闲列表; broken的连接关闭之后为等待的请求新建连接
+func (db *DB) putConn(co *Conn, broken bool) {
+	if co == nil {
+		return
+	}
+	if !broken && db.expired(co) {
+		atomic.AddInt64(&db.closedLifetime, 1)
+		broken = true
+	}
+
+	db.poolLock.Lock()
+	if broken || db.closed {
+		db.numOpen--
+		db.openForWaiter()
+		db.poolLock.Unlock()
+		co.Close()
+		return
+	}
+
+	co.pushTimestamp = time.Now().Unix()
+	if req := db.popWaiter(); req != nil {
+		db.poolLock.Unlock()
+		req <- connRequest{co: co}
+		return
+	}
+	db.idle = append(db.idle, co)
+	db.poolLock.Unlock()
+}
+
+//连接关闭之后为第一个等待的请求新建连接, 调用方持有poolLock
+func (db *DB) openForWaiter() {
+	if db.closed || db.numOpen >= db.pool.MaxOpen {
+		return
+	}
+	req := db.popWaiter()
+	if req == nil {
+		return
+	}
+	db.numOpen++
+	go func() {
+		co, err := db.newConn()
+		if err != nil {
+			db.poolLock.Lock()
+			db.numOpen--
+			db.poolLock.Unlock()
+		}
+		req <- connRequest{co: co, err: err}
+	}()
+}
+
+//清理上一个客户端留下的会话状态, 之后恢复连接池默认的数据库
+//COM_CHANGE_USER不可用时改用COM_RESET_CONNECTION, 都不可用时按ResetNone处理
+func (db *DB) resetConn(co *Conn) error {
+	noChangeUser := atomic.LoadInt32(&db.noChangeUser) == 1
+	if (db.pool.Reset == ResetConnection || noChangeUser) && atomic.LoadInt32(&db.noResetConn) == 0 {
+		err := co.ResetConnection()
+		if e, ok := err.(*mysql.SqlError); !ok || e.Code != mysql.ER_UNKNOWN_COM_ERROR {
+			if err == nil {
+				err = co.UseDB(db.db)
+			}
+			return err
+		}
+		atomic.StoreInt32(&db.noResetConn, 1)
+		golog.Warn("DB", "resetConn", "COM_RESET_CONNECTION not supported, use COM_CHANGE_USER", 0,
+			"db.Addr", db.addr)
+	}
+
+	if noChangeUser {
+		return nil
+	}
+
+	co.db = db.db
+	err := co.ChangeUser()
+	if err == errors.ErrAuthPlugin {
+		atomic.StoreInt32(&db.noChangeUser, 1)
+		golog.Warn("DB", "resetConn", "COM_CHANGE_USER needs mysql_native_password, use COM_RESET_CONNECTION", 0,
+			"db.Addr", db.addr)
+	}
+	return err
+}
+
+func (db *DB) expired(co *Conn) bool {
+	return db.pool.MaxLifetime <= time.Since(co.createdAt)
+}
+
+//后台预热到MinIdle个空闲连接, 关闭超过MaxLifetime和空闲太久的连接
+func (db *DB) maintainPool() {
+	ticker := time.NewTicker(poolMaintainInterval)
+	defer ticker.Stop()
+	for {
+		db.reapConns()
+		db.warmConns()
+
+		select {
+		case <-db.stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+//空闲列表的前面是最久没有使用的连接
+func (db *DB) reapConns() {
+	db.poolLock.Lock()
+	var closing []*Conn
+	excess := len(db.idle) - db.pool.MinIdle
+	kept := db.idle[:0]
+	for _, co := range db.idle {
+		switch {
+		case db.expired(co):
+			atomic.AddInt64(&db.closedLifetime, 1)
+			closing = append(closing, co)
+		case 0 < excess && db.pool.MaxIdleTime <= time.Since(time.Unix(co.pushTimestamp, 0)):
+			atomic.AddInt64(&db.closedIdle, 1)
+			closing = append(closing, co)
+			excess--
+		default:
+			kept = append(kept, co)
+		}
+	}
+	for i := len(kept); i < len(db.idle); i++ {
+		db.idle[i] = nil
+	}
+	db.idle = kept
+	db.numOpen -= len(closing)
+	db.poolLock.Unlock()
+
+	for _, co := range closing {
+		co.Close()
+	}
+}
+
+func (db *DB) warmConns() {
+	for {
+		db.poolLock.Lock()
+		if db.closed || db.pool.MinIdle <= len(db.idle) || db.pool.MaxOpen <= db.numOpen {
+			db.poolLock.Unlock()
+			return
+		}
+		db.numOpen++
+		db.poolLock.Unlock()
+
+		co, err := db.newConn()
+		if err != nil {
+			db.poolLock.Lock()
+			db.numOpen--
+			db.poolLock.Unlock()
+			golog.Warn("DB", "warmConns", err.Error(), 0, "db.Addr", db.addr)
+			return
+		}
+		db.putConn(co, false)
+	}
+}
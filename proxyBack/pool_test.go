@@ -0,0 +1,92 @@
+package proxyBack
+
+import (
+	"testing"
+	"time"
+
+	"brother/core/errors"
+	"brother/mysql"
+)
+
+//连接池中放入不连接mysql的空闲连接, 打开的连接数已经达到MaxOpen
+func newTestPool(maxOpen int, waitTimeout time.Duration) *DB {
+	db := &DB{addr: "127.0.0.1:3306", pool: PoolConfig{MaxOpen: maxOpen, WaitTimeout: waitTimeout}}
+	db.pool.setDefault()
+	for i := 0; i < maxOpen; i++ {
+		db.idle = append(db.idle, &Conn{createdAt: time.Now(), pushTimestamp: time.Now().Unix()})
+		db.numOpen++
+	}
+	return db
+}
+
+func TestPoolReuse(t *testing.T) {
+	db := newTestPool(2, time.Second)
+	last := db.idle[1]
+
+	co, err := db.getConn()
+	if err != nil || co != last {
+		t.Fatal("must reuse the last returned idle connection", err)
+	}
+	if s := db.PoolStats(); s.Open != 2 || s.Idle != 1 || s.InUse != 1 {
+		t.Fatal(s)
+	}
+
+	db.putConn(co, false)
+	if s := db.PoolStats(); s.Idle != 2 || s.InUse != 0 {
+		t.Fatal(s)
+	}
+
+	//超过MaxLifetime的连接归还时关闭
+	co, _ = db.getConn()
+	co.createdAt = time.Now().Add(-2 * db.pool.MaxLifetime)
+	db.putConn(co, false)
+	if s := db.PoolStats(); s.Open != 1 || s.Idle != 1 || s.ClosedLifetime != 1 {
+		t.Fatal(s)
+	}
+}
+
+func TestPoolWaitTimeout(t *testing.T) {
+	db := newTestPool(1, 50*time.Millisecond)
+	if _, err := db.getConn(); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := db.getConn()
+	if e, ok := err.(*mysql.SqlError); !ok || e.Code != mysql.ER_CON_COUNT_ERROR {
+		t.Fatal(err)
+	}
+	if s := db.PoolStats(); s.Waiting != 0 || s.WaitCount != 1 || s.WaitTimeouts != 1 {
+		t.Fatal(s)
+	}
+}
+
+func TestPoolHandOff(t *testing.T) {
+	db := newTestPool(1, time.Second)
+	co, err := db.getConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := make(chan *Conn)
+	go func() {
+		c, _ := db.getConn()
+		got <- c
+	}()
+	for db.PoolStats().Waiting == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	//有等待的请求时归还的连接直接交给它
+	db.putConn(co, false)
+	if c := <-got; c != co {
+		t.Fatal("returned connection must be handed to the waiter")
+	}
+	if s := db.PoolStats(); s.Idle != 0 || s.Waiting != 0 || s.WaitTimeouts != 0 {
+		t.Fatal(s)
+	}
+
+	db.closed = true
+	if _, err := db.getConn(); err != errors.ErrDatabaseClose {
+		t.Fatal(err)
+	}
+}
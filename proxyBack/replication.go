@@ -0,0 +1,171 @@
+package proxyBack
+
+import (
+	"time"
+
+	"brother/mysql"
+)
+
+//从库的复制状态, 由健康检查通过SHOW SLAVE STATUS获取
+type ReplicationStatus struct {
+	//没有配置复制时为false, 其余字段无意义
+	IsSlave				bool
+	//Seconds_Behind_Master, 为NULL(复制中断)时为-1
+	Lag				int64
+	IORunning			bool
+	SQLRunning			bool
+
+	//IO线程读到的主库位置和SQL线程执行到的主库位置, 故障切换时用于选择最新的从库
+	MasterLogFile			string
+	ReadMasterLogPos		uint64
+	RelayMasterLogFile		string
+	ExecMasterLogPos		uint64
+	ExecutedGtidSet			string
+}
+
+//复制线程都在运行且延迟不超过maxLag
+func (s *ReplicationStatus) CaughtUp(maxLag int64) bool {
+	if !s.IsSlave {
+		return true
+	}
+	return s.IORunning && s.SQLRunning && 0 <= s.Lag && s.Lag <= maxLag
+}
+
+type replicationColumns struct {
+	sql				string
+	lag				string
+	ioRunning			string
+	sqlRunning			string
+	masterLogFile			string
+	readMasterLogPos		string
+	relayMasterLogFile		string
+	execMasterLogPos		string
+}
+
+//MySQL 8.0.22之后的新语法和列名, 旧版本不支持时回退
+var replicationQueries = []*replicationColumns{
+	{"SHOW SLAVE STATUS", "Seconds_Behind_Master", "Slave_IO_Running", "Slave_SQL_Running",
+		"Master_Log_File", "Read_Master_Log_Pos", "Relay_Master_Log_File", "Exec_Master_Log_Pos"},
+	{"SHOW REPLICA STATUS", "Seconds_Behind_Source", "Replica_IO_Running", "Replica_SQL_Running",
+		"Source_Log_File", "Read_Source_Log_Pos", "Relay_Source_Log_File", "Exec_Source_Log_Pos"},
+}
+
+//通过checkConn查询复制状态, 结果同时记录在DB上
+func (db *DB) CheckReplication() (*ReplicationStatus, error) {
+	db.checkLock.Lock()
+	defer db.checkLock.Unlock()
+
+	if db.checkConn == nil {
+		return nil, mysql.ErrBadConn
+	}
+	if err := db.checkConn.SetDeadline(time.Now().Add(db.pingTimeout)); err != nil {
+		return nil, err
+	}
+	defer db.checkConn.SetDeadline(time.Time{})
+
+	var status *ReplicationStatus
+	var err error
+	for _, q := range replicationQueries {
+		var r *mysql.Result
+		r, err = db.checkConn.exec(q.sql)
+		if isParseError(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		status, err = parseReplicationStatus(r, q)
+		break
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	db.Lock()
+	db.replication = status
+	db.Unlock()
+	return status, nil
+}
+
+//多源复制时有多行, 取最大的延迟, 任何一个通道的线程停止都认为复制中断
+func parseReplicationStatus(r *mysql.Result, q *replicationColumns) (*ReplicationStatus, error) {
+	status := new(ReplicationStatus)
+	if r.Resultset == nil || r.RowNumber() == 0 {
+		return status, nil
+	}
+
+	status.IsSlave = true
+	status.IORunning = true
+	status.SQLRunning = true
+	for i := 0; i < r.RowNumber(); i++ {
+		io, err := r.GetStringByName(i, q.ioRunning)
+		if err != nil {
+			return nil, err
+		}
+		sql, err := r.GetStringByName(i, q.sqlRunning)
+		if err != nil {
+			return nil, err
+		}
+		status.IORunning = status.IORunning && io == "Yes"
+		status.SQLRunning = status.SQLRunning && sql == "Yes"
+
+		//多源复制时位置没有可比性, 只记录第一个通道
+		if i == 0 {
+			if err = parseReplicationPosition(r, q, status); err != nil {
+				return nil, err
+			}
+		}
+
+		isNull, err := r.IsNullByName(i, q.lag)
+		if err != nil {
+			return nil, err
+		}
+		if isNull {
+			status.Lag = -1
+			continue
+		}
+		lag, err := r.GetIntByName(i, q.lag)
+		if err != nil {
+			return nil, err
+		}
+		if status.Lag >= 0 && lag > status.Lag {
+			status.Lag = lag
+		}
+	}
+	return status, nil
+}
+
+func parseReplicationPosition(r *mysql.Result, q *replicationColumns, status *ReplicationStatus) error {
+	var err error
+	if status.MasterLogFile, err = r.GetStringByName(0, q.masterLogFile); err != nil {
+		return err
+	}
+	if status.ReadMasterLogPos, err = r.GetUintByName(0, q.readMasterLogPos); err != nil {
+		return err
+	}
+	if status.RelayMasterLogFile, err = r.GetStringByName(0, q.relayMasterLogFile); err != nil {
+		return err
+	}
+	if status.ExecMasterLogPos, err = r.GetUintByName(0, q.execMasterLogPos); err != nil {
+		return err
+	}
+	//5.6之前的版本没有GTID
+	if _, ok := r.FieldNames["Executed_Gtid_Set"]; ok {
+		if status.ExecutedGtidSet, err = r.GetStringByName(0, "Executed_Gtid_Set"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func isParseError(err error) bool {
+	e, ok := err.(*mysql.SqlError)
+	return ok && e.Code == mysql.ER_PARSE_ERROR
+}
+
+//最近一次检查到的复制状态, 没有检查过时为nil
+func (db *DB) Replication() *ReplicationStatus {
+	db.RLock()
+	defer db.RUnlock()
+	return db.replication
+}
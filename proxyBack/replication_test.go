@@ -0,0 +1,54 @@
+package proxyBack
+
+import (
+	"testing"
+
+	"brother/mysql"
+)
+
+func newTestResult(names []string, values ...[]interface{}) *mysql.Result {
+	r := &mysql.Resultset{FieldNames: make(map[string]int, len(names)), Values: values}
+	for i, name := range names {
+		r.Fields = append(r.Fields, &mysql.Field{Name: []byte(name)})
+		r.FieldNames[name] = i
+	}
+	return &mysql.Result{Resultset: r}
+}
+
+var testReplicationNames = []string{"Slave_IO_Running", "Slave_SQL_Running", "Seconds_Behind_Master",
+	"Master_Log_File", "Read_Master_Log_Pos", "Relay_Master_Log_File", "Exec_Master_Log_Pos", "Executed_Gtid_Set"}
+
+func TestParseReplicationStatus(t *testing.T) {
+	q := replicationQueries[0]
+
+	//不是从库
+	status, err := parseReplicationStatus(newTestResult(testReplicationNames), q)
+	if err != nil || status.IsSlave || !status.CaughtUp(0) {
+		t.Fatal(status, err)
+	}
+
+	r := newTestResult(testReplicationNames,
+		[]interface{}{"Yes", "Yes", int64(3), "mysql-bin.000003", uint64(200), "mysql-bin.000002", uint64(100), "uuid1:1-10"})
+	status, err = parseReplicationStatus(r, q)
+	if err != nil || !status.IsSlave || status.Lag != 3 || status.MasterLogFile != "mysql-bin.000003" ||
+		status.ReadMasterLogPos != 200 || status.ExecMasterLogPos != 100 || status.ExecutedGtidSet != "uuid1:1-10" {
+		t.Fatal(status, err)
+	}
+	if !status.CaughtUp(3) || status.CaughtUp(2) {
+		t.Fatal("lag 3 must be caught up within max lag 3 only")
+	}
+
+	//多源复制取最大的延迟, 任何一个通道中断都认为复制中断
+	r = newTestResult(testReplicationNames,
+		[]interface{}{"Yes", "Yes", int64(3), "mysql-bin.000003", uint64(200), "mysql-bin.000002", uint64(100), ""},
+		[]interface{}{"Yes", "Yes", int64(8), "mysql-bin.000001", uint64(4), "mysql-bin.000001", uint64(4), ""})
+	if status, err = parseReplicationStatus(r, q); err != nil || status.Lag != 8 {
+		t.Fatal(status, err)
+	}
+	r = newTestResult(testReplicationNames,
+		[]interface{}{"Yes", "Yes", int64(3), "mysql-bin.000003", uint64(200), "mysql-bin.000002", uint64(100), ""},
+		[]interface{}{"No", "Yes", nil, "mysql-bin.000001", uint64(4), "mysql-bin.000001", uint64(4), ""})
+	if status, err = parseReplicationStatus(r, q); err != nil || status.IORunning || status.Lag != -1 || status.CaughtUp(100) {
+		t.Fatal(status, err)
+	}
+}
@@ -215,4 +215,53 @@ func (c *Conn) Prepare(query string) (*Stmt, error) {
 	}
 
 	return s, nil
-}
\ No newline at end of file
+}
+
+//每个后端连接缓存的prepare语句数, 超过时关闭最久没有使用的, 避免超过服务端的max_prepared_stmt_count
+const StmtCacheSize = 64
+
+//同一个连接上相同的sql只prepare一次, 语句在连接关闭或者重置会话之前一直有效
+func (c *Conn) PrepareCached(query string) (*Stmt, error) {
+	if s, ok := c.stmtCache[query]; ok {
+		c.touchStmt(query)
+		return s, nil
+	}
+
+	s, err := c.Prepare(query)
+	if err != nil {
+		return nil, err
+	}
+	if c.stmtCache == nil {
+		c.stmtCache = make(map[string]*Stmt)
+	}
+	if len(c.stmtOrder) >= StmtCacheSize {
+		oldest := c.stmtOrder[0]
+		c.stmtOrder = c.stmtOrder[1:]
+		if old, ok := c.stmtCache[oldest]; ok {
+			delete(c.stmtCache, oldest)
+			if err = old.Close(); err != nil {
+				return nil, err
+			}
+		}
+	}
+	c.stmtCache[query] = s
+	c.stmtOrder = append(c.stmtOrder, query)
+	return s, nil
+}
+
+//移到最近使用的位置
+func (c *Conn) touchStmt(query string) {
+	for i, q := range c.stmtOrder {
+		if q == query {
+			c.stmtOrder = append(c.stmtOrder[:i], c.stmtOrder[i+1:]...)
+			break
+		}
+	}
+	c.stmtOrder = append(c.stmtOrder, query)
+}
+
+//服务端的prepare语句随会话一起释放
+func (c *Conn) clearStmtCache() {
+	c.stmtCache = nil
+	c.stmtOrder = nil
+}
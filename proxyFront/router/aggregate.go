@@ -0,0 +1,355 @@
+package router
+
+import (
+	"strconv"
+	"strings"
+
+	"brother/core/errors"
+	"brother/sqlparser"
+)
+
+//proxy能够合并的聚合函数
+const (
+	AggrCount         = "count"
+	AggrSum           = "sum"
+	AggrMin           = "min"
+	AggrMax           = "max"
+	AggrAvg           = "avg"
+	AggrCountDistinct = "count_distinct"
+)
+
+//结果集中需要合并的一个聚合列
+type AggrColumn struct {
+	Func  string
+	Index int
+	//avg在子表上改写成sum, CountIndex是追加的count列
+	CountIndex int
+}
+
+type OrderColumn struct {
+	Index     int
+	Direction string
+}
+
+//跨分表的聚合查询, proxy合并结果集需要的信息
+type SelectMerge struct {
+	//客户端可见的列数, 之后的列是为了合并追加的
+	ColumnCount   int
+	Aggrs         []*AggrColumn
+	GroupByIndexs []int
+	Distinct      bool
+	Having        sqlparser.BoolExpr
+	OrderBy       []*OrderColumn
+	Limit         *sqlparser.Limit
+
+	//表达式 -> 列下标
+	columns map[string]int
+	exprs   sqlparser.SelectExprs
+}
+
+//返回表达式在合并结果集中的列下标, 列名和表达式不区分大小写
+func (m *SelectMerge) ColumnIndex(expr sqlparser.ValExpr) (int, bool) {
+	s := sqlparser.String(expr)
+	if index, ok := m.columns[s]; ok {
+		return index, true
+	}
+	if index, ok := m.columns[strings.ToLower(s)]; ok {
+		return index, true
+	}
+	if col, ok := expr.(*sqlparser.ColName); ok {
+		index, ok := m.columns[strings.ToLower(string(col.Name))]
+		return index, ok
+	}
+	return -1, false
+}
+
+func (m *SelectMerge) addColumnName(name string, index int) {
+	if _, ok := m.columns[name]; !ok {
+		m.columns[name] = index
+	}
+}
+
+//把表达式加入子表的select列表, 聚合函数改写成可以合并的形式
+func (m *SelectMerge) addColumn(expr sqlparser.Expr, as []byte) (int, error) {
+	index := len(m.exprs)
+	valExpr, isValExpr := expr.(sqlparser.ValExpr)
+	if isValExpr {
+		m.addColumnName(sqlparser.String(valExpr), index)
+		m.addColumnName(strings.ToLower(sqlparser.String(valExpr)), index)
+		if col, ok := valExpr.(*sqlparser.ColName); ok {
+			m.addColumnName(strings.ToLower(string(col.Name)), index)
+		}
+	}
+	if as != nil {
+		m.addColumnName(strings.ToLower(string(as)), index)
+	}
+
+	fun, ok := expr.(*sqlparser.FuncExpr)
+	if !ok || !isAggregate(fun) {
+		if hasAggregate(expr) {
+			return -1, errors.ErrAggrTooComplex
+		}
+		m.exprs = append(m.exprs, &sqlparser.NonStarExpr{Expr: expr, As: as})
+		return index, nil
+	}
+
+	//改写之后的列仍然使用原来的列名
+	alias := as
+	if alias == nil {
+		alias = []byte("`" + strings.Replace(sqlparser.String(fun), "`", "``", -1) + "`")
+	}
+	name := strings.ToLower(string(fun.Name))
+	switch {
+	case fun.Distinct:
+		//count(distinct col): 子表按col分组, proxy对col去重计数
+		if name != AggrCount || len(fun.Exprs) != 1 {
+			return -1, errors.ErrAggrTooComplex
+		}
+		arg, ok := fun.Exprs[0].(*sqlparser.NonStarExpr)
+		if !ok {
+			return -1, errors.ErrAggrTooComplex
+		}
+		argExpr, ok := arg.Expr.(sqlparser.ValExpr)
+		if !ok {
+			return -1, errors.ErrAggrTooComplex
+		}
+		m.exprs = append(m.exprs, &sqlparser.NonStarExpr{Expr: argExpr, As: alias})
+		m.Aggrs = append(m.Aggrs, &AggrColumn{Func: AggrCountDistinct, Index: index})
+	case name == AggrAvg:
+		//avg(col)改写成sum(col), 对应的count(col)最后再追加
+		sum := &sqlparser.FuncExpr{Name: []byte(AggrSum), Exprs: fun.Exprs}
+		m.exprs = append(m.exprs, &sqlparser.NonStarExpr{Expr: sum, As: alias})
+		m.Aggrs = append(m.Aggrs, &AggrColumn{Func: AggrAvg, Index: index, CountIndex: -1})
+	default:
+		m.exprs = append(m.exprs, &sqlparser.NonStarExpr{Expr: expr, As: as})
+		m.Aggrs = append(m.Aggrs, &AggrColumn{Func: name, Index: index})
+	}
+	return index, nil
+}
+
+//select列表中没有的表达式, 追加到子表的select列表末尾
+func (m *SelectMerge) findOrAddColumn(expr sqlparser.ValExpr) (int, error) {
+	if index, ok := m.ColumnIndex(expr); ok {
+		return index, nil
+	}
+	return m.addColumn(expr, nil)
+}
+
+//order by的列, 数字表示select列表中的位置, 其他不在select列表中的表达式追加到末尾
+func (m *SelectMerge) addOrderBy(orderBy sqlparser.OrderBy) error {
+	for _, o := range orderBy {
+		var index int
+		var err error
+		if v, ok := o.Expr.(sqlparser.NumVal); ok {
+			pos, e := strconv.Atoi(string(v))
+			if e != nil || pos < 1 || m.ColumnCount < pos {
+				return errors.ErrOrderByColumn
+			}
+			index = pos - 1
+		} else if index, err = m.findOrAddColumn(o.Expr); err != nil {
+			return err
+		}
+		m.OrderBy = append(m.OrderBy, &OrderColumn{Index: index, Direction: o.Direction})
+	}
+	return nil
+}
+
+//having中引用的列和聚合函数都要出现在子表的结果集中
+func (m *SelectMerge) addHavingColumns(node sqlparser.BoolExpr) error {
+	switch node := node.(type) {
+	case *sqlparser.AndExpr:
+		if err := m.addHavingColumns(node.Left); err != nil {
+			return err
+		}
+		return m.addHavingColumns(node.Right)
+	case *sqlparser.OrExpr:
+		if err := m.addHavingColumns(node.Left); err != nil {
+			return err
+		}
+		return m.addHavingColumns(node.Right)
+	case *sqlparser.NotExpr:
+		return m.addHavingColumns(node.Expr)
+	case *sqlparser.ParenBoolExpr:
+		return m.addHavingColumns(node.Expr)
+	case *sqlparser.ComparisonExpr:
+		switch node.Operator {
+		case sqlparser.AST_EQ, sqlparser.AST_NE, sqlparser.AST_NSE,
+			sqlparser.AST_LT, sqlparser.AST_LE, sqlparser.AST_GT, sqlparser.AST_GE:
+			return m.addHavingValues(node.Left, node.Right)
+		}
+	case *sqlparser.RangeCond:
+		return m.addHavingValues(node.Left, node.From, node.To)
+	case *sqlparser.NullCheck:
+		return m.addHavingValues(node.Expr)
+	}
+	return errors.ErrHavingTooComplex
+}
+
+func (m *SelectMerge) addHavingValues(exprs ...sqlparser.ValExpr) error {
+	for _, expr := range exprs {
+		switch expr.(type) {
+		case sqlparser.StrVal, sqlparser.NumVal, *sqlparser.NullVal:
+			continue
+		case *sqlparser.ColName, *sqlparser.FuncExpr:
+			if _, err := m.findOrAddColumn(expr); err != nil {
+				return err
+			}
+		default:
+			return errors.ErrHavingTooComplex
+		}
+	}
+	return nil
+}
+
+//跨分表的select是否需要proxy做聚合合并
+func needMerge(stmt *sqlparser.Select) bool {
+	if len(stmt.Distinct) != 0 || len(stmt.GroupBy) != 0 || stmt.Having != nil {
+		return true
+	}
+	for _, e := range stmt.SelectExprs {
+		if expr, ok := e.(*sqlparser.NonStarExpr); ok && hasAggregate(expr.Expr) {
+			return true
+		}
+	}
+	return false
+}
+
+//生成合并信息, 返回发往各子表的select语句
+func (plan *Plan) buildSelectMerge(stmt *sqlparser.Select) (*sqlparser.Select, error) {
+	m := &SelectMerge{
+		ColumnCount: len(stmt.SelectExprs),
+		Distinct:    len(stmt.Distinct) != 0,
+		Limit:       stmt.Limit,
+		columns:     make(map[string]int),
+	}
+
+	for _, e := range stmt.SelectExprs {
+		expr, ok := e.(*sqlparser.NonStarExpr)
+		if !ok {
+			return nil, errors.ErrAggrWithStar
+		}
+		if _, err := m.addColumn(expr.Expr, expr.As); err != nil {
+			return nil, err
+		}
+	}
+
+	groupBy := make(sqlparser.GroupBy, 0, len(stmt.GroupBy))
+	for _, g := range stmt.GroupBy {
+		index, err := m.findOrAddColumn(g)
+		if err != nil {
+			return nil, err
+		}
+		m.GroupByIndexs = append(m.GroupByIndexs, index)
+		groupBy = append(groupBy, g)
+	}
+
+	if stmt.Having != nil {
+		if err := m.addHavingColumns(stmt.Having.Expr); err != nil {
+			return nil, err
+		}
+		m.Having = stmt.Having.Expr
+	}
+
+	if err := m.addOrderBy(stmt.OrderBy); err != nil {
+		return nil, err
+	}
+
+	for _, aggr := range m.Aggrs {
+		switch aggr.Func {
+		case AggrAvg:
+			sum := m.exprs[aggr.Index].(*sqlparser.NonStarExpr).Expr.(*sqlparser.FuncExpr)
+			count := &sqlparser.FuncExpr{Name: []byte(AggrCount), Exprs: sum.Exprs}
+			index, err := m.findOrAddColumn(count)
+			if err != nil {
+				return nil, err
+			}
+			aggr.CountIndex = index
+		case AggrCountDistinct:
+			//子表还需要按count(distinct col)的col分组
+			groupBy = append(groupBy, m.exprs[aggr.Index].(*sqlparser.NonStarExpr).Expr.(sqlparser.ValExpr))
+		}
+	}
+
+	//子表不做having/order by/limit, 合并之后由proxy处理
+	newStmt := *stmt
+	newStmt.SelectExprs = m.exprs
+	newStmt.GroupBy = groupBy
+	newStmt.Having = nil
+	newStmt.OrderBy = nil
+	newStmt.Limit = nil
+	if len(newStmt.GroupBy) == 0 {
+		newStmt.GroupBy = nil
+	}
+
+	plan.Merge = m
+	return &newStmt, nil
+}
+
+//跨分表只有order by的select: 子表保留order by和改写之后的limit, 不在select列表中的排序列
+//追加到子表的select列表末尾, 合并排序之后去掉; select *的列数未知, 由proxy按结果集的字段名排序
+func (plan *Plan) buildSelectSort(stmt *sqlparser.Select) (*sqlparser.Select, error) {
+	newLimit, err := stmt.Limit.RewriteLimit()
+	if err != nil {
+		return nil, err
+	}
+	newStmt := *stmt
+	newStmt.Limit = newLimit
+
+	for _, e := range stmt.SelectExprs {
+		if _, ok := e.(*sqlparser.NonStarExpr); !ok {
+			return &newStmt, nil
+		}
+	}
+
+	m := &SelectMerge{
+		ColumnCount: len(stmt.SelectExprs),
+		Limit:       stmt.Limit,
+		columns:     make(map[string]int),
+	}
+	for _, e := range stmt.SelectExprs {
+		expr := e.(*sqlparser.NonStarExpr)
+		if _, err := m.addColumn(expr.Expr, expr.As); err != nil {
+			return nil, err
+		}
+	}
+	if err := m.addOrderBy(stmt.OrderBy); err != nil {
+		return nil, err
+	}
+
+	newStmt.SelectExprs = m.exprs
+	plan.Merge = m
+	return &newStmt, nil
+}
+
+func isAggregate(fun *sqlparser.FuncExpr) bool {
+	switch strings.ToLower(string(fun.Name)) {
+	case AggrCount, AggrSum, AggrMin, AggrMax, AggrAvg:
+		return true
+	}
+	return false
+}
+
+func hasAggregate(expr sqlparser.Expr) bool {
+	switch node := expr.(type) {
+	case *sqlparser.FuncExpr:
+		if isAggregate(node) {
+			return true
+		}
+		for _, e := range node.Exprs {
+			if arg, ok := e.(*sqlparser.NonStarExpr); ok && hasAggregate(arg.Expr) {
+				return true
+			}
+		}
+	case *sqlparser.BinaryExpr:
+		return hasAggregate(node.Left) || hasAggregate(node.Right)
+	case *sqlparser.UnaryExpr:
+		return hasAggregate(node.Expr)
+	case sqlparser.ValTuple:
+		for _, e := range node {
+			if hasAggregate(e) {
+				return true
+			}
+		}
+	}
+	return false
+}
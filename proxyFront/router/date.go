@@ -0,0 +1,197 @@
+package router
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"brother/core/errors"
+	"brother/core/hack"
+)
+
+//分片键支持的日期格式, 纯数字按unix时间戳处理
+var dateLayouts = []string{
+	"2006-01-02 15:04:05",
+	"2006-01-02",
+}
+
+//按年分表: 子表下标为yyyy, 如orders_2016
+type DateYearShard struct {
+}
+
+func (s *DateYearShard) FindForKey(key interface{}) (int, error) {
+	t, err := DateValue(key)
+	if err != nil {
+		return -1, err
+	}
+	return t.Year(), nil
+}
+
+func (s *DateYearShard) EqualStart(key interface{}, index int) bool {
+	t, err := DateValue(key)
+	if err != nil {
+		return false
+	}
+	return t.YearDay() == 1 && isMidnight(t)
+}
+
+func (s *DateYearShard) EqualStop(key interface{}, index int) bool {
+	return false
+}
+
+//按月分表: 子表下标为yyyymm, 如orders_201605
+type DateMonthShard struct {
+}
+
+func (s *DateMonthShard) FindForKey(key interface{}) (int, error) {
+	t, err := DateValue(key)
+	if err != nil {
+		return -1, err
+	}
+	return t.Year()*100 + int(t.Month()), nil
+}
+
+func (s *DateMonthShard) EqualStart(key interface{}, index int) bool {
+	t, err := DateValue(key)
+	if err != nil {
+		return false
+	}
+	return t.Day() == 1 && isMidnight(t)
+}
+
+func (s *DateMonthShard) EqualStop(key interface{}, index int) bool {
+	return false
+}
+
+//按天分表: 子表下标为yyyymmdd, 如orders_20160501
+type DateDayShard struct {
+}
+
+func (s *DateDayShard) FindForKey(key interface{}) (int, error) {
+	t, err := DateValue(key)
+	if err != nil {
+		return -1, err
+	}
+	return t.Year()*10000 + int(t.Month())*100 + t.Day(), nil
+}
+
+func (s *DateDayShard) EqualStart(key interface{}, index int) bool {
+	t, err := DateValue(key)
+	if err != nil {
+		return false
+	}
+	return isMidnight(t)
+}
+
+func (s *DateDayShard) EqualStop(key interface{}, index int) bool {
+	return false
+}
+
+func isMidnight(t time.Time) bool {
+	return t.Hour() == 0 && t.Minute() == 0 && t.Second() == 0 && t.Nanosecond() == 0
+}
+
+//DATE/DATETIME字符串或者unix时间戳
+func DateValue(value interface{}) (time.Time, error) {
+	switch val := value.(type) {
+	case int:
+		return time.Unix(int64(val), 0), nil
+	case uint64:
+		return time.Unix(int64(val), 0), nil
+	case int64:
+		return time.Unix(val, 0), nil
+	case []byte:
+		return parseDateString(hack.String(val))
+	case string:
+		return parseDateString(val)
+	}
+	return time.Time{}, NewKeyError("Unexpected key variable type %T", value)
+}
+
+func parseDateString(s string) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if v, err := strconv.ParseInt(s, 10, 64); err == nil {
+		return time.Unix(v, 0), nil
+	}
+
+	for _, layout := range dateLayouts {
+		if t, err := time.ParseInLocation(layout, s, time.Local); err == nil {
+			return t, nil
+		}
+	}
+	return time.Time{}, errors.ErrDateIllegal
+}
+
+//date_range中的一项, 如"2015-2016"或者单独的"2015"
+func splitDateRange(dateRange string) (string, string, error) {
+	dates := strings.Split(strings.TrimSpace(dateRange), "-")
+	switch len(dates) {
+	case 1:
+		return dates[0], dates[0], nil
+	case 2:
+		return strings.TrimSpace(dates[0]), strings.TrimSpace(dates[1]), nil
+	}
+	return "", "", errors.ErrDateRangeIllegal
+}
+
+func parseDate(layout string, s string) (time.Time, error) {
+	if len(s) != len(layout) {
+		return time.Time{}, errors.ErrDateRangeIllegal
+	}
+	t, err := time.ParseInLocation(layout, s, time.Local)
+	if err != nil {
+		return time.Time{}, errors.ErrDateRangeIllegal
+	}
+	return t, nil
+}
+
+//按年: "2015-2016" -> [2015, 2016]
+func ParseYearRange(dateRange string) ([]int, error) {
+	return parseDateRange(dateRange, "2006", func(t time.Time) time.Time {
+		return t.AddDate(1, 0, 0)
+	}, new(DateYearShard))
+}
+
+//按月: "201511-201602" -> [201511, 201512, 201601, 201602]
+func ParseMonthRange(dateRange string) ([]int, error) {
+	return parseDateRange(dateRange, "200601", func(t time.Time) time.Time {
+		return t.AddDate(0, 1, 0)
+	}, new(DateMonthShard))
+}
+
+//按天: "20160130-20160202" -> [20160130, 20160131, 20160201, 20160202]
+func ParseDayRange(dateRange string) ([]int, error) {
+	return parseDateRange(dateRange, "20060102", func(t time.Time) time.Time {
+		return t.AddDate(0, 0, 1)
+	}, new(DateDayShard))
+}
+
+func parseDateRange(dateRange string, layout string, next func(time.Time) time.Time, s Shard) ([]int, error) {
+	start, end, err := splitDateRange(dateRange)
+	if err != nil {
+		return nil, err
+	}
+
+	startTime, err := parseDate(layout, start)
+	if err != nil {
+		return nil, err
+	}
+	endTime, err := parseDate(layout, end)
+	if err != nil {
+		return nil, err
+	}
+	if startTime.After(endTime) {
+		return nil, fmt.Errorf("%s: start is after end in [%s]", errors.ErrDateRangeIllegal, dateRange)
+	}
+
+	indexs := make([]int, 0)
+	for t := startTime; !t.After(endTime); t = next(t) {
+		index, err := s.FindForKey(t.Unix())
+		if err != nil {
+			return nil, err
+		}
+		indexs = append(indexs, index)
+	}
+	return indexs, nil
+}
@@ -0,0 +1,91 @@
+package router
+
+import (
+	"bytes"
+
+	"brother/core/errors"
+	"brother/sqlparser"
+)
+
+//DDL在AST中只保留了表名, 子表的语句通过替换原始sql中的表名生成
+func (r *Router) BuildDDLPlan(db string, statement sqlparser.Statement, sql string) (*Plan, error) {
+	var table *sqlparser.TableName
+	switch stmt := statement.(type) {
+	case *sqlparser.DDL:
+		name := stmt.Table
+		if stmt.Action == sqlparser.AST_CREATE {
+			name = stmt.NewName
+		}
+		table = &sqlparser.TableName{Name: name}
+	case *sqlparser.Truncate:
+		table = stmt.Table
+	default:
+		return nil, errors.ErrNoPlan
+	}
+
+	plan := &Plan{}
+	plan.Rule = r.GetRule(db, table)
+	if plan.Rule.Type == DefaultRuleType {
+		return plan, nil
+	}
+	//分表的rename需要同时修改配置, 不支持
+	if stmt, ok := statement.(*sqlparser.DDL); ok && stmt.Action == sqlparser.AST_RENAME {
+		return nil, errors.ErrDDLRename
+	}
+
+	plan.RouteTableIndexs = plan.Rule.SubTableIndexs
+	plan.RouteNodeIndexs = plan.TindexsToNindexs(plan.RouteTableIndexs)
+	plan.RewrittenSqls = make(map[string][]string)
+	for _, tableIndex := range plan.RouteTableIndexs {
+		nodeName := plan.Rule.Nodes[plan.Rule.TableToNode[tableIndex]]
+		subSql, err := rewriteDDL(sql, plan.Rule.Table, plan.Rule.SubTableName(tableIndex))
+		if err != nil {
+			return nil, err
+		}
+		plan.RewrittenSqls[nodeName] = append(plan.RewrittenSqls[nodeName], subSql)
+	}
+	return plan, nil
+}
+
+//把sql中第一次出现的表名替换成子表名, 保留原有的反引号
+func rewriteDDL(sql string, table string, subTable string) (string, error) {
+	tkn := sqlparser.NewStringTokenizer(sql)
+	end := 0
+	for {
+		typ, val := tkn.Scan()
+		if typ == 0 || typ == sqlparser.LEX_ERROR {
+			return "", errors.ErrDDLNoTable
+		}
+		start := end
+		end = tkn.Position - 1
+		if end > len(sql) {
+			end = len(sql)
+		}
+		if typ != sqlparser.ID || string(val) != table {
+			continue
+		}
+
+		for start < end && isBlank(sql[start]) {
+			start++
+		}
+		var buf bytes.Buffer
+		buf.WriteString(sql[:start])
+		if sql[start] == '`' {
+			buf.WriteString("`" + subTable + "`")
+		} else {
+			buf.WriteString(subTable)
+		}
+		buf.WriteString(sql[end:])
+		return buf.String(), nil
+	}
+}
+
+func isBlank(ch byte) bool {
+	return ch == ' ' || ch == '\n' || ch == '\r' || ch == '\t'
+}
+
+//DDL的AST中没有注释, 从原始sql中取出路由提示
+func ParseSqlHint(sql string) (*Hint, error) {
+	hint, _, err := StripSqlHint(sql)
+	return hint, err
+}
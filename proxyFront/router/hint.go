@@ -0,0 +1,178 @@
+package router
+
+import (
+	"strings"
+
+	"brother/core/errors"
+	"brother/sqlparser"
+)
+
+const (
+	hintPrefix = "brother:"
+
+	HintMaster = "master"
+	HintNode   = "node"
+	HintSlave  = "slave"
+	HintForce  = "force"
+)
+
+//sql注释中的路由提示, 如:
+//select /*brother:master*/ * from t
+//select /*brother:node=node2*/ * from t
+//select /*brother:slave=10.0.0.5:3306*/ * from t
+//alter /*brother:force*/ table t add c int
+type Hint struct {
+	//读也走主库
+	Master bool
+	//不做分表路由, 直接发往该节点
+	Node string
+	//读走该地址的从库
+	Slave string
+	//DDL在部分节点不可用时仍然执行
+	Force bool
+}
+
+//node或slave提示直接发往指定的数据库, 绕过分表路由
+func (h *Hint) IsDirect() bool {
+	return len(h.Node) != 0 || len(h.Slave) != 0
+}
+
+//解析注释中的路由提示, 返回提示和去掉提示之后的注释, 没有提示时返回nil
+func ParseHint(comments sqlparser.Comments) (*Hint, sqlparser.Comments, error) {
+	var hint *Hint
+	var rest sqlparser.Comments
+	for _, c := range comments {
+		text := strings.TrimSpace(string(c))
+		if !strings.HasPrefix(text, "/*") || !strings.HasSuffix(text, "*/") {
+			rest = append(rest, c)
+			continue
+		}
+		text = strings.TrimSpace(text[2 : len(text)-2])
+		if !strings.HasPrefix(strings.ToLower(text), hintPrefix) {
+			rest = append(rest, c)
+			continue
+		}
+
+		if hint == nil {
+			hint = new(Hint)
+		}
+		if err := hint.parse(text[len(hintPrefix):]); err != nil {
+			return nil, nil, err
+		}
+	}
+	if hint != nil && len(hint.Slave) != 0 && hint.Master {
+		return nil, nil, errors.ErrHintIllegal
+	}
+	return hint, rest, nil
+}
+
+//一个注释中可以有多个提示, 以逗号分隔
+func (h *Hint) parse(text string) error {
+	for _, item := range strings.Split(text, ",") {
+		item = strings.TrimSpace(item)
+		name, value := item, ""
+		if i := strings.Index(item, "="); i >= 0 {
+			name, value = strings.TrimSpace(item[:i]), strings.TrimSpace(item[i+1:])
+		}
+
+		switch strings.ToLower(name) {
+		case HintMaster:
+			if len(value) != 0 {
+				return errors.ErrHintIllegal
+			}
+			h.Master = true
+		case HintForce:
+			if len(value) != 0 {
+				return errors.ErrHintIllegal
+			}
+			h.Force = true
+		case HintNode:
+			if len(value) == 0 {
+				return errors.ErrHintIllegal
+			}
+			h.Node = value
+		case HintSlave:
+			if len(value) == 0 {
+				return errors.ErrHintIllegal
+			}
+			h.Slave = value
+		default:
+			return errors.ErrHintIllegal
+		}
+	}
+	return nil
+}
+
+//扫描原始sql中所有位置的注释取出路由提示, 返回去掉提示注释之后的sql
+//语句关键字之前的注释(/*brother:node=x*/ select ...)不在AST中, 只能从原始sql中取出
+func StripSqlHint(sql string) (*Hint, string, error) {
+	if !strings.Contains(sql, "/*") {
+		return nil, sql, nil
+	}
+
+	tkn := sqlparser.NewStringTokenizer(sql)
+	var comments sqlparser.Comments
+	var ends []int
+	for {
+		typ, val := tkn.Scan()
+		if typ == 0 || typ == sqlparser.LEX_ERROR {
+			break
+		}
+		if typ == sqlparser.COMMENT {
+			comments = append(comments, val)
+			//Position是已经读取的字节数, 最后读取的是注释之后的一个字符
+			ends = append(ends, tkn.Position-1)
+		}
+	}
+
+	hint, rest, err := ParseHint(comments)
+	if err != nil || hint == nil {
+		return nil, sql, err
+	}
+
+	//从后往前删除不在rest中的提示注释
+	kept := make(map[int]bool, len(rest))
+	for i, j := 0, 0; i < len(comments) && j < len(rest); i++ {
+		if string(comments[i]) == string(rest[j]) {
+			kept[i] = true
+			j++
+		}
+	}
+	for i := len(comments) - 1; i >= 0; i-- {
+		if kept[i] {
+			continue
+		}
+		end := ends[i]
+		start := end - len(comments[i])
+		sql = sql[:start] + sql[end:]
+	}
+	return hint, sql, nil
+}
+
+//取出语句中的路由提示, 并从语句的注释中删除
+func StripHint(statement sqlparser.Statement) (*Hint, error) {
+	var comments *sqlparser.Comments
+	switch stmt := statement.(type) {
+	case *sqlparser.Select:
+		comments = &stmt.Comments
+	case *sqlparser.SimpleSelect:
+		comments = &stmt.Comments
+	case *sqlparser.Insert:
+		comments = &stmt.Comments
+	case *sqlparser.Update:
+		comments = &stmt.Comments
+	case *sqlparser.Delete:
+		comments = &stmt.Comments
+	case *sqlparser.Replace:
+		comments = &stmt.Comments
+	default:
+		return nil, nil
+	}
+
+	hint, rest, err := ParseHint(*comments)
+	if err != nil || hint == nil {
+		return nil, err
+	}
+	*comments = rest
+	return hint, nil
+}
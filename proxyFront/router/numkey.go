@@ -0,0 +1,38 @@
+package router
+
+import (
+	"fmt"
+)
+
+//[Start, End)
+type NumKeyRange struct {
+	Start int64
+	End   int64
+}
+
+func (kr NumKeyRange) Contains(i int64) bool {
+	return kr.Start <= i && i < kr.End
+}
+
+func (kr NumKeyRange) String() string {
+	return fmt.Sprintf("{Start: %d, End: %d}", kr.Start, kr.End)
+}
+
+//每个子表保存tableRowLimit行, 子表按顺序首尾相接
+func ParseNumSharding(locations []int, tableRowLimit int) ([]NumKeyRange, error) {
+	if tableRowLimit <= 0 {
+		return nil, fmt.Errorf("table_row_limit must be greater than 0, not %d", tableRowLimit)
+	}
+
+	tableCount := 0
+	for _, l := range locations {
+		tableCount += l
+	}
+
+	ranges := make([]NumKeyRange, tableCount)
+	for i := 0; i < tableCount; i++ {
+		ranges[i].Start = int64(i * tableRowLimit)
+		ranges[i].End = int64((i + 1) * tableRowLimit)
+	}
+	return ranges, nil
+}
@@ -0,0 +1,502 @@
+package router
+
+import (
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"brother/core/errors"
+	"brother/sqlparser"
+)
+
+const (
+	EID_NODE = iota
+	VALUE_NODE
+	LIST_NODE
+	OTHER_NODE
+)
+
+type Plan struct {
+	Rule *Rule
+
+	//where条件或者insert的values
+	Criteria sqlparser.SQLNode
+	//insert/replace中分片键所在的列
+	KeyIndex int
+
+	RouteTableIndexs []int
+	RouteNodeIndexs  []int
+	//节点名 -> 在该节点上执行的sql
+	RewrittenSqls map[string][]string
+
+	//insert/replace: 子表下标 -> 插入该子表的行
+	tableRows map[int]sqlparser.Values
+	//分片键的in条件: 子表下标 -> 属于该子表的值
+	inValues map[*sqlparser.ComparisonExpr]map[int]sqlparser.ValTuple
+
+	//跨分表的聚合查询需要proxy合并结果集, 否则为nil
+	Merge *SelectMerge
+}
+
+func (plan *Plan) calRouteIndexs() error {
+	if plan.Rule.Type == DefaultRuleType {
+		plan.RouteNodeIndexs = []int{0}
+		return nil
+	}
+
+	switch criteria := plan.Criteria.(type) {
+	case sqlparser.Values:
+		tindexs, err := plan.getInsertTableIndexs(criteria)
+		if err != nil {
+			return err
+		}
+		plan.RouteTableIndexs = tindexs
+	case sqlparser.BoolExpr:
+		tindexs, err := plan.getTableIndexByBoolExpr(criteria)
+		if err != nil {
+			return err
+		}
+		plan.RouteTableIndexs = tindexs
+	default:
+		//没有分表条件, 全子表扫描
+		plan.RouteTableIndexs = plan.Rule.SubTableIndexs
+	}
+
+	if len(plan.RouteTableIndexs) == 0 {
+		return errors.ErrNoCriteria
+	}
+	plan.RouteNodeIndexs = plan.TindexsToNindexs(plan.RouteTableIndexs)
+	return nil
+}
+
+func (plan *Plan) TindexsToNindexs(tableIndexs []int) []int {
+	nodeIndexs := make([]int, 0, len(tableIndexs))
+	for _, tindex := range tableIndexs {
+		nodeIndexs = append(nodeIndexs, plan.Rule.TableToNode[tindex])
+	}
+	return unionList(nodeIndexs, nil)
+}
+
+func (plan *Plan) getIRKeyIndex(cols sqlparser.Columns) error {
+	if cols == nil {
+		return errors.ErrIRNoColumns
+	}
+
+	plan.KeyIndex = -1
+	for i := range cols {
+		expr, ok := cols[i].(*sqlparser.NonStarExpr)
+		if !ok {
+			return errors.ErrIRNoColumns
+		}
+		if strings.ToLower(sqlparser.GetColName(expr.Expr)) == plan.Rule.Key {
+			plan.KeyIndex = i
+			break
+		}
+	}
+	if plan.KeyIndex == -1 {
+		return errors.ErrIRNoShardingKey
+	}
+	return nil
+}
+
+func (plan *Plan) checkValuesType(rows sqlparser.InsertRows, colsLen int) (sqlparser.Values, error) {
+	vals, ok := rows.(sqlparser.Values)
+	if !ok {
+		return nil, errors.ErrInsertTooComplex
+	}
+
+	for i := 0; i < len(vals); i++ {
+		tuple, ok := vals[i].(sqlparser.ValTuple)
+		if !ok {
+			return nil, errors.ErrInsertTooComplex
+		}
+		if len(tuple) != colsLen {
+			return nil, errors.ErrColsLenNotMatch
+		}
+		if plan.getValueType(tuple[plan.KeyIndex]) != VALUE_NODE {
+			return nil, errors.ErrInsertTooComplex
+		}
+	}
+	return vals, nil
+}
+
+//多行insert按子表拆分, 每个子表只插入属于自己的行
+func (plan *Plan) getInsertTableIndexs(vals sqlparser.Values) ([]int, error) {
+	plan.tableRows = make(map[int]sqlparser.Values)
+	for i := 0; i < len(vals); i++ {
+		valueExpr := vals[i].(sqlparser.ValTuple)[plan.KeyIndex]
+		tableIndex, err := plan.getTableIndexByValue(valueExpr)
+		if err != nil {
+			return nil, err
+		}
+		plan.tableRows[tableIndex] = append(plan.tableRows[tableIndex], vals[i])
+	}
+
+	tableIndexs := make([]int, 0, len(plan.tableRows))
+	for tableIndex := range plan.tableRows {
+		tableIndexs = append(tableIndexs, tableIndex)
+	}
+	sort.Ints(tableIndexs)
+	return tableIndexs, nil
+}
+
+//返回valExpr表达式对应的类型
+func (plan *Plan) getValueType(valExpr sqlparser.ValExpr) int {
+	switch node := valExpr.(type) {
+	case *sqlparser.ColName:
+		if strings.ToLower(string(node.Name)) == plan.Rule.Key {
+			return EID_NODE //分片键
+		}
+	case sqlparser.ValTuple:
+		for _, n := range node {
+			if plan.getValueType(n) != VALUE_NODE {
+				return OTHER_NODE
+			}
+		}
+		return LIST_NODE
+	case sqlparser.StrVal, sqlparser.NumVal:
+		return VALUE_NODE
+	}
+	return OTHER_NODE
+}
+
+func (plan *Plan) getTableIndexByBoolExpr(node sqlparser.BoolExpr) ([]int, error) {
+	switch node := node.(type) {
+	case *sqlparser.AndExpr:
+		left, err := plan.getTableIndexByBoolExpr(node.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := plan.getTableIndexByBoolExpr(node.Right)
+		if err != nil {
+			return nil, err
+		}
+		return interList(left, right), nil
+	case *sqlparser.OrExpr:
+		left, err := plan.getTableIndexByBoolExpr(node.Left)
+		if err != nil {
+			return nil, err
+		}
+		right, err := plan.getTableIndexByBoolExpr(node.Right)
+		if err != nil {
+			return nil, err
+		}
+		return unionList(left, right), nil
+	case *sqlparser.ParenBoolExpr:
+		return plan.getTableIndexByBoolExpr(node.Expr)
+	case *sqlparser.RangeCond:
+		if node.Operator != sqlparser.AST_BETWEEN {
+			break
+		}
+		if plan.getValueType(node.Left) != EID_NODE ||
+			plan.getValueType(node.From) != VALUE_NODE ||
+			plan.getValueType(node.To) != VALUE_NODE {
+			break
+		}
+		return plan.getTableIndexsBetween(node.From, node.To)
+	case *sqlparser.ComparisonExpr:
+		switch node.Operator {
+		case sqlparser.AST_IN:
+			if plan.getValueType(node.Left) == EID_NODE && plan.getValueType(node.Right) == LIST_NODE {
+				return plan.getTableIndexsByIn(node)
+			}
+		case sqlparser.AST_LT, sqlparser.AST_LE, sqlparser.AST_GT, sqlparser.AST_GE:
+			left := plan.getValueType(node.Left)
+			right := plan.getValueType(node.Right)
+			if left == EID_NODE && right == VALUE_NODE {
+				return plan.getTableIndexsByRange(node.Operator, node.Right)
+			} else if left == VALUE_NODE && right == EID_NODE {
+				return plan.getTableIndexsByRange(reverseOperator(node.Operator), node.Left)
+			}
+		}
+		if node.Operator != sqlparser.AST_EQ && node.Operator != sqlparser.AST_NSE {
+			break
+		}
+		left := plan.getValueType(node.Left)
+		right := plan.getValueType(node.Right)
+		var index int
+		var err error
+		if left == EID_NODE && right == VALUE_NODE {
+			index, err = plan.getTableIndexByValue(node.Right)
+		} else if left == VALUE_NODE && right == EID_NODE {
+			index, err = plan.getTableIndexByValue(node.Left)
+		} else {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		return []int{index}, nil
+	}
+	return plan.Rule.SubTableIndexs, nil
+}
+
+//key in (...): 按子表拆分in列表, 改写sql时每个子表只保留自己的值
+func (plan *Plan) getTableIndexsByIn(node *sqlparser.ComparisonExpr) ([]int, error) {
+	values := make(map[int]sqlparser.ValTuple)
+	for _, valExpr := range node.Right.(sqlparser.ValTuple) {
+		index, err := plan.getTableIndexByValue(valExpr)
+		if err != nil {
+			return nil, err
+		}
+		values[index] = append(values[index], valExpr)
+	}
+
+	if plan.inValues == nil {
+		plan.inValues = make(map[*sqlparser.ComparisonExpr]map[int]sqlparser.ValTuple)
+	}
+	plan.inValues[node] = values
+
+	tableIndexs := make([]int, 0, len(values))
+	for index := range values {
+		tableIndexs = append(tableIndexs, index)
+	}
+	sort.Ints(tableIndexs)
+	return tableIndexs, nil
+}
+
+//分片键的范围条件, 只有按范围分片的规则才能裁剪子表
+func (plan *Plan) getTableIndexsByRange(operator string, valExpr sqlparser.ValExpr) ([]int, error) {
+	shard, ok := plan.Rule.Shard.(RangeShard)
+	if !ok {
+		return plan.Rule.SubTableIndexs, nil
+	}
+
+	value, err := getBoundValue(valExpr)
+	if err != nil {
+		return nil, err
+	}
+	index, err := shard.FindForKey(value)
+	if err == errors.ErrKeyOutOfRange {
+		//超出分片范围的值无法裁剪
+		return plan.Rule.SubTableIndexs, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	switch operator {
+	case sqlparser.AST_LT:
+		if shard.EqualStart(value, index) {
+			index--
+		}
+		return rangeList(plan.Rule.SubTableIndexs, math.MinInt32, index), nil
+	case sqlparser.AST_LE:
+		return rangeList(plan.Rule.SubTableIndexs, math.MinInt32, index), nil
+	case sqlparser.AST_GT:
+		if shard.EqualStop(value, index) {
+			index++
+		}
+		return rangeList(plan.Rule.SubTableIndexs, index, math.MaxInt32), nil
+	case sqlparser.AST_GE:
+		return rangeList(plan.Rule.SubTableIndexs, index, math.MaxInt32), nil
+	}
+	return plan.Rule.SubTableIndexs, nil
+}
+
+//key between from and to, 两端都包含
+func (plan *Plan) getTableIndexsBetween(from, to sqlparser.ValExpr) ([]int, error) {
+	shard, ok := plan.Rule.Shard.(RangeShard)
+	if !ok {
+		return plan.Rule.SubTableIndexs, nil
+	}
+
+	fromValue, err := getBoundValue(from)
+	if err != nil {
+		return nil, err
+	}
+	toValue, err := getBoundValue(to)
+	if err != nil {
+		return nil, err
+	}
+
+	start, err := shard.FindForKey(fromValue)
+	if err == errors.ErrKeyOutOfRange {
+		start = math.MinInt32
+	} else if err != nil {
+		return nil, err
+	}
+	end, err := shard.FindForKey(toValue)
+	if err == errors.ErrKeyOutOfRange {
+		end = math.MaxInt32
+	} else if err != nil {
+		return nil, err
+	}
+	return rangeList(plan.Rule.SubTableIndexs, start, end), nil
+}
+
+func (plan *Plan) getTableIndexByValue(valExpr sqlparser.ValExpr) (int, error) {
+	value, err := getBoundValue(valExpr)
+	if err != nil {
+		return -1, err
+	}
+	return plan.Rule.FindTableIndex(value)
+}
+
+func getBoundValue(valExpr sqlparser.ValExpr) (interface{}, error) {
+	switch node := valExpr.(type) {
+	case sqlparser.ValTuple:
+		if len(node) != 1 {
+			return nil, sqlparser.NewParserError("tuples not allowed as insert values")
+		}
+		return getBoundValue(node[0])
+	case sqlparser.StrVal:
+		return string(node), nil
+	case sqlparser.NumVal:
+		val, err := strconv.ParseInt(string(node), 10, 64)
+		if err != nil {
+			return nil, sqlparser.NewParserError("%s", err.Error())
+		}
+		return val, nil
+	}
+	return nil, sqlparser.NewParserError("unexpected shard key value %s", sqlparser.String(valExpr))
+}
+
+//把语句中的逻辑表名替换成子表名, 按节点分组
+func (plan *Plan) generateSqls(stmt sqlparser.Statement) error {
+	if len(plan.RouteNodeIndexs) == 0 {
+		return errors.ErrNoRouteNode
+	}
+
+	plan.RewrittenSqls = make(map[string][]string)
+	for _, tableIndex := range plan.RouteTableIndexs {
+		nodeIndex, err := plan.Rule.FindNodeIndex(tableIndex)
+		if err != nil {
+			return err
+		}
+		nodeName := plan.Rule.Nodes[nodeIndex]
+		plan.RewrittenSqls[nodeName] = append(plan.RewrittenSqls[nodeName],
+			plan.rewriteSql(stmt, tableIndex))
+	}
+	return nil
+}
+
+//plan路由到的一个子表
+type Route struct {
+	Node     string
+	SubTable string
+	Sql      string
+}
+
+//按子表列出plan中每条改写之后的sql, 顺序与generateSqls一致
+func (plan *Plan) Routes() []*Route {
+	routes := make([]*Route, 0, len(plan.RouteTableIndexs))
+	offsets := make(map[string]int)
+	for _, tableIndex := range plan.RouteTableIndexs {
+		nodeName := plan.Rule.Nodes[plan.Rule.TableToNode[tableIndex]]
+		sqls := plan.RewrittenSqls[nodeName]
+		if offsets[nodeName] >= len(sqls) {
+			continue
+		}
+		routes = append(routes, &Route{
+			Node:     nodeName,
+			SubTable: plan.Rule.SubTableName(tableIndex),
+			Sql:      sqls[offsets[nodeName]],
+		})
+		offsets[nodeName]++
+	}
+	return routes
+}
+
+func (plan *Plan) rewriteSql(stmt sqlparser.Statement, tableIndex int) string {
+	subTable := []byte(plan.Rule.SubTableName(tableIndex))
+	table := plan.Rule.Table
+
+	buf := sqlparser.NewTrackedBuffer(func(buf *sqlparser.TrackedBuffer, node sqlparser.SQLNode) {
+		switch n := node.(type) {
+		case *sqlparser.TableName:
+			if string(n.Name) == table {
+				node = &sqlparser.TableName{Name: subTable, Qualifier: n.Qualifier}
+			}
+		case *sqlparser.ColName:
+			if string(n.Qualifier) == table {
+				node = &sqlparser.ColName{Name: n.Name, Qualifier: subTable}
+			}
+		case sqlparser.Values:
+			if rows, ok := plan.tableRows[tableIndex]; ok {
+				node = rows
+			}
+		case *sqlparser.ComparisonExpr:
+			if values, ok := plan.inValues[n][tableIndex]; ok {
+				node = &sqlparser.ComparisonExpr{Operator: n.Operator, Left: n.Left, Right: values}
+			}
+		}
+		node.Format(buf)
+	})
+	buf.Fprintf("%v", stmt)
+	return buf.String()
+}
+
+func makeList(start, end int) []int {
+	list := make([]int, 0, end-start)
+	for i := start; i < end; i++ {
+		list = append(list, i)
+	}
+	return list
+}
+
+//a < b 等价于 b > a
+func reverseOperator(operator string) string {
+	switch operator {
+	case sqlparser.AST_LT:
+		return sqlparser.AST_GT
+	case sqlparser.AST_LE:
+		return sqlparser.AST_GE
+	case sqlparser.AST_GT:
+		return sqlparser.AST_LT
+	case sqlparser.AST_GE:
+		return sqlparser.AST_LE
+	}
+	return operator
+}
+
+//有序列表中[min, max]范围内的元素
+func rangeList(list []int, min, max int) []int {
+	l := make([]int, 0, len(list))
+	for _, v := range list {
+		if min <= v && v <= max {
+			l = append(l, v)
+		}
+	}
+	return l
+}
+
+//两个有序列表的交集
+func interList(l1 []int, l2 []int) []int {
+	if len(l1) == 0 || len(l2) == 0 {
+		return []int{}
+	}
+
+	l3 := make([]int, 0, len(l1))
+	var i, j int
+	for i < len(l1) && j < len(l2) {
+		if l1[i] == l2[j] {
+			l3 = append(l3, l1[i])
+			i++
+			j++
+		} else if l1[i] < l2[j] {
+			i++
+		} else {
+			j++
+		}
+	}
+	return l3
+}
+
+//两个列表的并集, 结果有序且去重
+func unionList(l1 []int, l2 []int) []int {
+	m := make(map[int]struct{}, len(l1)+len(l2))
+	for _, v := range l1 {
+		m[v] = struct{}{}
+	}
+	for _, v := range l2 {
+		m[v] = struct{}{}
+	}
+
+	l3 := make([]int, 0, len(m))
+	for v := range m {
+		l3 = append(l3, v)
+	}
+	sort.Ints(l3)
+	return l3
+}
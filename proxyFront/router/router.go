@@ -0,0 +1,534 @@
+package router
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"brother/config"
+	"brother/core/errors"
+	"brother/sqlparser"
+)
+
+const (
+	DefaultRuleType = "default"
+	HashRuleType    = "hash"
+	RangeRuleType   = "range"
+
+	DateYearRuleType  = "date_year"
+	DateMonthRuleType = "date_month"
+	DateDayRuleType   = "date_day"
+
+	//全局表: 每个节点上都有一份完整的数据
+	GlobalRuleType = "global"
+)
+
+//一张逻辑表的分表规则
+type Rule struct {
+	DB    string
+	Table string
+	Key   string
+
+	Type  string
+	Nodes []string
+	Shard Shard
+
+	//insert没有给出Key时用于生成Key的全局序列
+	Sequence string
+
+	//子表下标 -> 节点下标
+	TableToNode    map[int]int
+	SubTableIndexs []int
+}
+
+func NewDefaultRule(node string) *Rule {
+	var r *Rule = &Rule{
+		Type:        DefaultRuleType,
+		Nodes:       []string{node},
+		Shard:       new(DefaultShard),
+		TableToNode: nil,
+	}
+	return r
+}
+
+func (r *Rule) FindNode(key interface{}) (string, error) {
+	tableIndex, err := r.FindTableIndex(key)
+	if err != nil {
+		return "", err
+	}
+	nodeIndex := r.TableToNode[tableIndex]
+	return r.Nodes[nodeIndex], nil
+}
+
+func (r *Rule) FindNodeIndex(tableIndex int) (int, error) {
+	nodeIndex, ok := r.TableToNode[tableIndex]
+	if !ok {
+		return -1, errors.ErrNoRouteNode
+	}
+	return nodeIndex, nil
+}
+
+func (r *Rule) FindTableIndex(key interface{}) (int, error) {
+	tableIndex, err := r.Shard.FindForKey(key)
+	if err != nil {
+		return -1, err
+	}
+	//按日期分表时key可能落在date_range之外
+	if r.isDateRule() {
+		if _, ok := r.TableToNode[tableIndex]; !ok {
+			return -1, errors.ErrKeyOutOfRange
+		}
+	}
+	return tableIndex, nil
+}
+
+//子表名: table_0000, 按日期分表时为table_yyyy/table_yyyymm/table_yyyymmdd
+func (r *Rule) SubTableName(tableIndex int) string {
+	if r.Type == GlobalRuleType {
+		return r.Table
+	}
+	if r.isDateRule() {
+		return fmt.Sprintf("%s_%d", r.Table, tableIndex)
+	}
+	return fmt.Sprintf("%s_%04d", r.Table, tableIndex)
+}
+
+func (r *Rule) isDateRule() bool {
+	switch r.Type {
+	case DateYearRuleType, DateMonthRuleType, DateDayRuleType:
+		return true
+	}
+	return false
+}
+
+func (r *Rule) String() string {
+	return fmt.Sprintf("%s.%s?key=%v&shard=%s&nodes=%s",
+		r.DB, r.Table, r.Key, r.Type, strings.Join(r.Nodes, ", "))
+}
+
+//分片键不允许被update
+func (r *Rule) checkUpdateExprs(exprs sqlparser.UpdateExprs) error {
+	if r.Type == DefaultRuleType {
+		return nil
+	}
+
+	for _, e := range exprs {
+		if strings.ToLower(string(e.Name.Name)) == r.Key {
+			return errors.ErrUpdateKey
+		}
+	}
+	return nil
+}
+
+type Router struct {
+	//db -> table -> rule
+	Rules       map[string]map[string]*Rule
+	DefaultRule *Rule
+	Nodes       []string
+}
+
+func NewRouter(schemaConfig *config.SchemaConfig) (*Router, error) {
+	if !includeNode(schemaConfig.Nodes, schemaConfig.Default) {
+		return nil, fmt.Errorf("default node[%s] not in the nodes list.",
+			schemaConfig.Default)
+	}
+
+	rt := new(Router)
+	rt.Nodes = schemaConfig.Nodes
+	rt.Rules = make(map[string]map[string]*Rule)
+	rt.DefaultRule = NewDefaultRule(schemaConfig.Default)
+
+	for _, shard := range schemaConfig.ShardRule {
+		//全局表没有配置nodes时复制到schema的所有节点
+		if shard.Type == GlobalRuleType && len(shard.Nodes) == 0 {
+			shard.Nodes = schemaConfig.Nodes
+		}
+		for _, node := range shard.Nodes {
+			if !includeNode(rt.Nodes, node) {
+				return nil, fmt.Errorf("shard table[%s] node[%s] not in the schema.nodes list:[%s].",
+					shard.Table, node, strings.Join(rt.Nodes, ","))
+			}
+		}
+
+		if len(shard.Sequence) != 0 && !includeSequence(schemaConfig.Sequences, shard.Sequence) {
+			return nil, fmt.Errorf("shard table[%s] sequence[%s] not in the schema.sequences list.",
+				shard.Table, shard.Sequence)
+		}
+
+		rule, err := parseRule(&shard)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := rt.Rules[rule.DB]; !ok {
+			rt.Rules[rule.DB] = make(map[string]*Rule)
+		}
+		if _, ok := rt.Rules[rule.DB][rule.Table]; ok {
+			return nil, fmt.Errorf("table %s rule in %s duplicate", rule.Table, rule.DB)
+		}
+		rt.Rules[rule.DB][rule.Table] = rule
+	}
+	return rt, nil
+}
+
+func includeNode(nodes []string, node string) bool {
+	for _, n := range nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+func includeSequence(sequences []config.SequenceConfig, name string) bool {
+	for _, seq := range sequences {
+		if seq.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func parseRule(cfg *config.ShardConfig) (*Rule, error) {
+	r := new(Rule)
+	r.Sequence = cfg.Sequence
+	r.DB = cfg.DB
+	r.Table = cfg.Table
+	r.Key = strings.ToLower(cfg.Key) //ignore case
+	r.Type = cfg.Type
+	r.Nodes = cfg.Nodes
+	r.TableToNode = make(map[int]int)
+
+	if len(r.Table) == 0 || (len(r.Key) == 0 && r.Type != GlobalRuleType) {
+		return nil, fmt.Errorf("shard rule must have table and key, table[%s] key[%s]", r.Table, r.Key)
+	}
+
+	switch r.Type {
+	case HashRuleType, RangeRuleType:
+		var sumTables int
+		if len(cfg.Locations) != len(r.Nodes) {
+			return nil, errors.ErrLocationsCount
+		}
+		for i := 0; i < len(cfg.Locations); i++ {
+			for j := 0; j < cfg.Locations[i]; j++ {
+				r.SubTableIndexs = append(r.SubTableIndexs, j+sumTables)
+				r.TableToNode[j+sumTables] = i
+			}
+			sumTables += cfg.Locations[i]
+		}
+	case DateYearRuleType, DateMonthRuleType, DateDayRuleType:
+		if len(cfg.DateRange) != len(r.Nodes) {
+			return nil, errors.ErrDateRangeCount
+		}
+		for i := 0; i < len(cfg.DateRange); i++ {
+			dateIndexs, err := parseDateIndexs(r.Type, cfg.DateRange[i])
+			if err != nil {
+				return nil, err
+			}
+			for _, index := range dateIndexs {
+				if _, ok := r.TableToNode[index]; ok {
+					return nil, fmt.Errorf("date [%d] of table [%s] duplicated in date_range", index, r.Table)
+				}
+				r.SubTableIndexs = append(r.SubTableIndexs, index)
+				r.TableToNode[index] = i
+			}
+		}
+		sort.Ints(r.SubTableIndexs)
+	case GlobalRuleType:
+		//每个节点上一张同名的表, 子表下标即节点下标
+		for i := range r.Nodes {
+			r.SubTableIndexs = append(r.SubTableIndexs, i)
+			r.TableToNode[i] = i
+		}
+	default:
+		return nil, fmt.Errorf("invalid shard type [%s] of table [%s]", r.Type, r.Table)
+	}
+
+	if err := parseShard(r, cfg); err != nil {
+		return nil, err
+	}
+
+	return r, nil
+}
+
+func parseShard(r *Rule, cfg *config.ShardConfig) error {
+	switch r.Type {
+	case HashRuleType:
+		r.Shard = &HashShard{ShardNum: len(r.TableToNode)}
+	case RangeRuleType:
+		rs, err := ParseNumSharding(cfg.Locations, cfg.TableRowLimit)
+		if err != nil {
+			return err
+		}
+
+		if len(rs) != len(r.TableToNode) {
+			return fmt.Errorf("range space %d not equal tables %d", len(rs), len(r.TableToNode))
+		}
+
+		r.Shard = &NumRangeShard{Shards: rs}
+	case DateYearRuleType:
+		r.Shard = &DateYearShard{}
+	case DateMonthRuleType:
+		r.Shard = &DateMonthShard{}
+	case DateDayRuleType:
+		r.Shard = &DateDayShard{}
+	default:
+		r.Shard = &DefaultShard{}
+	}
+
+	return nil
+}
+
+func parseDateIndexs(ruleType string, dateRange string) ([]int, error) {
+	switch ruleType {
+	case DateYearRuleType:
+		return ParseYearRange(dateRange)
+	case DateMonthRuleType:
+		return ParseMonthRange(dateRange)
+	default:
+		return ParseDayRange(dateRange)
+	}
+}
+
+//table可能带有db前缀
+func (r *Router) GetRule(db string, table *sqlparser.TableName) *Rule {
+	if table == nil {
+		return r.DefaultRule
+	}
+	if len(table.Qualifier) > 0 {
+		db = string(table.Qualifier)
+	}
+
+	if rule, ok := r.Rules[db][string(table.Name)]; ok {
+		return rule
+	}
+	return r.DefaultRule
+}
+
+//分表的语句返回对应的plan, 未分表的语句返回的plan只包含DefaultRule
+func (r *Router) BuildPlan(db string, statement sqlparser.Statement) (*Plan, error) {
+	if rule := r.GetRule(db, getStatementTable(statement)); rule.Type == GlobalRuleType {
+		return buildGlobalPlan(rule, statement)
+	}
+
+	switch stmt := statement.(type) {
+	case *sqlparser.Insert:
+		return r.buildInsertPlan(db, stmt)
+	case *sqlparser.Replace:
+		return r.buildReplacePlan(db, stmt)
+	case *sqlparser.Select:
+		return r.buildSelectPlan(db, stmt)
+	case *sqlparser.Update:
+		return r.buildUpdatePlan(db, stmt)
+	case *sqlparser.Delete:
+		return r.buildDeletePlan(db, stmt)
+	}
+	return nil, errors.ErrNoPlan
+}
+
+func getStatementTable(statement sqlparser.Statement) *sqlparser.TableName {
+	switch stmt := statement.(type) {
+	case *sqlparser.Insert:
+		return stmt.Table
+	case *sqlparser.Replace:
+		return stmt.Table
+	case *sqlparser.Select:
+		return getSelectTable(stmt)
+	case *sqlparser.Update:
+		return stmt.Table
+	case *sqlparser.Delete:
+		return stmt.Table
+	}
+	return nil
+}
+
+//全局表的语句在每个节点上原样执行, 读由proxy只选择其中一个节点
+func buildGlobalPlan(rule *Rule, stmt sqlparser.Statement) (*Plan, error) {
+	plan := &Plan{Rule: rule}
+	plan.RouteTableIndexs = rule.SubTableIndexs
+	plan.RouteNodeIndexs = rule.SubTableIndexs
+	if err := plan.generateSqls(stmt); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+//只根据FROM中的第一张表选择规则
+func getSelectTable(stmt *sqlparser.Select) *sqlparser.TableName {
+	if len(stmt.From) == 0 {
+		return nil
+	}
+
+	var expr sqlparser.TableExpr = stmt.From[0]
+	for {
+		switch v := expr.(type) {
+		case *sqlparser.AliasedTableExpr:
+			if t, ok := v.Expr.(*sqlparser.TableName); ok {
+				return t
+			}
+			return nil
+		case *sqlparser.JoinTableExpr:
+			expr = v.LeftExpr
+		case *sqlparser.ParenTableExpr:
+			expr = v.Expr
+		default:
+			return nil
+		}
+	}
+}
+
+func (r *Router) buildSelectPlan(db string, stmt *sqlparser.Select) (*Plan, error) {
+	plan := &Plan{}
+	plan.Rule = r.GetRule(db, getSelectTable(stmt))
+	if plan.Rule.Type == DefaultRuleType {
+		return plan, nil
+	}
+
+	if stmt.Where != nil {
+		plan.Criteria = stmt.Where.Expr
+	}
+	if err := plan.calRouteIndexs(); err != nil {
+		return nil, err
+	}
+
+	//跨分表的聚合查询由proxy合并, 子表不做having/order by/limit
+	if len(plan.RouteTableIndexs) > 1 && needMerge(stmt) {
+		newStmt, err := plan.buildSelectMerge(stmt)
+		if err != nil {
+			return nil, err
+		}
+		stmt = newStmt
+	} else if len(plan.RouteTableIndexs) > 1 && len(stmt.OrderBy) != 0 {
+		newStmt, err := plan.buildSelectSort(stmt)
+		if err != nil {
+			return nil, err
+		}
+		stmt = newStmt
+	} else if len(plan.RouteTableIndexs) > 1 && stmt.Limit != nil {
+		//跨分表时每个子表都要取出offset+count行, 合并之后再由proxy截取
+		newLimit, err := stmt.Limit.RewriteLimit()
+		if err != nil {
+			return nil, err
+		}
+		newStmt := *stmt
+		newStmt.Limit = newLimit
+		stmt = &newStmt
+	}
+
+	if err := plan.generateSqls(stmt); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+func (r *Router) buildUpdatePlan(db string, stmt *sqlparser.Update) (*Plan, error) {
+	plan := &Plan{}
+	plan.Rule = r.GetRule(db, stmt.Table)
+	if plan.Rule.Type == DefaultRuleType {
+		return plan, nil
+	}
+
+	if err := plan.Rule.checkUpdateExprs(stmt.Exprs); err != nil {
+		return nil, err
+	}
+
+	if stmt.Where != nil {
+		plan.Criteria = stmt.Where.Expr
+	}
+	if err := plan.calRouteIndexs(); err != nil {
+		return nil, err
+	}
+
+	if err := plan.generateSqls(stmt); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+func (r *Router) buildDeletePlan(db string, stmt *sqlparser.Delete) (*Plan, error) {
+	plan := &Plan{}
+	plan.Rule = r.GetRule(db, stmt.Table)
+	if plan.Rule.Type == DefaultRuleType {
+		return plan, nil
+	}
+
+	if stmt.Where != nil {
+		plan.Criteria = stmt.Where.Expr
+	}
+	if err := plan.calRouteIndexs(); err != nil {
+		return nil, err
+	}
+
+	if err := plan.generateSqls(stmt); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+func (r *Router) buildInsertPlan(db string, stmt *sqlparser.Insert) (*Plan, error) {
+	plan := &Plan{}
+	plan.Rule = r.GetRule(db, stmt.Table)
+	if plan.Rule.Type == DefaultRuleType {
+		return plan, nil
+	}
+
+	if _, ok := stmt.Rows.(sqlparser.SelectStatement); ok {
+		return nil, errors.ErrSelectInInsert
+	}
+
+	if err := plan.getIRKeyIndex(stmt.Columns); err != nil {
+		return nil, err
+	}
+
+	if stmt.OnDup != nil {
+		if err := plan.Rule.checkUpdateExprs(sqlparser.UpdateExprs(stmt.OnDup)); err != nil {
+			return nil, err
+		}
+	}
+
+	vals, err := plan.checkValuesType(stmt.Rows, len(stmt.Columns))
+	if err != nil {
+		return nil, err
+	}
+	plan.Criteria = vals
+
+	if err := plan.calRouteIndexs(); err != nil {
+		return nil, err
+	}
+
+	if err := plan.generateSqls(stmt); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
+
+func (r *Router) buildReplacePlan(db string, stmt *sqlparser.Replace) (*Plan, error) {
+	plan := &Plan{}
+	plan.Rule = r.GetRule(db, stmt.Table)
+	if plan.Rule.Type == DefaultRuleType {
+		return plan, nil
+	}
+
+	if _, ok := stmt.Rows.(sqlparser.SelectStatement); ok {
+		return nil, errors.ErrSelectInInsert
+	}
+
+	if err := plan.getIRKeyIndex(stmt.Columns); err != nil {
+		return nil, err
+	}
+
+	vals, err := plan.checkValuesType(stmt.Rows, len(stmt.Columns))
+	if err != nil {
+		return nil, err
+	}
+	plan.Criteria = vals
+
+	if err := plan.calRouteIndexs(); err != nil {
+		return nil, err
+	}
+
+	if err := plan.generateSqls(stmt); err != nil {
+		return nil, err
+	}
+	return plan, nil
+}
@@ -0,0 +1,555 @@
+package router
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"brother/config"
+	"brother/sqlparser"
+)
+
+func newTestRouter(t *testing.T) *Router {
+	var s = `
+schema :
+  nodes: [node1, node2, node3]
+  default: node1
+  shard:
+    -
+      db : brother
+      table: test_shard_hash
+      key: id
+      nodes: [node1, node2, node3]
+      type: hash
+      locations: [4,4,4]
+    -
+      db : brother
+      table: test_shard_range
+      key: id
+      type: range
+      nodes: [node2, node3]
+      locations: [4,4]
+      table_row_limit: 10000
+    -
+      db : brother
+      table: test_shard_year
+      key: ctime
+      type: date_year
+      nodes: [node1, node2]
+      date_range: [2014-2015, 2016-2017]
+    -
+      db : brother
+      table: test_shard_month
+      key: ctime
+      type: date_month
+      nodes: [node1, node2]
+      date_range: [201511-201602, 201603-201605]
+    -
+      db : brother
+      table: test_shard_day
+      key: ctime
+      type: date_day
+      nodes: [node1, node2]
+      date_range: [20160130-20160131, 20160201-20160202]
+    -
+      db : brother
+      table: test_global
+      type: global
+`
+	cfg, err := config.ParseConfigData([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewRouter(&cfg.Schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestParseRule(t *testing.T) {
+	r := newTestRouter(t)
+
+	hashRule := r.Rules["brother"]["test_shard_hash"]
+	if hashRule == nil || hashRule.Type != HashRuleType {
+		t.Fatal("hash rule not found")
+	}
+	if len(hashRule.SubTableIndexs) != 12 {
+		t.Fatal(hashRule.SubTableIndexs)
+	}
+	if n, _ := hashRule.FindNode(uint64(5)); n != "node2" {
+		t.Fatal(n)
+	}
+	if n, _ := hashRule.FindNode(uint64(11)); n != "node3" {
+		t.Fatal(n)
+	}
+
+	rangeRule := r.Rules["brother"]["test_shard_range"]
+	if rangeRule == nil || rangeRule.Type != RangeRuleType {
+		t.Fatal("range rule not found")
+	}
+	if index, _ := rangeRule.FindTableIndex(int64(30001)); index != 3 {
+		t.Fatal(index)
+	}
+	if n, _ := rangeRule.FindNode(int64(40000)); n != "node3" {
+		t.Fatal(n)
+	}
+	if _, err := rangeRule.FindTableIndex(int64(80000)); err == nil {
+		t.Fatal("must out of range")
+	}
+
+	if r.DefaultRule.Nodes[0] != "node1" {
+		t.Fatal(r.DefaultRule.Nodes)
+	}
+}
+
+func testPlan(t *testing.T, r *Router, sql string) *Plan {
+	stmt, err := sqlparser.Parse(sql)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := r.BuildPlan("brother", stmt)
+	if err != nil {
+		t.Fatal(sql, err)
+	}
+	return plan
+}
+
+func checkPlan(t *testing.T, sql string, tableIndexs []int, nodeIndexs []int) {
+	r := newTestRouter(t)
+	plan := testPlan(t, r, sql)
+	if !reflect.DeepEqual(plan.RouteTableIndexs, tableIndexs) {
+		t.Fatalf("%s: table indexs %v, want %v", sql, plan.RouteTableIndexs, tableIndexs)
+	}
+	if !reflect.DeepEqual(plan.RouteNodeIndexs, nodeIndexs) {
+		t.Fatalf("%s: node indexs %v, want %v", sql, plan.RouteNodeIndexs, nodeIndexs)
+	}
+}
+
+func TestSelectPlan(t *testing.T) {
+	checkPlan(t, "select * from test_shard_hash where id = 5", []int{5}, []int{1})
+	checkPlan(t, "select * from test_shard_hash where id = 5 or id = 11", []int{5, 11}, []int{1, 2})
+	checkPlan(t, "select * from test_shard_hash where (id = 5 or id = 11) and id = 11", []int{11}, []int{2})
+	checkPlan(t, "select * from test_shard_hash where 3 = id and name = 'a'", []int{3}, []int{0})
+	checkPlan(t, "select * from test_shard_hash where name = 'a'",
+		[]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}, []int{0, 1, 2})
+	checkPlan(t, "select * from test_shard_range where id = 12345", []int{1}, []int{0})
+	checkPlan(t, "select * from test_shard_range", []int{0, 1, 2, 3, 4, 5, 6, 7}, []int{0, 1})
+
+	checkPlan(t, "select * from test_shard_hash where id in (1, 5, 13)", []int{1, 5}, []int{0, 1})
+	checkPlan(t, "select * from test_shard_hash where id in (1, 5) or id = 11", []int{1, 5, 11}, []int{0, 1, 2})
+	checkPlan(t, "select * from test_shard_hash where id in (1, 5) and id in (5, 6)", []int{5}, []int{1})
+	checkPlan(t, "select * from test_shard_hash where id not in (1, 5)",
+		[]int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11}, []int{0, 1, 2})
+	checkPlan(t, "select * from test_shard_range where id between 100 and 20000", []int{0, 1, 2}, []int{0})
+	checkPlan(t, "select * from test_shard_range where id < 20000", []int{0, 1}, []int{0})
+	checkPlan(t, "select * from test_shard_range where id <= 20000", []int{0, 1, 2}, []int{0})
+	checkPlan(t, "select * from test_shard_range where id > 69999", []int{7}, []int{1})
+	checkPlan(t, "select * from test_shard_range where id >= 69999", []int{6, 7}, []int{1})
+	checkPlan(t, "select * from test_shard_range where id > 30000 and id < 50000", []int{3, 4}, []int{0, 1})
+	checkPlan(t, "select * from test_shard_range where id < 10000 or id in (75000)", []int{0, 7}, []int{0, 1})
+	checkPlan(t, "select * from test_shard_range where id > 90000", []int{0, 1, 2, 3, 4, 5, 6, 7}, []int{0, 1})
+}
+
+func TestInRewrite(t *testing.T) {
+	r := newTestRouter(t)
+
+	plan := testPlan(t, r, "select * from test_shard_hash where id in (1, 13, 5, 25) and name = 'a'")
+	if sqls := plan.RewrittenSqls["node1"]; !reflect.DeepEqual(sqls, []string{
+		"select * from test_shard_hash_0001 where id in (1, 13, 25) and name = 'a'",
+	}) {
+		t.Fatal(sqls)
+	}
+	if sqls := plan.RewrittenSqls["node2"]; !reflect.DeepEqual(sqls, []string{
+		"select * from test_shard_hash_0005 where id in (5) and name = 'a'",
+	}) {
+		t.Fatal(sqls)
+	}
+
+	//or的另一个分支路由到的子表, in列表中没有属于该子表的值时保持原样
+	plan = testPlan(t, r, "delete from test_shard_hash where id in (1, 5) or id = 2")
+	if sqls := plan.RewrittenSqls["node1"]; !reflect.DeepEqual(sqls, []string{
+		"delete from test_shard_hash_0001 where id in (1) or id = 2",
+		"delete from test_shard_hash_0002 where id in (1, 5) or id = 2",
+	}) {
+		t.Fatal(sqls)
+	}
+}
+
+func TestSelectLimitRewrite(t *testing.T) {
+	r := newTestRouter(t)
+
+	plan := testPlan(t, r, "select * from test_shard_hash where id in (1, 2) order by id desc limit 10, 5")
+	sqls := plan.RewrittenSqls["node1"]
+	if len(sqls) != 2 || sqls[0] != "select * from test_shard_hash_0001 where id in (1) order by id desc limit 15" {
+		t.Fatal(sqls)
+	}
+
+	plan = testPlan(t, r, "select * from test_shard_hash where id = 5 limit 10, 5")
+	sqls = plan.RewrittenSqls["node2"]
+	if len(sqls) != 1 || sqls[0] != "select * from test_shard_hash_0005 where id = 5 limit 10, 5" {
+		t.Fatal(sqls)
+	}
+}
+
+func TestSelectMerge(t *testing.T) {
+	r := newTestRouter(t)
+
+	sql := "select name, count(*), avg(age) as a, max(ctime) from test_shard_hash where id > 10 " +
+		"group by name having sum(age) > 100 order by a desc limit 10"
+	plan := testPlan(t, r, sql)
+	sqls := plan.RewrittenSqls["node1"]
+	if len(sqls) != 4 || sqls[0] != "select name, count(*), sum(age) as a, max(ctime), sum(age), count(age) "+
+		"from test_shard_hash_0000 where id > 10 group by name" {
+		t.Fatal(sqls)
+	}
+
+	m := plan.Merge
+	if m == nil || m.ColumnCount != 4 || m.Limit == nil {
+		t.Fatal(m)
+	}
+	if !reflect.DeepEqual(m.GroupByIndexs, []int{0}) {
+		t.Fatal(m.GroupByIndexs)
+	}
+	if len(m.OrderBy) != 1 || m.OrderBy[0].Index != 2 || m.OrderBy[0].Direction != "desc" {
+		t.Fatal(m.OrderBy)
+	}
+	aggrs := make(map[int]AggrColumn)
+	for _, aggr := range m.Aggrs {
+		aggrs[aggr.Index] = *aggr
+	}
+	if aggrs[1].Func != AggrCount || aggrs[2].Func != AggrAvg || aggrs[2].CountIndex != 5 ||
+		aggrs[3].Func != AggrMax || aggrs[4].Func != AggrSum || aggrs[5].Func != AggrCount {
+		t.Fatal(aggrs)
+	}
+
+	plan = testPlan(t, r, "select count(distinct name) from test_shard_hash")
+	sqls = plan.RewrittenSqls["node2"]
+	if len(sqls) != 4 || sqls[0] != "select name as `count(distinct name)` from test_shard_hash_0004 group by name" {
+		t.Fatal(sqls)
+	}
+
+	badSqls := []string{
+		"select *, count(*) from test_shard_hash",
+		"select count(*) + 1 from test_shard_hash",
+		"select sum(distinct age) from test_shard_hash",
+		"select name from test_shard_hash group by name having name in ('a', 'b')",
+	}
+	for _, sql := range badSqls {
+		stmt, err := sqlparser.Parse(sql)
+		if err != nil {
+			t.Fatal(sql, err)
+		}
+		if _, err := r.BuildPlan("brother", stmt); err == nil {
+			t.Fatalf("%s must fail", sql)
+		}
+	}
+}
+
+func TestSelectSort(t *testing.T) {
+	r := newTestRouter(t)
+
+	//不在select列表中的排序列追加到末尾, 列名不区分大小写, 数字表示位置
+	plan := testPlan(t, r, "select id, Name as n from test_shard_hash where id in (1, 2) order by N, 1 desc, age limit 10, 5")
+	sqls := plan.RewrittenSqls["node1"]
+	if len(sqls) != 2 || sqls[0] != "select id, name as n, age from test_shard_hash_0001 where id in (1) "+
+		"order by n asc, 1 desc, age asc limit 15" {
+		t.Fatal(sqls)
+	}
+	m := plan.Merge
+	if m == nil || m.ColumnCount != 2 || m.Limit == nil || len(m.Aggrs) != 0 {
+		t.Fatal(m)
+	}
+	if len(m.OrderBy) != 3 || m.OrderBy[0].Index != 1 || m.OrderBy[1].Index != 0 ||
+		m.OrderBy[1].Direction != "desc" || m.OrderBy[2].Index != 2 {
+		t.Fatal(m.OrderBy)
+	}
+
+	//select *由proxy按字段名排序
+	plan = testPlan(t, r, "select * from test_shard_hash where id in (1, 2) order by id")
+	if plan.Merge != nil {
+		t.Fatal(plan.Merge)
+	}
+
+	stmt, err := sqlparser.Parse("select id from test_shard_hash order by 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.BuildPlan("brother", stmt); err == nil {
+		t.Fatal("order by position out of select list must fail")
+	}
+}
+
+func TestParseDateRange(t *testing.T) {
+	if l, err := ParseMonthRange("201511-201602"); err != nil ||
+		!reflect.DeepEqual(l, []int{201511, 201512, 201601, 201602}) {
+		t.Fatal(l, err)
+	}
+	if l, err := ParseDayRange("20160228-20160301"); err != nil ||
+		!reflect.DeepEqual(l, []int{20160228, 20160229, 20160301}) {
+		t.Fatal(l, err)
+	}
+	if l, err := ParseYearRange("2016"); err != nil || !reflect.DeepEqual(l, []int{2016}) {
+		t.Fatal(l, err)
+	}
+
+	badRanges := []string{"2016-2015", "201613-201701", "2016-05", "2015-2016-2017"}
+	for _, v := range badRanges {
+		if _, err := ParseMonthRange(v); err == nil {
+			t.Fatalf("date range %s must be illegal", v)
+		}
+	}
+}
+
+func TestDatePlan(t *testing.T) {
+	r := newTestRouter(t)
+	monthRule := r.Rules["brother"]["test_shard_month"]
+	if monthRule.SubTableName(201605) != "test_shard_month_201605" {
+		t.Fatal(monthRule.SubTableName(201605))
+	}
+	if n, _ := monthRule.FindNode("2016-04-01 12:30:00"); n != "node2" {
+		t.Fatal(n)
+	}
+	if _, err := monthRule.FindTableIndex("2017-01-01"); err == nil {
+		t.Fatal("must out of range")
+	}
+	if _, err := monthRule.FindTableIndex("2016/01/01"); err == nil {
+		t.Fatal("must illegal date")
+	}
+
+	checkPlan(t, "select * from test_shard_year where ctime = '2015-06-01'", []int{2015}, []int{0})
+	checkPlan(t, "select * from test_shard_year where ctime >= '2015-06-01'",
+		[]int{2015, 2016, 2017}, []int{0, 1})
+	checkPlan(t, "select * from test_shard_year where ctime < '2016-01-01'", []int{2014, 2015}, []int{0})
+	checkPlan(t, "select * from test_shard_year where '2016-01-01' <= ctime", []int{2016, 2017}, []int{1})
+	checkPlan(t, "select * from test_shard_month where ctime between '2015-12-10' and '2016-03-01'",
+		[]int{201512, 201601, 201602, 201603}, []int{0, 1})
+	checkPlan(t, "select * from test_shard_month where ctime > '2016-02-29 10:00:00' and ctime < '2016-04-01'",
+		[]int{201602, 201603}, []int{0, 1})
+	checkPlan(t, "select * from test_shard_day where ctime between '2016-01-31' and '2016-12-01'",
+		[]int{20160131, 20160201, 20160202}, []int{0, 1})
+
+	plan := testPlan(t, r, "insert into test_shard_month(id, ctime) values (1, '2016-05-20 08:00:00')")
+	sqls := plan.RewrittenSqls["node2"]
+	if len(sqls) != 1 ||
+		sqls[0] != "insert  into test_shard_month_201605(id, ctime) values (1, '2016-05-20 08:00:00')" {
+		t.Fatal(sqls)
+	}
+}
+
+func TestRewriteSql(t *testing.T) {
+	r := newTestRouter(t)
+
+	plan := testPlan(t, r, "select test_shard_hash.name from test_shard_hash where id = 5")
+	sqls := plan.RewrittenSqls["node2"]
+	if len(sqls) != 1 || sqls[0] != "select test_shard_hash_0005.name from test_shard_hash_0005 where id = 5" {
+		t.Fatal(plan.RewrittenSqls)
+	}
+
+	plan = testPlan(t, r, "update brother.test_shard_range set name = 'a' where id = 40001")
+	sqls = plan.RewrittenSqls["node3"]
+	if len(sqls) != 1 || sqls[0] != "update brother.test_shard_range_0004 set name = 'a' where id = 40001" {
+		t.Fatal(plan.RewrittenSqls)
+	}
+
+	plan = testPlan(t, r, "select * from test_default where id = 5")
+	if plan.Rule.Type != DefaultRuleType || plan.RewrittenSqls != nil {
+		t.Fatal(plan.Rule)
+	}
+}
+
+func TestInsertPlan(t *testing.T) {
+	r := newTestRouter(t)
+
+	plan := testPlan(t, r, "insert into test_shard_hash(id, name) values(13, 'a'), (25, 'b')")
+	sqls := plan.RewrittenSqls["node1"]
+	if len(sqls) != 1 || sqls[0] != "insert  into test_shard_hash_0001(id, name) values (13, 'a'), (25, 'b')" {
+		t.Fatal(plan.RewrittenSqls)
+	}
+
+	plan = testPlan(t, r, "replace into test_shard_hash(id, name) values(1, 'a'), (5, 'b'), (2, 'c'), (17, 'd')")
+	if !reflect.DeepEqual(plan.RouteTableIndexs, []int{1, 2, 5}) ||
+		!reflect.DeepEqual(plan.RouteNodeIndexs, []int{0, 1}) {
+		t.Fatal(plan.RouteTableIndexs, plan.RouteNodeIndexs)
+	}
+	if sqls := plan.RewrittenSqls["node1"]; !reflect.DeepEqual(sqls, []string{
+		"replace into test_shard_hash_0001(id, name) values (1, 'a')",
+		"replace into test_shard_hash_0002(id, name) values (2, 'c')",
+	}) {
+		t.Fatal(sqls)
+	}
+	if sqls := plan.RewrittenSqls["node2"]; !reflect.DeepEqual(sqls, []string{
+		"replace into test_shard_hash_0005(id, name) values (5, 'b'), (17, 'd')",
+	}) {
+		t.Fatal(sqls)
+	}
+
+	badSqls := []string{
+		"insert into test_shard_range(id, name) values(1, 'a'), (90000, 'b')",
+		"insert into test_shard_hash(name) values('a')",
+		"insert into test_shard_hash values(1, 'a')",
+		"insert into test_shard_hash(id, name) values(1)",
+		"update test_shard_hash set id = 2 where id = 1",
+	}
+	for _, sql := range badSqls {
+		stmt, err := sqlparser.Parse(sql)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := r.BuildPlan("brother", stmt); err == nil {
+			t.Fatalf("%s must fail", sql)
+		}
+	}
+}
+
+func TestStripHint(t *testing.T) {
+	stmt, err := sqlparser.Parse("select /*brother:node=node2, master*/ /*other*/ * from test_shard_hash where id = 1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hint, err := StripHint(stmt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(hint, &Hint{Master: true, Node: "node2"}) || !hint.IsDirect() {
+		t.Fatal(hint)
+	}
+	if sql := sqlparser.String(stmt); sql != "select /*other*/ * from test_shard_hash where id = 1" {
+		t.Fatal(sql)
+	}
+
+	stmt, _ = sqlparser.Parse("update /*brother:master*/ test_shard_hash set name = 'a' where id = 1")
+	if hint, err = StripHint(stmt); err != nil || hint == nil || !hint.Master || hint.IsDirect() {
+		t.Fatal(hint, err)
+	}
+
+	stmt, _ = sqlparser.Parse("select /*other*/ * from test_shard_hash")
+	if hint, err = StripHint(stmt); err != nil || hint != nil {
+		t.Fatal(hint, err)
+	}
+
+	badSqls := []string{
+		"select /*brother:slave*/ * from t",
+		"select /*brother:unknown=1*/ * from t",
+		"select /*brother:master, slave=127.0.0.1:3306*/ * from t",
+	}
+	for _, sql := range badSqls {
+		stmt, _ := sqlparser.Parse(sql)
+		if _, err := StripHint(stmt); err == nil {
+			t.Fatalf("%s must fail", sql)
+		}
+	}
+}
+
+func TestStripSqlHint(t *testing.T) {
+	tests := []struct {
+		sql  string
+		hint *Hint
+		rest string
+	}{
+		{"/*brother:node=node2*/ select * from t", &Hint{Node: "node2"}, " select * from t"},
+		{"select /*other*/ * from t /*brother:master*/", &Hint{Master: true}, "select /*other*/ * from t "},
+		{"/*other*/ alter /*brother:force*/ table t add c int", &Hint{Force: true}, "/*other*/ alter  table t add c int"},
+		{"select '/*brother:master*/' from t", nil, "select '/*brother:master*/' from t"},
+		{"select * from t", nil, "select * from t"},
+	}
+	for _, test := range tests {
+		hint, rest, err := StripSqlHint(test.sql)
+		if err != nil {
+			t.Fatal(test.sql, err)
+		}
+		if !reflect.DeepEqual(hint, test.hint) || rest != test.rest {
+			t.Fatalf("%s: %v %q", test.sql, hint, rest)
+		}
+	}
+
+	if _, _, err := StripSqlHint("/*brother:unknown*/ select 1"); err == nil {
+		t.Fatal("unknown hint must fail")
+	}
+}
+
+func TestGlobalPlan(t *testing.T) {
+	r := newTestRouter(t)
+
+	plan := testPlan(t, r, "insert into test_global(id, name) values(1, 'a')")
+	if !reflect.DeepEqual(plan.RouteNodeIndexs, []int{0, 1, 2}) {
+		t.Fatal(plan.RouteNodeIndexs)
+	}
+	for _, node := range []string{"node1", "node2", "node3"} {
+		sqls := plan.RewrittenSqls[node]
+		if len(sqls) != 1 || sqls[0] != "insert  into test_global(id, name) values (1, 'a')" {
+			t.Fatal(node, sqls)
+		}
+	}
+
+	plan = testPlan(t, r, "select g.name from test_global as g join test_shard_hash as s on g.id = s.gid where g.id = 1")
+	if plan.Rule.Type != GlobalRuleType || len(plan.RewrittenSqls) != 3 {
+		t.Fatal(plan.Rule, plan.RewrittenSqls)
+	}
+}
+
+func TestDDLPlan(t *testing.T) {
+	r := newTestRouter(t)
+
+	sql := "alter /*brother:force*/ table `test_shard_range` add column test_shard_range int"
+	stmt, err := sqlparser.Parse(sql)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := r.BuildDDLPlan("brother", stmt, sql)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.RewrittenSqls["node2"]) != 4 || len(plan.RewrittenSqls["node3"]) != 4 {
+		t.Fatal(plan.RewrittenSqls)
+	}
+	if s := plan.RewrittenSqls["node3"][1]; s != "alter /*brother:force*/ table `test_shard_range_0005` add column test_shard_range int" {
+		t.Fatal(s)
+	}
+	if hint, err := ParseSqlHint(sql); err != nil || hint == nil || !hint.Force {
+		t.Fatal(hint, err)
+	}
+
+	sql = "truncate table brother.test_shard_year"
+	stmt, _ = sqlparser.Parse(sql)
+	if plan, err = r.BuildDDLPlan("other", stmt, sql); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(plan.RewrittenSqls["node1"], []string{
+		"truncate table brother.test_shard_year_2014",
+		"truncate table brother.test_shard_year_2015",
+	}) {
+		t.Fatal(plan.RewrittenSqls)
+	}
+
+	sql = "create table test_default(id int)"
+	stmt, _ = sqlparser.Parse(sql)
+	if plan, err = r.BuildDDLPlan("brother", stmt, sql); err != nil || plan.Rule.Type != DefaultRuleType {
+		t.Fatal(plan, err)
+	}
+
+	sql = "rename table test_shard_hash to test_other"
+	stmt, _ = sqlparser.Parse(sql)
+	if _, err = r.BuildDDLPlan("brother", stmt, sql); err == nil {
+		t.Fatal("rename must fail")
+	}
+}
+
+func TestPlanRoutes(t *testing.T) {
+	r := newTestRouter(t)
+
+	plan := testPlan(t, r, "select * from test_shard_hash where id in (1, 5, 2)")
+	routes := plan.Routes()
+	if len(routes) != len(plan.RouteTableIndexs) {
+		t.Fatal(routes)
+	}
+	for i, route := range routes {
+		nodeIndex := plan.Rule.TableToNode[plan.RouteTableIndexs[i]]
+		if route.Node != plan.Rule.Nodes[nodeIndex] ||
+			route.SubTable != plan.Rule.SubTableName(plan.RouteTableIndexs[i]) ||
+			!strings.Contains(route.Sql, route.SubTable) {
+			t.Fatal(route)
+		}
+	}
+}
@@ -0,0 +1,138 @@
+package router
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+
+	"brother/core/errors"
+	"brother/core/hack"
+)
+
+type KeyError string
+
+func NewKeyError(format string, args ...interface{}) KeyError {
+	return KeyError(fmt.Sprintf(format, args...))
+}
+
+func (ke KeyError) Error() string {
+	return string(ke)
+}
+
+//分片规则, 根据分片键的值计算出对应子表的下标
+type Shard interface {
+	FindForKey(key interface{}) (int, error)
+}
+
+//子表下标随key单调递增的分片规则, 可以按范围裁剪子表
+type RangeShard interface {
+	Shard
+	//key恰好是下标为index的子表的起始值
+	EqualStart(key interface{}, index int) bool
+	//key恰好是下标为index的子表的结束值
+	EqualStop(key interface{}, index int) bool
+}
+
+//hash分片: key % 子表总数
+type HashShard struct {
+	ShardNum int
+}
+
+func (s *HashShard) FindForKey(key interface{}) (int, error) {
+	h, err := HashValue(key)
+	if err != nil {
+		return -1, err
+	}
+
+	return int(h % uint64(s.ShardNum)), nil
+}
+
+//range分片: 每个子表保存[Start, End)范围内的key
+type NumRangeShard struct {
+	Shards []NumKeyRange
+}
+
+func (s *NumRangeShard) FindForKey(key interface{}) (int, error) {
+	v, err := NumValue(key)
+	if err != nil {
+		return -1, err
+	}
+
+	for i, r := range s.Shards {
+		if r.Contains(v) {
+			return i, nil
+		}
+	}
+	return -1, errors.ErrKeyOutOfRange
+}
+
+func (s *NumRangeShard) EqualStart(key interface{}, index int) bool {
+	v, err := NumValue(key)
+	if err != nil || index < 0 || index >= len(s.Shards) {
+		return false
+	}
+	return v == s.Shards[index].Start
+}
+
+func (s *NumRangeShard) EqualStop(key interface{}, index int) bool {
+	v, err := NumValue(key)
+	if err != nil || index < 0 || index >= len(s.Shards) {
+		return false
+	}
+	return v == s.Shards[index].End-1
+}
+
+//未分表的规则, 全部落到第一个节点
+type DefaultShard struct {
+}
+
+func (s *DefaultShard) FindForKey(key interface{}) (int, error) {
+	return 0, nil
+}
+
+func HashValue(value interface{}) (uint64, error) {
+	switch val := value.(type) {
+	case int:
+		return uint64(val), nil
+	case uint64:
+		return val, nil
+	case int64:
+		return uint64(val), nil
+	case string:
+		if v, err := strconv.ParseUint(val, 10, 64); err == nil {
+			return v, nil
+		}
+		h := fnv.New64a()
+		h.Write(hack.Slice(val))
+		return h.Sum64(), nil
+	case []byte:
+		h := fnv.New64a()
+		h.Write(val)
+		return h.Sum64(), nil
+	}
+	return 0, NewKeyError("Unexpected key variable type %T", value)
+}
+
+func NumValue(value interface{}) (int64, error) {
+	switch val := value.(type) {
+	case int:
+		return int64(val), nil
+	case uint64:
+		return int64(val), nil
+	case int64:
+		return val, nil
+	case string:
+		if v, err := strconv.ParseInt(val, 10, 64); err != nil {
+			return 0, NewKeyError("invalid num format %s", val)
+		} else {
+			return v, nil
+		}
+	case []byte:
+		if v, err := strconv.ParseInt(hack.String(val), 10, 64); err != nil {
+			return 0, NewKeyError("invalid num format %s", val)
+		} else {
+			return v, nil
+		}
+	}
+	return 0, NewKeyError("Unexpected key variable type %T", value)
+}
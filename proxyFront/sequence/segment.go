@@ -0,0 +1,119 @@
+package sequence
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+
+	"brother/config"
+	"brother/core/golog"
+	"brother/proxyBack"
+)
+
+const (
+	defaultSegmentTable = "brother_sequence"
+	defaultSegmentStep  = 1000
+)
+
+//号段分配: 每次从序列表取step个id缓存在内存中, 用完再取下一段
+//序列表: name varchar(64) primary key, next_value bigint, next_value是下一个未分配的id
+type SegmentSequence struct {
+	sync.Mutex
+
+	name  string
+	table string
+	step  int64
+	node  *proxyBack.Node
+
+	inited bool
+	//当前号段[next, max)
+	next int64
+	max  int64
+}
+
+func NewSegmentSequence(cfg *config.SequenceConfig, node *proxyBack.Node) (*SegmentSequence, error) {
+	if node == nil {
+		return nil, fmt.Errorf("segment sequence [%s] must have a node", cfg.Name)
+	}
+	if len(cfg.DB) == 0 {
+		return nil, fmt.Errorf("segment sequence [%s] must have a db", cfg.Name)
+	}
+
+	s := &SegmentSequence{
+		name:  cfg.Name,
+		table: fmt.Sprintf("`%s`.`%s`", cfg.DB, cfg.Table),
+		step:  cfg.Step,
+		node:  node,
+	}
+	if len(cfg.Table) == 0 {
+		s.table = fmt.Sprintf("`%s`.`%s`", cfg.DB, defaultSegmentTable)
+	}
+	if s.step <= 0 {
+		s.step = defaultSegmentStep
+	}
+	return s, nil
+}
+
+func (s *SegmentSequence) Next() (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.next >= s.max {
+		if err := s.fetch(); err != nil {
+			return 0, err
+		}
+	}
+
+	id := s.next
+	s.next++
+	return id, nil
+}
+
+//LAST_INSERT_ID(expr)把新的next_value带回到OK包的insert id中, 一条语句完成分配
+func (s *SegmentSequence) fetch() error {
+	co, err := s.node.GetMasterConn()
+	if err != nil {
+		return err
+	}
+	defer co.Close()
+
+	if !s.inited {
+		if err = s.init(co); err != nil {
+			golog.Error("SegmentSequence", "fetch", err.Error(), 0, "sequence", s.name)
+			return err
+		}
+		s.inited = true
+	}
+
+	sql := fmt.Sprintf("UPDATE %s SET next_value = LAST_INSERT_ID(next_value + %d) WHERE name = '%s'",
+		s.table, s.step, escape(s.name))
+	r, err := co.Execute(sql)
+	if err != nil {
+		return err
+	}
+	if r.AffectedRows == 0 {
+		return fmt.Errorf("sequence [%s] not exists in %s", s.name, s.table)
+	}
+
+	s.max = int64(r.InsertId)
+	s.next = s.max - s.step
+	return nil
+}
+
+//第一次使用时创建序列表和序列记录, 已经存在则不做修改
+func (s *SegmentSequence) init(co *proxyBack.BackendConn) error {
+	sql := fmt.Sprintf("CREATE TABLE IF NOT EXISTS %s ("+
+		"name varchar(64) NOT NULL PRIMARY KEY, "+
+		"next_value bigint NOT NULL) ENGINE=InnoDB", s.table)
+	if _, err := co.Execute(sql); err != nil {
+		return err
+	}
+
+	sql = fmt.Sprintf("INSERT IGNORE INTO %s(name, next_value) VALUES ('%s', 1)", s.table, escape(s.name))
+	_, err := co.Execute(sql)
+	return err
+}
+
+func escape(s string) string {
+	return strings.Replace(strings.Replace(s, "\\", "\\\\", -1), "'", "\\'", -1)
+}
@@ -0,0 +1,29 @@
+package sequence
+
+import (
+	"fmt"
+
+	"brother/config"
+	"brother/proxyBack"
+)
+
+const (
+	SegmentType   = "segment"
+	SnowflakeType = "snowflake"
+)
+
+//全局唯一的id生成器, 并发安全
+type Sequence interface {
+	Next() (int64, error)
+}
+
+//segment类型需要node, 序列表建在node的master上
+func New(cfg *config.SequenceConfig, node *proxyBack.Node) (Sequence, error) {
+	switch cfg.Type {
+	case SegmentType:
+		return NewSegmentSequence(cfg, node)
+	case SnowflakeType:
+		return NewSnowflakeSequence(cfg.WorkerId)
+	}
+	return nil, fmt.Errorf("invalid sequence type [%s] of sequence [%s]", cfg.Type, cfg.Name)
+}
@@ -0,0 +1,76 @@
+package sequence
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	//2016-01-01 00:00:00 UTC, 毫秒
+	snowflakeEpoch int64 = 1451606400000
+
+	workerIdBits = 10
+	sequenceBits = 12
+
+	MaxWorkerId  = -1 ^ (-1 << workerIdBits)
+	sequenceMask = -1 ^ (-1 << sequenceBits)
+
+	//时钟回拨在该范围内时等待, 超过则报错
+	maxBackwardMs = 5
+)
+
+//41位毫秒时间戳 + 10位worker id + 12位毫秒内序号
+type SnowflakeSequence struct {
+	sync.Mutex
+
+	workerId int64
+	lastTime int64
+	sequence int64
+}
+
+func NewSnowflakeSequence(workerId int64) (*SnowflakeSequence, error) {
+	if workerId < 0 || workerId > MaxWorkerId {
+		return nil, fmt.Errorf("snowflake worker_id must be between 0 and %d, not %d", MaxWorkerId, workerId)
+	}
+	return &SnowflakeSequence{workerId: workerId}, nil
+}
+
+func (s *SnowflakeSequence) Next() (int64, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := currentMs()
+	if now < s.lastTime {
+		if s.lastTime-now > maxBackwardMs {
+			return 0, fmt.Errorf("clock moved backwards %dms", s.lastTime-now)
+		}
+		now = waitUntil(s.lastTime)
+	}
+
+	if now == s.lastTime {
+		s.sequence = (s.sequence + 1) & sequenceMask
+		//当前毫秒的序号用完, 等到下一毫秒
+		if s.sequence == 0 {
+			now = waitUntil(s.lastTime + 1)
+		}
+	} else {
+		s.sequence = 0
+	}
+	s.lastTime = now
+
+	return (now-snowflakeEpoch)<<(workerIdBits+sequenceBits) | s.workerId<<sequenceBits | s.sequence, nil
+}
+
+func currentMs() int64 {
+	return time.Now().UnixNano() / int64(time.Millisecond)
+}
+
+func waitUntil(ms int64) int64 {
+	now := currentMs()
+	for now < ms {
+		time.Sleep(time.Duration(ms-now) * time.Millisecond)
+		now = currentMs()
+	}
+	return now
+}
@@ -0,0 +1,70 @@
+package sequence
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestSnowflakeWorkerId(t *testing.T) {
+	if _, err := NewSnowflakeSequence(-1); err == nil {
+		t.Fatal("worker id -1 must be invalid")
+	}
+	if _, err := NewSnowflakeSequence(MaxWorkerId + 1); err == nil {
+		t.Fatal("worker id too large must be invalid")
+	}
+
+	s, err := NewSnowflakeSequence(5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	id, err := s.Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if (id>>sequenceBits)&MaxWorkerId != 5 {
+		t.Fatalf("worker id of %d must be 5", id)
+	}
+}
+
+func TestSnowflakeUnique(t *testing.T) {
+	s, err := NewSnowflakeSequence(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const workers = 8
+	const count = 5000
+	ids := make([][]int64, workers)
+
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < count; j++ {
+				id, err := s.Next()
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				//同一个goroutine拿到的id递增
+				if j > 0 && id <= ids[i][j-1] {
+					t.Errorf("id %d not greater than %d", id, ids[i][j-1])
+					return
+				}
+				ids[i] = append(ids[i], id)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[int64]bool, workers*count)
+	for _, l := range ids {
+		for _, id := range l {
+			if seen[id] {
+				t.Fatalf("duplicate id %d", id)
+			}
+			seen[id] = true
+		}
+	}
+}
@@ -30,8 +30,11 @@ type ClientConn struct {
 	status				uint16
 	collation			mysql.CollationId
 	charset				string
+	sysVars				map[string]string //客户端SET的会话变量
 
 	user				string
+	//以admin_user登录, 可以执行修改节点的admin命令
+	isAdmin				bool
 	db				string
 
 	salt				[]byte
@@ -39,9 +42,14 @@ type ClientConn struct {
 	schema				*Schema
 
 	txConns				map[*proxyBack.Node]*proxyBack.BackendConn
+	xaGtrid				string //XA模式下当前事务的gtrid
 
 	closed				bool
 
+	readConsistency			readConsistency
+	writeConns			map[*proxyBack.BackendConn]*proxyBack.Node //非事务中使用的主库连接
+	nodeWrites			map[*proxyBack.Node]*nodeWrite //会话在各节点最近的写入
+
 	lastInsertId			int64
 	affectedRows			int64
 
@@ -184,8 +192,13 @@ func (c *ClientConn) readHandshakeResponse() error {
 	pos++
 	auth := data[pos:pos+authLen]
 
-	checkAuth := mysql.CalcPassword(c.salt, []byte(c.proxy.cfg.Password))
-	if c.user != c.proxy.cfg.User || !bytes.Equal(auth, checkAuth) {
+	password := c.proxy.cfg.Password
+	c.isAdmin = len(c.proxy.cfg.AdminUser) != 0 && c.user == c.proxy.cfg.AdminUser
+	if c.isAdmin {
+		password = c.proxy.cfg.AdminPassword
+	}
+	checkAuth := mysql.CalcPassword(c.salt, []byte(password))
+	if (c.user != c.proxy.cfg.User && !c.isAdmin) || !bytes.Equal(auth, checkAuth) {
 		golog.Error("ClientConn", "readHandshakeResponse", "error", 0,
 			"auth", auth,
 			"checkAuth", checkAuth,
@@ -292,6 +305,13 @@ func (c *ClientConn) Close() error {
 		return nil
 	}
 
+	//客户端在事务中断开, 自动回滚并归还后端连接
+	if len(c.txConns) > 0 || len(c.xaGtrid) != 0 {
+		if err := c.rollback(); err != nil {
+			golog.Error("ClientConn", "Close", err.Error(), c.connectionId)
+		}
+	}
+
 	c.c.Close()
 	c.closed = true
 
@@ -348,7 +368,6 @@ func (c *ClientConn) dispatch(data []byte) error {
 	golog.Info("server", "dispatch", "received cmd:", 0, hack.String(data))
 	switch cmd {
 	case mysql.COM_QUIT:
-		c.handleRollback()
 		c.Close()
 		return nil
 	case mysql.COM_PING:
@@ -357,11 +376,19 @@ func (c *ClientConn) dispatch(data []byte) error {
 		return c.handleUseDB(hack.String(data))
 	case mysql.COM_QUERY:
 		return c.handleQuery(hack.String(data))
+	case mysql.COM_STMT_PREPARE:
+		return c.handleStmtPrepare(hack.String(data))
+	case mysql.COM_STMT_EXECUTE:
+		return c.handleStmtExecute(data)
+	case mysql.COM_STMT_CLOSE:
+		return c.handleStmtClose(data)
+	case mysql.COM_STMT_SEND_LONG_DATA:
+		return c.handleStmtSendLongData(data)
+	case mysql.COM_STMT_RESET:
+		return c.handleStmtReset(data)
 	default:
 		msg := f.Sprintf("command %d not supported now", cmd)
 		golog.Error("ClientConn", "dispatch", msg, 0)
 		return mysql.NewError(mysql.ER_UNKNOWN_ERROR, msg)
 	}
-
-	return nil
 }
\ No newline at end of file
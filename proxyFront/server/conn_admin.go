@@ -0,0 +1,380 @@
+package server
+
+import (
+	f "fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"brother/config"
+	"brother/core/errors"
+	"brother/mysql"
+	"brother/proxyBack"
+	"brother/sqlparser"
+)
+
+/**
+ * ################################### ADMIN ###########################################
+ */
+
+//admin server(opt,k) values('show','node')
+//admin server(opt,k) values('show','failover')
+//admin server(opt,k) values('show','balancer')
+//admin server(opt,k) values('show','breaker')
+//admin server(opt,k) values('show','pool')
+//admin node(opt,node,k,v) values('add','node3','node','127.0.0.1:3308')
+//admin node(opt,node,k,v) values('del','node3','node','')
+//admin node(opt,node,k,v) values('add','node1','slave','127.0.0.1:3307@2')
+//admin node(opt,node,k,v) values('del','node1','slave','127.0.0.1:3307')
+//admin node(opt,node,k,v) values('set','node1','weight','127.0.0.1:3307@3')
+//admin node(opt,node,k,v) values('up','node1','slave','127.0.0.1:3307')
+//admin node(opt,node,k,v) values('down','node1','master','127.0.0.1:3306')
+//增加save列时写回配置文件: admin node(opt,node,k,v,save) values('del','node1','slave','127.0.0.1:3307','true')
+const (
+	AdminServerRegion	= "server"
+	AdminNodeRegion		= "node"
+
+	AdminOptShow		= "show"
+
+	AdminShowNode		= "node"
+	AdminShowFailover	= "failover"
+	AdminShowBalancer	= "balancer"
+	AdminShowBreaker	= "breaker"
+	AdminShowPool		= "pool"
+
+	AdminOptAdd		= "add"
+	AdminOptDel		= "del"
+	AdminOptSet		= "set"
+	AdminOptUp		= "up"
+	AdminOptDown		= "down"
+
+	AdminNodeNode		= "node"
+	AdminNodeMaster		= "master"
+	AdminNodeSlave		= "slave"
+	AdminNodeWeight		= "weight"
+)
+
+var adminServerColumns = []string{"opt", "k"}
+
+var adminNodeOptColumns = []string{"opt", "node", "k", "v"}
+
+var adminNodeSaveColumns = []string{"opt", "node", "k", "v", "save"}
+
+var adminNodeColumns = []string{"node", "address", "type", "state", "last_ping", "lag"}
+
+var adminBalancerColumns = []string{"node", "balancer", "slave", "weight", "state", "borrowed", "latency_ms", "next"}
+
+var adminBreakerColumns = []string{"node", "address", "type", "breaker", "consecutive_failures",
+	"window_requests", "window_errors", "opened_at"}
+
+var adminPoolColumns = []string{"node", "address", "type", "max_open", "open", "idle", "in_use", "waiting",
+	"wait_count", "wait_ms", "wait_timeouts", "closed_idle", "closed_lifetime"}
+
+var adminFailoverColumns = []string{"time", "node", "step", "message"}
+
+var adminHelpColumns = []string{"command", "description"}
+
+var adminHelpRows = [][]interface{}{
+	{"admin server(opt,k) values('show','node')", "show master and slaves of every node"},
+	{"admin server(opt,k) values('show','failover')", "show recent failover events"},
+	{"admin server(opt,k) values('show','balancer')", "show slave balancer of every node and its next choice"},
+	{"admin server(opt,k) values('show','breaker')", "show circuit breaker of every database"},
+	{"admin server(opt,k) values('show','pool')", "show connection pool stats of every database"},
+	{"admin node(opt,node,k,v) values('add','node3','node','addr')", "add node with master addr and the settings of the default node"},
+	{"admin node(opt,node,k,v) values('del','node3','node','')", "remove node not used by schema after its connections drain"},
+	{"admin node(opt,node,k,v) values('add','node1','slave','addr@weight')", "add slave to node"},
+	{"admin node(opt,node,k,v) values('del','node1','slave','addr')", "remove slave from node"},
+	{"admin node(opt,node,k,v) values('set','node1','weight','addr@weight')", "change slave weight"},
+	{"admin node(opt,node,k,v) values('up','node1','slave','addr')", "set master or slave up"},
+	{"admin node(opt,node,k,v) values('down','node1','slave','addr')", "set master or slave manual down"},
+	{"admin node(opt,node,k,v,save) values(...,'true')", "also write node changes to the config file"},
+	{"admin node(...)", "only allowed for admin_user"},
+}
+
+var dbStateNames = map[int32]string{
+	proxyBack.Up:         "up",
+	proxyBack.Down:       "down",
+	proxyBack.ManualDown: "manual_down",
+	proxyBack.Unknown:    "unknown",
+	proxyBack.Lagging:    "lagging",
+}
+
+func (c *ClientConn) handleAdmin(admin *sqlparser.Admin) error {
+	region := strings.ToLower(sqlparser.String(admin.Region))
+	values, err := adminValues(admin)
+	if err != nil {
+		return err
+	}
+
+	var names []string
+	var rows [][]interface{}
+	switch region {
+	case AdminServerRegion:
+		names, rows, err = c.handleAdminServer(admin, values)
+	case AdminNodeRegion:
+		//修改节点只允许admin_user执行
+		if !c.isAdmin {
+			return mysql.NewDefaultError(mysql.ER_SPECIFIC_ACCESS_DENIED_ERROR, "brother admin_user")
+		}
+		err = c.handleAdminNode(admin, values)
+	default:
+		err = errors.ErrCmdUnsupport
+	}
+	if err != nil {
+		return err
+	}
+	//修改类的命令没有结果集
+	if names == nil {
+		return c.writeOK(nil)
+	}
+
+	r, err := c.buildResultset(names, rows)
+	if err != nil {
+		return err
+	}
+	return c.writeResultset(c.status, r)
+}
+
+func (c *ClientConn) handleAdminHelp() error {
+	r, err := c.buildResultset(adminHelpColumns, adminHelpRows)
+	if err != nil {
+		return err
+	}
+	return c.writeResultset(c.status, r)
+}
+
+func (c *ClientConn) handleAdminServer(admin *sqlparser.Admin, values []string) ([]string, [][]interface{}, error) {
+	if err := checkAdminColumns(admin, adminServerColumns); err != nil {
+		return nil, nil, err
+	}
+	opt, k := strings.ToLower(values[0]), strings.ToLower(values[1])
+	if opt != AdminOptShow {
+		return nil, nil, errors.ErrCmdUnsupport
+	}
+
+	switch k {
+	case AdminShowNode:
+		return adminNodeColumns, c.adminNodeRows(), nil
+	case AdminShowFailover:
+		return adminFailoverColumns, c.adminFailoverRows(), nil
+	case AdminShowBalancer:
+		return adminBalancerColumns, c.adminBalancerRows(), nil
+	case AdminShowBreaker:
+		return adminBreakerColumns, c.adminBreakerRows(), nil
+	case AdminShowPool:
+		return adminPoolColumns, c.adminPoolRows(), nil
+	}
+	return nil, nil, errors.ErrCmdUnsupport
+}
+
+func (c *ClientConn) handleAdminNode(admin *sqlparser.Admin, values []string) error {
+	save := false
+	if err := checkAdminColumns(admin, adminNodeOptColumns); err != nil {
+		if err = checkAdminColumns(admin, adminNodeSaveColumns); err != nil {
+			return err
+		}
+		if save, err = strconv.ParseBool(values[4]); err != nil {
+			return errors.ErrCmdIllegal
+		}
+	}
+	opt, node, k, v := strings.ToLower(values[0]), values[1], strings.ToLower(values[2]), strings.TrimSpace(values[3])
+	s := c.proxy
+
+	switch {
+	case opt == AdminOptAdd && k == AdminNodeNode:
+		return s.AddNode(s.newNodeConfig(node, v), save)
+	case opt == AdminOptDel && k == AdminNodeNode:
+		return s.RemoveNode(node, save)
+	case opt == AdminOptAdd && k == AdminNodeSlave:
+		return s.AddSlave(node, v, save)
+	case opt == AdminOptDel && k == AdminNodeSlave:
+		return s.RemoveSlave(node, v, save)
+	case opt == AdminOptSet && k == AdminNodeWeight:
+		addr, weight, err := proxyBack.ParseSlaveWeight(v)
+		if err != nil {
+			return err
+		}
+		return s.SetSlaveWeight(node, addr, weight, save)
+	case opt == AdminOptUp && (k == AdminNodeMaster || k == AdminNodeSlave):
+		return s.UpDB(node, v)
+	case opt == AdminOptDown && (k == AdminNodeMaster || k == AdminNodeSlave):
+		return s.DownDB(node, v)
+	}
+	return errors.ErrCmdUnsupport
+}
+
+//admin添加的节点使用默认节点的账号和连接池等配置
+func (s *Server) newNodeConfig(name, master string) config.NodeConfig {
+	//saveNodeConfig在configLock中修改节点的Cfg
+	s.configLock.Lock()
+	cfg := s.schema.defaultNode.Cfg
+	s.configLock.Unlock()
+	cfg.Name = name
+	cfg.Master = master
+	cfg.Slave = ""
+	return cfg
+}
+
+func (c *ClientConn) adminNodeRows() [][]interface{} {
+	rows := make([][]interface{}, 0)
+	for _, n := range c.proxy.sortedNodes() {
+		if master := n.GetMaster(); master != nil {
+			rows = append(rows, adminDBRow(n, master, proxyBack.Master))
+		}
+		for _, db := range n.GetSlaves() {
+			rows = append(rows, adminDBRow(n, db, proxyBack.Slave))
+		}
+	}
+	return rows
+}
+
+func adminDBRow(n *proxyBack.Node, db *proxyBack.DB, typ string) []interface{} {
+	lag := "-"
+	if status := db.Replication(); status != nil && status.IsSlave {
+		lag = f.Sprintf("%d", status.Lag)
+	}
+	return []interface{}{
+		n.String(),
+		db.Addr(),
+		typ,
+		dbStateNames[db.State()],
+		time.Unix(db.GetLastPing(), 0).Format("2006-01-02 15:04:05"),
+		lag,
+	}
+}
+
+func (c *ClientConn) adminBalancerRows() [][]interface{} {
+	rows := make([][]interface{}, 0)
+	for _, n := range c.proxy.sortedNodes() {
+		name, status := n.BalancerStatus()
+		for _, s := range status {
+			next := "no"
+			if s.Next {
+				next = "yes"
+			}
+			state := "-"
+			if db := n.GetSlave(s.Addr); db != nil {
+				state = dbStateNames[db.State()]
+			}
+			rows = append(rows, []interface{}{
+				n.String(),
+				name,
+				s.Addr,
+				s.Weight,
+				state,
+				s.Borrowed,
+				f.Sprintf("%.3f", float64(s.Latency)/float64(time.Millisecond)),
+				next,
+			})
+		}
+	}
+	return rows
+}
+
+func (c *ClientConn) adminBreakerRows() [][]interface{} {
+	rows := make([][]interface{}, 0)
+	for _, n := range c.proxy.sortedNodes() {
+		if master := n.GetMaster(); master != nil {
+			rows = append(rows, adminBreakerRow(n, master, proxyBack.Master))
+		}
+		for _, db := range n.GetSlaves() {
+			rows = append(rows, adminBreakerRow(n, db, proxyBack.Slave))
+		}
+	}
+	return rows
+}
+
+//没有配置熔断的DB显示为disabled
+func adminBreakerRow(n *proxyBack.Node, db *proxyBack.DB, typ string) []interface{} {
+	status := db.Breaker()
+	if status == nil {
+		return []interface{}{n.String(), db.Addr(), typ, "disabled", int64(0), int64(0), int64(0), "-"}
+	}
+	openedAt := "-"
+	if !status.OpenedAt.IsZero() {
+		openedAt = status.OpenedAt.Format("2006-01-02 15:04:05")
+	}
+	return []interface{}{n.String(), db.Addr(), typ, status.State, int64(status.Consecutive),
+		status.Requests, status.Errors, openedAt}
+}
+
+func (c *ClientConn) adminPoolRows() [][]interface{} {
+	rows := make([][]interface{}, 0)
+	for _, n := range c.proxy.sortedNodes() {
+		if master := n.GetMaster(); master != nil {
+			rows = append(rows, adminPoolRow(n, master, proxyBack.Master))
+		}
+		for _, db := range n.GetSlaves() {
+			rows = append(rows, adminPoolRow(n, db, proxyBack.Slave))
+		}
+	}
+	return rows
+}
+
+func adminPoolRow(n *proxyBack.Node, db *proxyBack.DB, typ string) []interface{} {
+	s := db.PoolStats()
+	return []interface{}{n.String(), db.Addr(), typ, int64(s.MaxOpen), int64(s.Open), int64(s.Idle),
+		int64(s.InUse), int64(s.Waiting), s.WaitCount, s.WaitDuration.Nanoseconds() / int64(time.Millisecond),
+		s.WaitTimeouts, s.ClosedIdle, s.ClosedLifetime}
+}
+
+func (c *ClientConn) adminFailoverRows() [][]interface{} {
+	rows := make([][]interface{}, 0)
+	for _, n := range c.proxy.sortedNodes() {
+		for _, e := range n.FailoverEvents() {
+			rows = append(rows, []interface{}{e.Time.Format("2006-01-02 15:04:05"), e.Node, e.Step, e.Message})
+		}
+	}
+	return rows
+}
+
+//admin的列名必须与命令的格式一致
+func checkAdminColumns(admin *sqlparser.Admin, names []string) error {
+	if len(admin.Columns) != len(names) {
+		return errors.ErrCmdIllegal
+	}
+	for i, col := range admin.Columns {
+		if strings.ToLower(sqlparser.String(col)) != names[i] {
+			return errors.ErrCmdIllegal
+		}
+	}
+	return nil
+}
+
+//admin的values只能有一行字符串
+func adminValues(admin *sqlparser.Admin) ([]string, error) {
+	rows, ok := admin.Rows.(sqlparser.Values)
+	if !ok || len(rows) != 1 {
+		return nil, errors.ErrCmdIllegal
+	}
+	tuple, ok := rows[0].(sqlparser.ValTuple)
+	if !ok || len(tuple) != len(admin.Columns) {
+		return nil, errors.ErrCmdIllegal
+	}
+
+	values := make([]string, 0, len(tuple))
+	for _, v := range tuple {
+		s, ok := v.(sqlparser.StrVal)
+		if !ok {
+			return nil, errors.ErrCmdIllegal
+		}
+		values = append(values, string(s))
+	}
+	return values, nil
+}
+
+func (s *Server) sortedNodes() []*proxyBack.Node {
+	all := s.GetAllNodes()
+	names := make([]string, 0, len(all))
+	for name := range all {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	nodes := make([]*proxyBack.Node, 0, len(names))
+	for _, name := range names {
+		nodes = append(nodes, all[name])
+	}
+	return nodes
+}
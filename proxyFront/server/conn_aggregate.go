@@ -0,0 +1,438 @@
+package server
+
+import (
+	"bytes"
+	f "fmt"
+	"math/big"
+	"strings"
+
+	"brother/core/errors"
+	"brother/core/hack"
+	"brother/mysql"
+	"brother/proxyFront/router"
+	"brother/sqlparser"
+)
+
+/**
+ * ################################### 跨分表聚合结果合并 ###########################################
+ */
+
+func (c *ClientConn) mergeAggregateResult(r *mysql.Result, m *router.SelectMerge) error {
+	if err := c.mergeResultset(r.Resultset, m); err != nil {
+		return err
+	}
+	return c.writeResultset(c.status|r.Status, r.Resultset)
+}
+
+//group by -> 聚合 -> having -> distinct -> order by -> limit, 最后去掉为合并追加的列
+func (c *ClientConn) mergeResultset(rs *mysql.Resultset, m *router.SelectMerge) error {
+	var err error
+	if len(m.Aggrs) != 0 || len(m.GroupByIndexs) != 0 {
+		if err = c.aggregateResultset(rs, m); err != nil {
+			return err
+		}
+	}
+
+	if m.Having != nil {
+		if err = c.havingResultset(rs, m); err != nil {
+			return err
+		}
+	}
+
+	if m.Distinct {
+		c.distinctResultset(rs, m.ColumnCount)
+	}
+
+	if err = c.sortResultset(rs, m.OrderBy); err != nil {
+		return err
+	}
+
+	if err = c.limitResultset(rs, m.Limit); err != nil {
+		return err
+	}
+
+	c.trimResultset(rs, m.ColumnCount)
+	return nil
+}
+
+//按group by的列分组, 同一组内的聚合列合并, 其他列取第一行的值
+func (c *ClientConn) aggregateResultset(r *mysql.Resultset, m *router.SelectMerge) error {
+	var err error
+	groups := make(map[string]int)
+	values := make([][]interface{}, 0, len(r.Values))
+	//count(distinct col): 分组下标 -> 列下标 -> 去重之后的值
+	distincts := make([]map[int]map[string]struct{}, 0, len(r.Values))
+
+	for _, row := range r.Values {
+		key := groupKey(row, m.GroupByIndexs)
+		i, ok := groups[key]
+		if !ok {
+			groups[key] = len(values)
+			merged := make([]interface{}, len(row))
+			copy(merged, row)
+			values = append(values, merged)
+
+			sets := make(map[int]map[string]struct{})
+			for _, aggr := range m.Aggrs {
+				if aggr.Func == router.AggrCountDistinct {
+					sets[aggr.Index] = make(map[string]struct{})
+					addDistinctValue(sets[aggr.Index], row[aggr.Index])
+				}
+			}
+			distincts = append(distincts, sets)
+			continue
+		}
+
+		merged := values[i]
+		for _, aggr := range m.Aggrs {
+			if aggr.Func == router.AggrCountDistinct {
+				addDistinctValue(distincts[i][aggr.Index], row[aggr.Index])
+				continue
+			}
+
+			merged[aggr.Index], err = mergeAggrValue(aggr.Func, r.Fields[aggr.Index], merged[aggr.Index], row[aggr.Index])
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for i, merged := range values {
+		for _, aggr := range m.Aggrs {
+			switch aggr.Func {
+			case router.AggrCountDistinct:
+				merged[aggr.Index] = int64(len(distincts[i][aggr.Index]))
+			case router.AggrAvg:
+				merged[aggr.Index], err = avgValue(merged[aggr.Index], merged[aggr.CountIndex])
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	//字段的类型随聚合函数变化
+	for _, aggr := range m.Aggrs {
+		field := r.Fields[aggr.Index]
+		switch aggr.Func {
+		case router.AggrCountDistinct:
+			field.Type = mysql.MYSQL_TYPE_LONGLONG
+			field.Charset = 63 //binary
+			field.Flag = mysql.BINARY_FLAG | mysql.NOT_NULL_FLAG
+			field.ColumnLength = 21
+			field.Decimal = 0
+			field.Data = nil
+		case router.AggrAvg:
+			if field.IsDecimal() {
+				field.Decimal += avgScaleIncrement
+				field.ColumnLength += avgScaleIncrement
+				field.Data = nil
+			}
+		}
+	}
+
+	r.Values = values
+	return nil
+}
+
+func (c *ClientConn) havingResultset(r *mysql.Resultset, m *router.SelectMerge) error {
+	values := r.Values[:0]
+	for _, row := range r.Values {
+		ok, err := evalHaving(m.Having, row, r.Fields, m)
+		if err != nil {
+			return err
+		}
+		if ok {
+			values = append(values, row)
+		}
+	}
+	r.Values = values
+	return nil
+}
+
+//select distinct: 客户端可见的列完全相同的行只保留一行
+func (c *ClientConn) distinctResultset(r *mysql.Resultset, columnCount int) {
+	indexs := make([]int, columnCount)
+	for i := range indexs {
+		indexs[i] = i
+	}
+
+	keys := make(map[string]struct{}, len(r.Values))
+	values := r.Values[:0]
+	for _, row := range r.Values {
+		key := groupKey(row, indexs)
+		if _, ok := keys[key]; ok {
+			continue
+		}
+		keys[key] = struct{}{}
+		values = append(values, row)
+	}
+	r.Values = values
+}
+
+func (c *ClientConn) sortResultset(r *mysql.Resultset, orderBy []*router.OrderColumn) error {
+	if len(orderBy) == 0 {
+		return nil
+	}
+
+	sk := make([]mysql.SortKey, len(orderBy))
+	for i, o := range orderBy {
+		sk[i] = mysql.SortKey{Column: o.Index, Direction: o.Direction}
+	}
+	return r.Sort(sk)
+}
+
+//去掉为合并追加的列, 并根据合并之后的值重新生成行数据
+func (c *ClientConn) trimResultset(r *mysql.Resultset, columnCount int) {
+	if len(r.Fields) > columnCount {
+		r.Fields = r.Fields[:columnCount]
+		r.FieldNames = make(map[string]int, columnCount)
+		for i, field := range r.Fields {
+			r.FieldNames[string(field.Name)] = i
+		}
+	}
+
+	r.RowDatas = make([]mysql.RowData, len(r.Values))
+	for i := range r.Values {
+		r.Values[i] = r.Values[i][:len(r.Fields)]
+		r.RowDatas[i] = buildRowData(r.Values[i])
+	}
+}
+
+//text协议的一行数据
+func buildRowData(row []interface{}) mysql.RowData {
+	data := make([]byte, 0, 16*len(row))
+	for _, v := range row {
+		if v == nil {
+			data = append(data, 0xfb)
+			continue
+		}
+		data = append(data, mysql.PutLengthEncodedString(mysql.FormatValue(v))...)
+	}
+	return data
+}
+
+func groupKey(row []interface{}, indexs []int) string {
+	var buf bytes.Buffer
+	for _, index := range indexs {
+		f.Fprintf(&buf, "%#v,", row[index])
+	}
+	return buf.String()
+}
+
+//count(distinct col)不统计NULL
+func addDistinctValue(set map[string]struct{}, value interface{}) {
+	if value == nil {
+		return
+	}
+	set[f.Sprintf("%#v", value)] = struct{}{}
+}
+
+func mergeAggrValue(fun string, field *mysql.Field, v1 interface{}, v2 interface{}) (interface{}, error) {
+	switch fun {
+	case router.AggrCount, router.AggrSum, router.AggrAvg:
+		return sumValue(v1, v2)
+	case router.AggrMin, router.AggrMax:
+		if v1 == nil {
+			return v2, nil
+		} else if v2 == nil {
+			return v1, nil
+		}
+		cmp := mysql.CompareValue(v1, v2, field.IsNumeric())
+		if (fun == router.AggrMin && cmp > 0) || (fun == router.AggrMax && cmp < 0) {
+			return v2, nil
+		}
+		return v1, nil
+	}
+	return nil, f.Errorf("aggregate function %s not support", fun)
+}
+
+//sum(int)返回的是decimal字符串, 用big.Rat保证精度
+func sumValue(v1 interface{}, v2 interface{}) (interface{}, error) {
+	if v1 == nil {
+		return v2, nil
+	} else if v2 == nil {
+		return v1, nil
+	}
+
+	switch a := v1.(type) {
+	case int64:
+		if b, ok := v2.(int64); ok {
+			return a + b, nil
+		}
+	case uint64:
+		if b, ok := v2.(uint64); ok {
+			return a + b, nil
+		}
+	case float64:
+		if b, ok := v2.(float64); ok {
+			return a + b, nil
+		}
+	case []byte:
+		if b, ok := v2.([]byte); ok {
+			x, ok1 := new(big.Rat).SetString(hack.String(a))
+			y, ok2 := new(big.Rat).SetString(hack.String(b))
+			if !ok1 || !ok2 {
+				return nil, errors.ErrSumColumnType
+			}
+			scale := decimalScale(a)
+			if s := decimalScale(b); s > scale {
+				scale = s
+			}
+			return []byte(x.Add(x, y).FloatString(scale)), nil
+		}
+	}
+	return nil, errors.ErrSumColumnType
+}
+
+//与mysql的div_precision_increment默认值一致
+const avgScaleIncrement = 4
+
+func avgValue(sum interface{}, count interface{}) (interface{}, error) {
+	if sum == nil {
+		return nil, nil
+	}
+	n, ok := mysql.ValueToRat(count)
+	if !ok {
+		return nil, errors.ErrSumColumnType
+	}
+	if n.Sign() == 0 {
+		return nil, nil
+	}
+
+	switch v := sum.(type) {
+	case float64:
+		cnt, _ := n.Float64()
+		return v / cnt, nil
+	case []byte:
+		s, ok := mysql.ValueToRat(v)
+		if !ok {
+			return nil, errors.ErrSumColumnType
+		}
+		return []byte(s.Quo(s, n).FloatString(decimalScale(v) + avgScaleIncrement)), nil
+	default:
+		s, ok := mysql.ValueToRat(v)
+		if !ok {
+			return nil, errors.ErrSumColumnType
+		}
+		return []byte(s.Quo(s, n).FloatString(avgScaleIncrement)), nil
+	}
+}
+
+func decimalScale(v []byte) int {
+	if i := bytes.IndexByte(v, '.'); i >= 0 {
+		return len(v) - i - 1
+	}
+	return 0
+}
+
+/**
+ * ################################### having ###########################################
+ */
+
+//having在合并之后的行上计算, 与NULL比较的结果为false
+func evalHaving(node sqlparser.BoolExpr, row []interface{}, fields []*mysql.Field, m *router.SelectMerge) (bool, error) {
+	switch node := node.(type) {
+	case *sqlparser.AndExpr:
+		left, err := evalHaving(node.Left, row, fields, m)
+		if err != nil || !left {
+			return false, err
+		}
+		return evalHaving(node.Right, row, fields, m)
+	case *sqlparser.OrExpr:
+		left, err := evalHaving(node.Left, row, fields, m)
+		if err != nil || left {
+			return left, err
+		}
+		return evalHaving(node.Right, row, fields, m)
+	case *sqlparser.NotExpr:
+		v, err := evalHaving(node.Expr, row, fields, m)
+		return !v, err
+	case *sqlparser.ParenBoolExpr:
+		return evalHaving(node.Expr, row, fields, m)
+	case *sqlparser.NullCheck:
+		v, _, err := havingValue(node.Expr, row, fields, m)
+		if err != nil {
+			return false, err
+		}
+		if node.Operator == sqlparser.AST_IS_NULL {
+			return v == nil, nil
+		}
+		return v != nil, nil
+	case *sqlparser.RangeCond:
+		v, n1, err := havingValue(node.Left, row, fields, m)
+		if err != nil {
+			return false, err
+		}
+		from, n2, err := havingValue(node.From, row, fields, m)
+		if err != nil {
+			return false, err
+		}
+		to, n3, err := havingValue(node.To, row, fields, m)
+		if err != nil {
+			return false, err
+		}
+		if v == nil || from == nil || to == nil {
+			return false, nil
+		}
+		numeric := n1 || n2 || n3
+		between := mysql.CompareValue(v, from, numeric) >= 0 && mysql.CompareValue(v, to, numeric) <= 0
+		if node.Operator == sqlparser.AST_NOT_BETWEEN {
+			return !between, nil
+		}
+		return between, nil
+	case *sqlparser.ComparisonExpr:
+		left, n1, err := havingValue(node.Left, row, fields, m)
+		if err != nil {
+			return false, err
+		}
+		right, n2, err := havingValue(node.Right, row, fields, m)
+		if err != nil {
+			return false, err
+		}
+		if node.Operator == sqlparser.AST_NSE {
+			if left == nil || right == nil {
+				return left == nil && right == nil, nil
+			}
+			return mysql.CompareValue(left, right, n1 || n2) == 0, nil
+		}
+		if left == nil || right == nil {
+			return false, nil
+		}
+
+		cmp := mysql.CompareValue(left, right, n1 || n2)
+		switch node.Operator {
+		case sqlparser.AST_EQ:
+			return cmp == 0, nil
+		case sqlparser.AST_NE:
+			return cmp != 0, nil
+		case sqlparser.AST_LT:
+			return cmp < 0, nil
+		case sqlparser.AST_LE:
+			return cmp <= 0, nil
+		case sqlparser.AST_GT:
+			return cmp > 0, nil
+		case sqlparser.AST_GE:
+			return cmp >= 0, nil
+		}
+	}
+	return false, errors.ErrHavingTooComplex
+}
+
+//返回表达式的值, 以及是否按数值比较
+func havingValue(expr sqlparser.ValExpr, row []interface{}, fields []*mysql.Field, m *router.SelectMerge) (interface{}, bool, error) {
+	switch v := expr.(type) {
+	case sqlparser.NumVal:
+		return []byte(v), true, nil
+	case sqlparser.StrVal:
+		return []byte(v), false, nil
+	case *sqlparser.NullVal:
+		return nil, false, nil
+	}
+
+	index, ok := m.ColumnIndex(expr)
+	if !ok || index >= len(row) {
+		return nil, false, f.Errorf("unknown column '%s' in having clause", strings.TrimSpace(sqlparser.String(expr)))
+	}
+	return row[index], fields[index].IsNumeric(), nil
+}
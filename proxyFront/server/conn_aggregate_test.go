@@ -0,0 +1,134 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"brother/config"
+	"brother/mysql"
+	"brother/proxyFront/router"
+	"brother/sqlparser"
+)
+
+func testMergePlan(t *testing.T, sql string) *router.Plan {
+	var s = `
+schema :
+  nodes: [node1, node2]
+  default: node1
+  shard:
+    -
+      db : brother
+      table: test_shard_hash
+      key: id
+      nodes: [node1, node2]
+      type: hash
+      locations: [1,1]
+`
+	cfg, err := config.ParseConfigData([]byte(s))
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := router.NewRouter(&cfg.Schema)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stmt, err := sqlparser.Parse(sql)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := r.BuildPlan("brother", stmt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.Merge == nil {
+		t.Fatalf("%s has no merge", sql)
+	}
+	return plan
+}
+
+//模拟各子表返回的结果集合并之后的行
+func testMergeResultset(t *testing.T, names []string, values [][]interface{}) *mysql.Resultset {
+	c := new(ClientConn)
+	r, err := c.buildResultset(names, values)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r
+}
+
+func TestMergeAggregate(t *testing.T) {
+	plan := testMergePlan(t, "select name, count(*), sum(age), avg(age) from test_shard_hash "+
+		"group by name having count(*) > 1 order by name desc limit 2")
+	if sqls := plan.RewrittenSqls["node1"]; len(sqls) != 1 || sqls[0] != "select name, count(*), sum(age), "+
+		"sum(age) as `avg(age)`, count(age) from test_shard_hash_0000 group by name" {
+		t.Fatal(sqls)
+	}
+
+	names := []string{"name", "count(*)", "sum(age)", "avg(age)", "count(age)"}
+	r := testMergeResultset(t, names, [][]interface{}{
+		//test_shard_hash_0000
+		{"a", int64(2), []byte("30"), []byte("30"), int64(2)},
+		{"b", int64(1), []byte("10"), []byte("10"), int64(1)},
+		{"c", int64(3), []byte("60"), []byte("60"), int64(3)},
+		//test_shard_hash_0001
+		{"a", int64(1), []byte("20"), []byte("20"), int64(1)},
+		{"b", int64(1), []byte("5"), []byte("5"), int64(1)},
+		{"d", int64(1), []byte("7"), []byte("7"), int64(1)},
+	})
+
+	c := new(ClientConn)
+	if err := c.mergeResultset(r, plan.Merge); err != nil {
+		t.Fatal(err)
+	}
+	expect := [][]interface{}{
+		{"c", int64(3), []byte("60"), []byte("20.0000")},
+		{"b", int64(2), []byte("15"), []byte("7.5000")},
+	}
+	if !reflect.DeepEqual(r.Values, expect) {
+		t.Fatal(r.Values)
+	}
+	if len(r.Fields) != 4 || len(r.RowDatas) != 2 {
+		t.Fatal(len(r.Fields), len(r.RowDatas))
+	}
+	if string(r.RowDatas[1]) != string(buildRowData(expect[1])) {
+		t.Fatal(r.RowDatas[1])
+	}
+}
+
+func TestMergeDistinct(t *testing.T) {
+	plan := testMergePlan(t, "select distinct name from test_shard_hash order by age")
+	if plan.Merge.ColumnCount != 1 || len(plan.Merge.OrderBy) != 1 || plan.Merge.OrderBy[0].Index != 1 {
+		t.Fatal(plan.Merge)
+	}
+
+	r := testMergeResultset(t, []string{"name", "age"}, [][]interface{}{
+		{"b", int64(20)},
+		{"a", int64(30)},
+		{"b", int64(20)},
+		{"c", int64(10)},
+	})
+	c := new(ClientConn)
+	if err := c.mergeResultset(r, plan.Merge); err != nil {
+		t.Fatal(err)
+	}
+	//排序列不在select列表中, 合并之后去掉
+	if !reflect.DeepEqual(r.Values, [][]interface{}{{"c"}, {"b"}, {"a"}}) {
+		t.Fatal(r.Values)
+	}
+}
+
+func TestMergeCountDistinct(t *testing.T) {
+	plan := testMergePlan(t, "select count(distinct name) from test_shard_hash")
+
+	//子表按name分组, proxy去重计数, NULL不计数
+	r := testMergeResultset(t, []string{"count(distinct name)"}, [][]interface{}{
+		{"a"}, {"b"}, {nil}, {"a"}, {"c"},
+	})
+	c := new(ClientConn)
+	if err := c.mergeResultset(r, plan.Merge); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(r.Values, [][]interface{}{{int64(3)}}) || r.Fields[0].Type != mysql.MYSQL_TYPE_LONGLONG {
+		t.Fatal(r.Values, r.Fields[0])
+	}
+}
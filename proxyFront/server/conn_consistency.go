@@ -0,0 +1,191 @@
+package server
+
+import (
+	f "fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"brother/core/errors"
+	"brother/core/golog"
+	"brother/mysql"
+	"brother/proxyBack"
+	"brother/sqlparser"
+)
+
+/**
+ * ################################### 读一致性 ###########################################
+ */
+
+//读写分离时会话的读一致性:
+//none: 读总是优先走从库
+//window: 会话在某个节点写入之后的window时间内, 该节点的读走主库
+//gtid: 写入之后记录主库的gtid_executed, 读从库前用WAIT_FOR_EXECUTED_GTID_SET等待从库执行到该位置,
+//      超过window时间仍未执行到时读走主库
+const (
+	ReadConsistencyNone		= "none"
+	ReadConsistencyWindow		= "window"
+	ReadConsistencyGtid		= "gtid"
+
+	DefaultReadConsistencyWindow	= 1000 * time.Millisecond
+
+	//会话级的设置: SET brother_read_consistency = 'gtid', SET brother_read_window = 500(毫秒)
+	sessionReadConsistency		= "brother_read_consistency"
+	sessionReadWindow		= "brother_read_window"
+)
+
+type readConsistency struct {
+	mode				string
+	window				time.Duration
+}
+
+//会话在节点上最近一次写入的时间和写入之后主库的gtid_executed
+type nodeWrite struct {
+	time				time.Time
+	gtid				string
+}
+
+func parseReadConsistency(mode string, windowMs int) (readConsistency, error) {
+	rc := readConsistency{mode: strings.ToLower(mode), window: DefaultReadConsistencyWindow}
+	switch rc.mode {
+	case "":
+		rc.mode = ReadConsistencyNone
+	case ReadConsistencyNone, ReadConsistencyWindow, ReadConsistencyGtid:
+	default:
+		return rc, errors.ErrReadConsistency
+	}
+	if windowMs < 0 {
+		return rc, errors.ErrReadConsistency
+	}
+	if windowMs > 0 {
+		rc.window = time.Duration(windowMs) * time.Millisecond
+	}
+	return rc, nil
+}
+
+func (s *Server) parseReadConsistency() error {
+	rc, err := parseReadConsistency(s.cfg.ReadConsistency, s.cfg.ReadConsistencyWindow)
+	if err != nil {
+		return err
+	}
+	s.readConsistency = rc
+	return nil
+}
+
+//SET中的读一致性设置由proxy处理, 不发往后端
+func (c *ClientConn) setReadConsistency(name string, val sqlparser.ValExpr) error {
+	value := strings.ToLower(strings.Trim(sqlparser.String(val), "'`\""))
+	switch name {
+	case sessionReadConsistency:
+		if value == "default" {
+			c.readConsistency.mode = c.proxy.readConsistency.mode
+			return nil
+		}
+		rc, err := parseReadConsistency(value, 0)
+		if err != nil {
+			return mysql.NewDefaultError(mysql.ER_WRONG_VALUE_FOR_VAR, name, value)
+		}
+		c.readConsistency.mode = rc.mode
+	case sessionReadWindow:
+		if value == "default" {
+			c.readConsistency.window = c.proxy.readConsistency.window
+			return nil
+		}
+		ms, err := strconv.Atoi(value)
+		if err != nil || ms <= 0 {
+			return mysql.NewDefaultError(mysql.ER_WRONG_VALUE_FOR_VAR, name, value)
+		}
+		c.readConsistency.window = time.Duration(ms) * time.Millisecond
+	}
+	return nil
+}
+
+//按会话的读一致性判断节点的读是否必须走主库, 超过window的写入记录被删除(gtid模式也一样,
+//否则之后每次读从库都要多一次WAIT_FOR_EXECUTED_GTID_SET)
+//gtid模式取到了gtid时返回false, 由从库等待执行到该位置
+func (c *ClientConn) mustReadMaster(n *proxyBack.Node) bool {
+	w, ok := c.nodeWrites[n]
+	if !ok || c.readConsistency.mode == ReadConsistencyNone {
+		return false
+	}
+	if time.Since(w.time) >= c.readConsistency.window {
+		delete(c.nodeWrites, n)
+		return false
+	}
+	//没有取到gtid时按window处理
+	return c.readConsistency.mode != ReadConsistencyGtid || len(w.gtid) == 0
+}
+
+//按会话的读一致性取从库连接, 返回错误时由调用方回退到主库
+func (c *ClientConn) getConsistentSlaveConn(n *proxyBack.Node) (*proxyBack.BackendConn, error) {
+	if c.mustReadMaster(n) {
+		return nil, errors.ErrReadOnMaster
+	}
+
+	co, err := n.GetSlaveConn()
+	if err != nil {
+		return nil, err
+	}
+	if w, ok := c.nodeWrites[n]; ok && c.readConsistency.mode == ReadConsistencyGtid {
+		if err = c.waitGtid(co, w.gtid); err != nil {
+			co.Close()
+			return nil, err
+		}
+	}
+	return co, nil
+}
+
+//WAIT_FOR_EXECUTED_GTID_SET返回0表示已经执行到, 1表示超时
+func (c *ClientConn) waitGtid(co *proxyBack.BackendConn, gtid string) error {
+	sql := f.Sprintf("SELECT WAIT_FOR_EXECUTED_GTID_SET('%s', %.3f)",
+		strings.Replace(gtid, "'", "", -1), c.readConsistency.window.Seconds())
+	r, err := co.Execute(sql)
+	if err != nil {
+		golog.Warn("ClientConn", "waitGtid", err.Error(), c.connectionId, "db.Addr", co.GetAddr())
+		return err
+	}
+	if r.Resultset == nil || r.RowNumber() == 0 {
+		return errors.ErrReadOnMaster
+	}
+	ret, err := r.GetInt(0, 0)
+	if err != nil {
+		return err
+	}
+	if ret != 0 {
+		golog.Warn("ClientConn", "waitGtid", "slave not caught up, read from master", c.connectionId,
+			"db.Addr", co.GetAddr(), "gtid", gtid)
+		return errors.ErrReadOnMaster
+	}
+	return nil
+}
+
+//主库连接用完之后记录写入, gtid模式下在同一个连接上读取gtid_executed
+func (c *ClientConn) recordWrite(n *proxyBack.Node, co *proxyBack.BackendConn) {
+	if c.readConsistency.mode == ReadConsistencyNone {
+		return
+	}
+
+	w := &nodeWrite{time: time.Now()}
+	if c.readConsistency.mode == ReadConsistencyGtid && co != nil {
+		r, err := co.Execute("SELECT @@GLOBAL.gtid_executed")
+		if err == nil && r.Resultset != nil && r.RowNumber() == 1 {
+			w.gtid, err = r.GetString(0, 0)
+		}
+		if err != nil {
+			golog.Warn("ClientConn", "recordWrite", err.Error(), c.connectionId, "node", n.String())
+		}
+	}
+	c.nodeWrites[n] = w
+}
+
+//非事务中取出的主库连接, 归还时记录写入
+func (c *ClientConn) releaseWriteConn(co *proxyBack.BackendConn, rollback bool) {
+	n, ok := c.writeConns[co]
+	if !ok {
+		return
+	}
+	delete(c.writeConns, co)
+	if !rollback {
+		c.recordWrite(n, co)
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"brother/proxyBack"
+)
+
+func TestParseReadConsistency(t *testing.T) {
+	rc, err := parseReadConsistency("", 0)
+	if err != nil || rc.mode != ReadConsistencyNone || rc.window != DefaultReadConsistencyWindow {
+		t.Fatal(rc, err)
+	}
+	rc, err = parseReadConsistency("GTID", 500)
+	if err != nil || rc.mode != ReadConsistencyGtid || rc.window != 500*time.Millisecond {
+		t.Fatal(rc, err)
+	}
+	if _, err = parseReadConsistency("session", 0); err == nil {
+		t.Fatal("unknown mode must fail")
+	}
+	if _, err = parseReadConsistency(ReadConsistencyWindow, -1); err == nil {
+		t.Fatal("negative window must fail")
+	}
+}
+
+func TestMustReadMaster(t *testing.T) {
+	n := new(proxyBack.Node)
+	c := &ClientConn{
+		readConsistency: readConsistency{mode: ReadConsistencyNone, window: time.Second},
+		nodeWrites:      map[*proxyBack.Node]*nodeWrite{n: {time: time.Now()}},
+	}
+	if c.mustReadMaster(n) {
+		t.Fatal("mode none never reads master")
+	}
+
+	//window内的读走主库, 超过window之后删除写入记录
+	c.readConsistency.mode = ReadConsistencyWindow
+	if !c.mustReadMaster(n) {
+		t.Fatal("read within window must go to master")
+	}
+	c.nodeWrites[n].time = time.Now().Add(-2 * time.Second)
+	if c.mustReadMaster(n) {
+		t.Fatal("read after window may go to slave")
+	}
+	if _, ok := c.nodeWrites[n]; ok {
+		t.Fatal("write record must be removed after window")
+	}
+
+	//gtid模式取到gtid时由从库等待, 没有gtid时按window处理
+	c.readConsistency.mode = ReadConsistencyGtid
+	c.nodeWrites[n] = &nodeWrite{time: time.Now(), gtid: "uuid1:1-10"}
+	if c.mustReadMaster(n) {
+		t.Fatal("read with gtid may go to slave")
+	}
+	c.nodeWrites[n].gtid = ""
+	if !c.mustReadMaster(n) {
+		t.Fatal("read without gtid within window must go to master")
+	}
+
+	//超过window之后gtid的写入记录也被删除, 从库不再等待gtid
+	c.nodeWrites[n] = &nodeWrite{time: time.Now().Add(-2 * time.Second), gtid: "uuid1:1-10"}
+	if c.mustReadMaster(n) {
+		t.Fatal("read with gtid after window may go to slave")
+	}
+	if _, ok := c.nodeWrites[n]; ok {
+		t.Fatal("gtid write record must be removed after window")
+	}
+}
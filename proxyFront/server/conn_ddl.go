@@ -0,0 +1,155 @@
+package server
+
+import (
+	f "fmt"
+	"sort"
+	"strings"
+	"sync"
+
+	"brother/core/errors"
+	"brother/core/golog"
+	"brother/mysql"
+	"brother/proxyBack"
+	"brother/proxyFront/router"
+	"brother/sqlparser"
+)
+
+/**
+ * ################################### DDL ###########################################
+ */
+
+const (
+	ddlResultOK		= "ok"
+	ddlResultFailed		= "failed"
+	ddlResultSkipped	= "skipped"
+)
+
+var ddlColumns = []string{"node", "sql", "result", "message"}
+
+//分表的create/alter/drop/truncate改写到每个子表上执行, 各子表的执行结果合并成一个结果集返回
+//有节点不可用时拒绝执行, 除非带有/*brother:force*/提示
+func (c *ClientConn) handleDDL(stmt sqlparser.Statement, sql string) error {
+	//提示注释不发往后端
+	hint, sql, err := router.StripSqlHint(sql)
+	if err != nil {
+		return err
+	}
+	if hint != nil && hint.IsDirect() {
+		return c.handleHintNode(hint, sql, nil, false)
+	}
+
+	if c.schema == nil || c.schema.rule == nil {
+		return c.handleDefaultNode(sql, nil, false)
+	}
+	plan, err := c.schema.rule.BuildDDLPlan(c.db, stmt, sql)
+	if err != nil {
+		golog.Error("ClientConn", "handleDDL", err.Error(), c.connectionId, "sql", sql)
+		return err
+	}
+	if plan.Rule.Type == router.DefaultRuleType {
+		return c.handleDefaultNode(sql, nil, false)
+	}
+
+	conns, downs := c.getDDLConns(plan)
+	defer func() {
+		for _, co := range conns {
+			co.Close()
+		}
+	}()
+	if len(downs) != 0 && (hint == nil || !hint.Force) {
+		names := make([]string, 0, len(downs))
+		for name, e := range downs {
+			names = append(names, f.Sprintf("%s: %s", name, errMessage(e)))
+		}
+		sort.Strings(names)
+		return mysql.NewError(mysql.ER_UNKNOWN_ERROR,
+			f.Sprintf("ddl refused, nodes unavailable [%s], add /*brother:force*/ to run on the other nodes",
+				strings.Join(names, "; ")))
+	}
+
+	rows := c.executeDDL(conns, downs, plan.RewrittenSqls)
+	r, err := c.buildResultset(ddlColumns, rows)
+	if err != nil {
+		return err
+	}
+	return c.writeResultset(c.status, r)
+}
+
+//DDL不在客户端的事务中执行, 每个节点单独取主库连接
+func (c *ClientConn) getDDLConns(plan *router.Plan) (map[string]*proxyBack.BackendConn, map[string]error) {
+	conns := make(map[string]*proxyBack.BackendConn)
+	downs := make(map[string]error)
+	for _, nodeIndex := range plan.RouteNodeIndexs {
+		name := plan.Rule.Nodes[nodeIndex]
+		n := c.proxy.GetNode(name)
+		if n == nil {
+			downs[name] = errors.ErrNoRouteNode
+			continue
+		}
+
+		co, err := n.GetMasterConn()
+		if err == nil {
+			if err = c.initBackendConn(co); err != nil {
+				co.Close()
+			}
+		}
+		if err != nil {
+			golog.Error("ClientConn", "getDDLConns", err.Error(), c.connectionId, "node", name)
+			downs[name] = err
+			continue
+		}
+		conns[name] = co
+	}
+	return conns, downs
+}
+
+//各节点并行执行, 同一节点上的子表顺序执行; 某个子表失败不影响其他子表
+func (c *ClientConn) executeDDL(conns map[string]*proxyBack.BackendConn, downs map[string]error,
+	sqls map[string][]string) [][]interface{} {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	results := make(map[string][][]interface{}, len(sqls))
+
+	for name, co := range conns {
+		wg.Add(1)
+		go func(name string, co *proxyBack.BackendConn) {
+			defer wg.Done()
+			rows := make([][]interface{}, 0, len(sqls[name]))
+			for i, sql := range sqls[name] {
+				if _, err := c.executeInNode(co, sql, nil); err != nil {
+					golog.Error("ClientConn", "executeDDL", err.Error(), c.connectionId, "node", name, "sql", sql)
+					rows = append(rows, []interface{}{name, sql, ddlResultFailed, errMessage(err)})
+				} else {
+					golog.Info("ClientConn", "executeDDL", "ddl done", c.connectionId,
+						"node", name, "progress", f.Sprintf("%d/%d", i+1, len(sqls[name])), "sql", sql)
+					rows = append(rows, []interface{}{name, sql, ddlResultOK, ""})
+				}
+			}
+
+			mu.Lock()
+			results[name] = rows
+			mu.Unlock()
+		}(name, co)
+	}
+	wg.Wait()
+
+	for name, err := range downs {
+		rows := make([][]interface{}, 0, len(sqls[name]))
+		for _, sql := range sqls[name] {
+			rows = append(rows, []interface{}{name, sql, ddlResultSkipped, errMessage(err)})
+		}
+		results[name] = rows
+	}
+
+	names := make([]string, 0, len(results))
+	for name := range results {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	rows := make([][]interface{}, 0)
+	for _, name := range names {
+		rows = append(rows, results[name]...)
+	}
+	return rows
+}
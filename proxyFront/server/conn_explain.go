@@ -0,0 +1,157 @@
+package server
+
+import (
+	f "fmt"
+	"regexp"
+
+	"brother/core/errors"
+	"brother/proxyBack"
+	"brother/proxyFront/router"
+	"brother/sqlparser"
+)
+
+/**
+ * ################################### EXPLAIN ROUTE ###########################################
+ */
+
+const (
+	routeDBMaster	= "master"
+	routeDBSlave	= "slave"
+)
+
+var explainRouteRegexp = regexp.MustCompile(`(?is)^\s*explain\s+route\s+(.+)$`)
+
+var explainRouteColumns = []string{"node", "sub_table", "db_type", "db_addr", "sql"}
+
+func parseExplainRoute(sql string) (string, bool) {
+	m := explainRouteRegexp.FindStringSubmatch(sql)
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
+
+//EXPLAIN ROUTE <sql>: 按handleQuery相同的路由和读写分离规则列出sql会发往哪里, 不执行sql
+//insert需要序列生成分片键时不会消耗序列, 需要显式给出分片键
+func (c *ClientConn) handleExplainRoute(sql string) error {
+	stmt, err := sqlparser.Parse(sql)
+	if err != nil {
+		return err
+	}
+
+	var hint *router.Hint
+	var plan *router.Plan
+	fromSlave := false
+	switch v := stmt.(type) {
+	case *sqlparser.Select, *sqlparser.SimpleSelect:
+		fromSlave = true
+		if hint, sql, err = c.parseHint(v, sql); err == nil && (hint == nil || !hint.IsDirect()) {
+			plan, err = c.buildPlan(v)
+		}
+	case *sqlparser.Insert, *sqlparser.Update, *sqlparser.Delete, *sqlparser.Replace:
+		if hint, sql, err = c.parseHint(v, sql); err == nil && (hint == nil || !hint.IsDirect()) {
+			plan, err = c.buildPlan(v)
+		}
+	case *sqlparser.DDL, *sqlparser.Truncate:
+		if hint, sql, err = router.StripSqlHint(sql); err == nil && (hint == nil || !hint.IsDirect()) &&
+			c.schema != nil && c.schema.rule != nil {
+			plan, err = c.schema.rule.BuildDDLPlan(c.db, v, sql)
+			if err == nil && plan.Rule.Type == router.DefaultRuleType {
+				plan = nil
+			}
+		}
+	default:
+		return f.Errorf("statement %T not support explain route", stmt)
+	}
+	if err != nil {
+		return err
+	}
+	if hint != nil && hint.Master {
+		fromSlave = false
+	}
+
+	var rows [][]interface{}
+	switch {
+	case hint != nil && hint.IsDirect():
+		rows, err = c.explainHintRoute(hint, sql, fromSlave)
+	case plan == nil:
+		var n *proxyBack.Node
+		if n, err = c.getDefaultNode(); err == nil {
+			rows = [][]interface{}{c.explainRow(n, "", sql, fromSlave)}
+		}
+	case fromSlave && plan.Rule.Type == router.GlobalRuleType:
+		rows, err = c.explainGlobalRoute(plan, fromSlave)
+	default:
+		for _, route := range plan.Routes() {
+			rows = append(rows, c.explainRow(c.proxy.GetNode(route.Node), route.SubTable, route.Sql, fromSlave))
+		}
+	}
+	if err != nil {
+		return err
+	}
+
+	r, err := c.buildResultset(explainRouteColumns, rows)
+	if err != nil {
+		return err
+	}
+	return c.writeResultset(c.status, r)
+}
+
+func (c *ClientConn) explainHintRoute(hint *router.Hint, sql string, fromSlave bool) ([][]interface{}, error) {
+	if len(hint.Slave) != 0 && !fromSlave {
+		return nil, errors.ErrHintSlaveWrite
+	}
+	n, err := c.getHintNode(hint)
+	if err != nil {
+		return nil, err
+	}
+	if len(hint.Slave) != 0 && !c.isInTransaction() {
+		if n.GetSlave(hint.Slave) == nil {
+			return nil, errors.ErrSlaveNotExist
+		}
+		return [][]interface{}{{n.String(), "", routeDBSlave, hint.Slave, sql}}, nil
+	}
+	return [][]interface{}{c.explainRow(n, "", sql, fromSlave)}, nil
+}
+
+//和handleGlobalSelect相同的选择顺序, 只列出会执行的一个节点
+func (c *ClientConn) explainGlobalRoute(plan *router.Plan, fromSlave bool) ([][]interface{}, error) {
+	nodes, err := c.globalReadNodes(plan, true)
+	if err != nil {
+		return nil, err
+	}
+
+	n := nodes[0]
+	for _, node := range nodes {
+		if c.explainSlave(node, fromSlave) != nil {
+			n = node
+			break
+		}
+	}
+	sqls := plan.RewrittenSqls[n.String()]
+	if len(sqls) != 1 {
+		return nil, errors.ErrConnNotEqual
+	}
+	return [][]interface{}{c.explainRow(n, "", sqls[0], fromSlave)}, nil
+}
+
+//读请求按读一致性和负载均衡列出下一次会选择的从库, 不移动轮询位置
+func (c *ClientConn) explainSlave(n *proxyBack.Node, fromSlave bool) *proxyBack.DB {
+	if !fromSlave || c.isInTransaction() || c.mustReadMaster(n) {
+		return nil
+	}
+	return n.PeekSlave()
+}
+
+//没有可用从库, 读一致性要求或者在事务中时走主库
+func (c *ClientConn) explainRow(n *proxyBack.Node, subTable string, sql string, fromSlave bool) []interface{} {
+	if db := c.explainSlave(n, fromSlave); db != nil {
+		return []interface{}{n.String(), subTable, routeDBSlave, db.Addr(), sql}
+	}
+
+	var addr string
+	if master := n.GetMaster(); master != nil {
+		addr = master.Addr()
+	}
+	return []interface{}{n.String(), subTable, routeDBMaster, addr, sql}
+}
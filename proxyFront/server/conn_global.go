@@ -0,0 +1,191 @@
+package server
+
+import (
+	f "fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"brother/core/errors"
+	"brother/core/golog"
+	"brother/mysql"
+	"brother/proxyBack"
+	"brother/proxyFront/router"
+)
+
+/**
+ * ################################### 全局表 ###########################################
+ */
+
+//全局表的读只发往一个节点: 事务中使用已经开启事务的节点, 否则从轮询位置开始依次尝试,
+//先在各节点按读一致性和从库的负载均衡选择从库, 都不可用时再尝试各节点的主库
+func (c *ClientConn) handleGlobalSelect(plan *router.Plan, args []interface{}, fromSlave bool) error {
+	nodes, err := c.globalReadNodes(plan, false)
+	if err != nil {
+		return err
+	}
+
+	var conn *proxyBack.BackendConn
+	var name string
+	if fromSlave && !c.isInTransaction() {
+		for _, n := range nodes {
+			if conn, err = c.getConsistentSlaveConn(n); err != nil {
+				continue
+			}
+			if err = c.initBackendConn(conn); err != nil {
+				golog.Warn("ClientConn", "handleGlobalSelect", err.Error(), c.connectionId, "node", n.String())
+				conn.Close()
+				conn = nil
+				continue
+			}
+			name = n.String()
+			break
+		}
+	}
+	if conn == nil {
+		for _, n := range nodes {
+			name = n.String()
+			if conn, err = c.getBackendConn(n, false); err == nil {
+				break
+			}
+			golog.Warn("ClientConn", "handleGlobalSelect", err.Error(), c.connectionId, "node", name)
+			c.closeConn(conn, false)
+			conn = nil
+		}
+	}
+	if conn == nil {
+		return err
+	}
+	defer c.closeConn(conn, false)
+
+	sqls := plan.RewrittenSqls[name]
+	if len(sqls) != 1 {
+		return errors.ErrConnNotEqual
+	}
+	r, err := c.executeInNode(conn, sqls[0], args)
+	if err != nil {
+		return err
+	}
+
+	return c.writeResult(r)
+}
+
+//全局表读的候选节点: 事务中只能使用已经开启事务的节点(还没有时为任意一个节点), 否则从轮询位置开始排列
+//peek为true时不移动轮询位置, 用于EXPLAIN ROUTE
+func (c *ClientConn) globalReadNodes(plan *router.Plan, peek bool) ([]*proxyBack.Node, error) {
+	names := plan.Rule.Nodes
+	if len(names) == 0 {
+		return nil, errors.ErrNoRouteNode
+	}
+	var start int
+	if peek {
+		start = int(atomic.LoadUint32(&c.schema.globalIndex) + 1)
+	} else {
+		start = int(atomic.AddUint32(&c.schema.globalIndex, 1))
+	}
+
+	nodes := make([]*proxyBack.Node, 0, len(names))
+	for i := 0; i < len(names); i++ {
+		if n := c.proxy.GetNode(names[(start+i)%len(names)]); n != nil {
+			nodes = append(nodes, n)
+		}
+	}
+	if len(nodes) == 0 {
+		return nil, errors.ErrNoRouteNode
+	}
+	if c.isInTransaction() {
+		for _, n := range nodes {
+			if _, ok := c.txConns[n]; ok {
+				return []*proxyBack.Node{n}, nil
+			}
+		}
+		//事务中不能再换节点
+		return nodes[:1], nil
+	}
+	return nodes, nil
+}
+
+//全局表的写入在所有节点上执行, 部分节点失败时返回的错误中列出数据不一致的节点
+func (c *ClientConn) executeGlobal(conns map[string]*proxyBack.BackendConn, sqls map[string][]string, args []interface{}) error {
+	if len(conns) != len(sqls) {
+		return errors.ErrConnNotEqual
+	}
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	rs := make(map[string]*mysql.Result, len(conns))
+	errs := make(map[string]error)
+
+	wg.Add(len(conns))
+	for name, co := range conns {
+		go func(name string, co *proxyBack.BackendConn) {
+			defer wg.Done()
+			var r *mysql.Result
+			var err error
+			for _, sql := range sqls[name] {
+				if r, err = c.executeInNode(co, sql, args); err != nil {
+					break
+				}
+			}
+
+			mu.Lock()
+			if err != nil {
+				errs[name] = err
+			} else {
+				rs[name] = r
+			}
+			mu.Unlock()
+		}(name, co)
+	}
+	wg.Wait()
+
+	succeed := make([]string, 0, len(rs))
+	for name := range rs {
+		succeed = append(succeed, name)
+	}
+	sort.Strings(succeed)
+
+	if len(errs) == 0 {
+		//每个节点的结果相同, 返回其中一个节点的结果
+		return c.writeResult(rs[succeed[0]])
+	}
+	return c.globalExecError(succeed, errs)
+}
+
+func (c *ClientConn) globalExecError(succeed []string, errs map[string]error) error {
+	failed := make([]string, 0, len(errs))
+	for name := range errs {
+		failed = append(failed, name)
+	}
+	sort.Strings(failed)
+	err := errs[failed[0]]
+
+	golog.Error("ClientConn", "executeGlobal", err.Error(), c.connectionId,
+		"succeed", strings.Join(succeed, ","), "failed", strings.Join(failed, ","))
+	if len(succeed) == 0 {
+		return err
+	}
+
+	details := make([]string, 0, len(failed))
+	for _, name := range failed {
+		details = append(details, f.Sprintf("%s: %s", name, errMessage(errs[name])))
+	}
+
+	var msg string
+	if c.isInTransaction() {
+		if e := c.rollback(); e != nil {
+			golog.Error("ClientConn", "globalExecError", e.Error(), c.connectionId)
+		}
+		msg = f.Sprintf("global table write failed on [%s], succeeded on [%s], the transaction has been rolled back",
+			strings.Join(details, "; "), strings.Join(succeed, ", "))
+	} else {
+		msg = f.Sprintf("global table diverged: written on [%s], failed on [%s]",
+			strings.Join(succeed, ", "), strings.Join(details, "; "))
+	}
+
+	if e, ok := err.(*mysql.SqlError); ok {
+		return &mysql.SqlError{Code: e.Code, Message: msg, State: e.State}
+	}
+	return mysql.NewError(mysql.ER_UNKNOWN_ERROR, msg)
+}
@@ -0,0 +1,97 @@
+package server
+
+import (
+	"brother/core/errors"
+	"brother/core/golog"
+	"brother/proxyBack"
+	"brother/proxyFront/router"
+	"brother/sqlparser"
+)
+
+/**
+ * ################################### 路由提示 ###########################################
+ */
+
+//取出语句中任意位置的路由提示, 有提示时返回去掉提示之后的sql
+func (c *ClientConn) parseHint(stmt sqlparser.Statement, sql string) (*router.Hint, string, error) {
+	hint, sql, err := router.StripSqlHint(sql)
+	if err != nil {
+		golog.Error("ClientConn", "parseHint", err.Error(), c.connectionId, "sql", sql)
+		return nil, sql, err
+	}
+	if hint == nil {
+		return nil, sql, nil
+	}
+	//AST中的提示注释也要删除, 分表改写的sql由AST生成
+	if _, err = router.StripHint(stmt); err != nil {
+		return nil, sql, err
+	}
+	return hint, sql, nil
+}
+
+//node/slave提示: 不做分表路由, 语句原样发往指定的节点或从库
+func (c *ClientConn) handleHintNode(hint *router.Hint, sql string, args []interface{}, fromSlave bool) error {
+	if len(hint.Slave) != 0 && !fromSlave {
+		return errors.ErrHintSlaveWrite
+	}
+
+	n, err := c.getHintNode(hint)
+	if err != nil {
+		return err
+	}
+
+	//事务中仍然使用事务的主库连接
+	var conn *proxyBack.BackendConn
+	if len(hint.Slave) != 0 && !c.isInTransaction() {
+		conn, err = c.getHintSlaveConn(n, hint.Slave)
+	} else {
+		conn, err = c.getBackendConn(n, fromSlave && !hint.Master)
+	}
+	defer c.closeConn(conn, false)
+	if err != nil {
+		golog.Error("ClientConn", "handleHintNode", err.Error(), c.connectionId, "node", n.String())
+		return err
+	}
+
+	r, err := c.executeInNode(conn, sql, args)
+	if err != nil {
+		return err
+	}
+
+	return c.writeResult(r)
+}
+
+//只能指定schema中的节点, 只给出slave时按地址查找所在的节点
+func (c *ClientConn) getHintNode(hint *router.Hint) (*proxyBack.Node, error) {
+	if c.schema == nil {
+		return nil, errors.ErrNoDefaultNode
+	}
+
+	if len(hint.Node) != 0 {
+		n, ok := c.schema.nodes[hint.Node]
+		if !ok {
+			return nil, errors.ErrHintNodeUnknown
+		}
+		return n, nil
+	}
+
+	for _, n := range c.schema.nodes {
+		if n.GetSlave(hint.Slave) != nil {
+			return n, nil
+		}
+	}
+	return nil, errors.ErrSlaveNotExist
+}
+
+func (c *ClientConn) getHintSlaveConn(n *proxyBack.Node, addr string) (*proxyBack.BackendConn, error) {
+	co, err := n.GetSlaveConnByAddr(addr)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = c.initBackendConn(co); err != nil {
+		co.Close()
+		return nil, err
+	}
+	return co, nil
+}
@@ -7,6 +7,11 @@ import (
 	"brother/sqlparser"
 	"brother/proxyBack"
 	f"fmt"
+	"brother/mysql"
+	"time"
+	"sync"
+	"brother/core/errors"
+	"brother/proxyFront/router"
 )
 
 /**
@@ -33,6 +38,13 @@ func (c *ClientConn) handleQuery(sql string) (err error) {
 	sql = strings.TrimRight(sql, ";") //删除sql语句最后的分号
 	//TODO 此处不再处理 分表
 
+	if expr, name, ok := parseNextValue(sql); ok {
+		return c.handleNextValue(expr, name)
+	}
+	if routeSql, ok := parseExplainRoute(sql); ok {
+		return c.handleExplainRoute(routeSql)
+	}
+
 	var stmt sqlparser.Statement
 	stmt, err = sqlparser.Parse(sql) //解析sql语句， 得到的stmt是一个interface 类型
 	if err != nil {
@@ -42,29 +54,509 @@ func (c *ClientConn) handleQuery(sql string) (err error) {
 
 	switch v := stmt.(type) {
 	case *sqlparser.Select:
-		f.Println("Select cmd!")
-		return nil
+		return c.handleSelect(v, sql, nil)
+	case *sqlparser.SimpleSelect:
+		return c.handleSimpleSelect(v, sql)
 	case *sqlparser.Insert:
-		f.Println("insert cmd!")
-		return nil
+		return c.handleExec(v, sql, nil)
 	case *sqlparser.Update:
-		f.Println("update cmd!")
-		return nil
+		return c.handleExec(v, sql, nil)
 	case *sqlparser.Delete:
-		f.Println("delete cmd!")
-		return nil
+		return c.handleExec(v, sql, nil)
 	case *sqlparser.Replace:
-		f.Println("replace cmd!")
-		return nil
+		return c.handleExec(v, sql, nil)
+	case *sqlparser.DDL:
+		return c.handleDDL(v, sql)
+	case *sqlparser.Truncate:
+		return c.handleDDL(v, sql)
+	case *sqlparser.Set:
+		return c.handleSet(v, sql)
+	case *sqlparser.Begin:
+		return c.handleBegin()
+	case *sqlparser.Commit:
+		return c.handleCommit()
+	case *sqlparser.Rollback:
+		return c.handleRollback()
 	case *sqlparser.UseDB:
-		f.Println("use cmd!")
-		return nil
+		return c.handleUseDB(v.DB)
+	case *sqlparser.Admin:
+		return c.handleAdmin(v)
+	case *sqlparser.AdminHelp:
+		return c.handleAdminHelp()
 	default:
-		f.Println("value", v)
 		return f.Errorf("statement %T not support now", stmt)
 	}
+}
+
+//select语句优先走从库, 从库不可用时回退到主库
+func (c *ClientConn) handleSelect(stmt sqlparser.Statement, sql string, args []interface{}) error {
+	hint, sql, err := c.parseHint(stmt, sql)
+	if err != nil {
+		return err
+	}
+	if hint != nil && hint.IsDirect() {
+		return c.handleHintNode(hint, sql, args, true)
+	}
+	//master提示: 读也走主库
+	fromSlave := hint == nil || !hint.Master
+
+	plan, err := c.buildPlan(stmt)
+	if err != nil {
+		return err
+	}
+	if plan == nil {
+		return c.handleDefaultNode(sql, args, fromSlave)
+	}
+	if plan.Rule.Type == router.GlobalRuleType {
+		return c.handleGlobalSelect(plan, args, fromSlave)
+	}
+
+	conns, err := c.getShardConns(fromSlave, plan)
+	defer c.closeShardConns(conns, false)
+	if err != nil {
+		golog.Error("ClientConn", "handleSelect", err.Error(), c.connectionId)
+		return err
+	}
+	extraConns := c.getSubTableConns(fromSlave, plan)
+	defer c.closeSubTableConns(extraConns)
+
+	rs, err := c.executeInMultiNodes(conns, extraConns, plan.RewrittenSqls, args)
+	if err != nil {
+		golog.Error("ClientConn", "handleSelect", err.Error(), c.connectionId)
+		return err
+	}
+
+	if len(rs) == 1 {
+		return c.writeResult(rs[0])
+	}
+
+	//跨分表的结果集需要在proxy合并
+	return c.mergeSelectResult(rs, stmt.(*sqlparser.Select), plan.Merge)
+}
+
+//insert/update/delete/replace 只能走主库
+func (c *ClientConn) handleExec(stmt sqlparser.Statement, sql string, args []interface{}) error {
+	hint, sql, err := c.parseHint(stmt, sql)
+	if err != nil {
+		return err
+	}
+	if hint != nil && hint.IsDirect() {
+		return c.handleHintNode(hint, sql, args, false)
+	}
+
+	insertId, err := c.fillSequence(stmt)
+	if err != nil {
+		return err
+	}
+
+	plan, err := c.buildPlan(stmt)
+	if err != nil {
+		return err
+	}
+	if plan == nil {
+		return c.handleDefaultNode(sql, args, false)
+	}
+
+	conns, err := c.getShardConns(false, plan)
+	if err != nil {
+		c.closeShardConns(conns, true)
+		golog.Error("ClientConn", "handleExec", err.Error(), c.connectionId)
+		return err
+	}
+	defer func() {
+		c.closeShardConns(conns, false)
+	}()
+
+	if plan.Rule.Type == router.GlobalRuleType {
+		err = c.executeGlobal(conns, plan.RewrittenSqls, args)
+		if err != nil && c.isInTransaction() {
+			conns = nil
+		}
+		return err
+	}
+
+	var rs []*mysql.Result
+	rs, err = c.executeInMultiNodes(conns, nil, plan.RewrittenSqls, args)
+	if err != nil {
+		golog.Error("ClientConn", "handleExec", err.Error(), c.connectionId)
+		if c.isInTransaction() {
+			//事务中的连接由commit/rollback归还连接池
+			conns = nil
+		}
+		return c.partialExecError(rs, err)
+	}
+
+	return c.mergeExecResult(rs, insertId)
+}
+
+//跨分表的写入部分失败: 事务中回滚整个事务, 否则已经执行成功的子表不会回滚
+func (c *ClientConn) partialExecError(rs []*mysql.Result, err error) error {
+	var succeed int
+	var affectedRows uint64
+	for _, r := range rs {
+		if r != nil {
+			succeed++
+			affectedRows += r.AffectedRows
+		}
+	}
+	if succeed == 0 {
+		return err
+	}
+
+	var msg string
+	if c.isInTransaction() {
+		if e := c.rollback(); e != nil {
+			golog.Error("ClientConn", "partialExecError", e.Error(), c.connectionId)
+		}
+		msg = f.Sprintf("%s; %d of %d shard statements succeeded, the transaction has been rolled back",
+			errMessage(err), succeed, len(rs))
+	} else {
+		msg = f.Sprintf("%s; %d of %d shard statements succeeded and were committed (%d rows affected), "+
+			"the failed shards were not written",
+			errMessage(err), succeed, len(rs), affectedRows)
+	}
+
+	if e, ok := err.(*mysql.SqlError); ok {
+		return &mysql.SqlError{Code: e.Code, Message: msg, State: e.State}
+	}
+	return mysql.NewError(mysql.ER_UNKNOWN_ERROR, msg)
+}
+
+func errMessage(err error) string {
+	if e, ok := err.(*mysql.SqlError); ok {
+		return e.Message
+	}
+	return err.Error()
+}
+
+//未分表的语句返回nil plan, 直接发往默认节点
+func (c *ClientConn) buildPlan(stmt sqlparser.Statement) (*router.Plan, error) {
+	if c.schema == nil || c.schema.rule == nil {
+		return nil, nil
+	}
+	if _, ok := stmt.(*sqlparser.SimpleSelect); ok {
+		return nil, nil
+	}
+
+	plan, err := c.schema.rule.BuildPlan(c.db, stmt)
+	if err != nil {
+		golog.Error("ClientConn", "buildPlan", err.Error(), c.connectionId)
+		return nil, err
+	}
+	if plan.Rule.Type == router.DefaultRuleType {
+		return nil, nil
+	}
+
+	return plan, nil
+}
+
+func (c *ClientConn) handleDefaultNode(sql string, args []interface{}, fromSlave bool) error {
+	n, err := c.getDefaultNode()
+	if err != nil {
+		return err
+	}
+
+	conn, err := c.getBackendConn(n, fromSlave)
+	defer c.closeConn(conn, false)
+	if err != nil {
+		golog.Error("ClientConn", "handleDefaultNode", err.Error(), c.connectionId)
+		return err
+	}
+
+	r, err := c.executeInNode(conn, sql, args)
+	if err != nil {
+		return err
+	}
+
+	return c.writeResult(r)
+}
+
+func (c *ClientConn) getDefaultNode() (*proxyBack.Node, error) {
+	if c.schema == nil || c.schema.defaultNode == nil {
+		return nil, mysql.NewDefaultError(mysql.ER_NO_DB_ERROR)
+	}
+	return c.schema.defaultNode, nil
+}
+
+//事务中(包括autocommit=0)的语句都固定在第一次使用的主库连接上, commit/rollback时才归还连接池
+func (c *ClientConn) getBackendConn(n *proxyBack.Node, fromSlave bool) (*proxyBack.BackendConn, error) {
+	return c.getNodeConn(n, fromSlave, c.proxy.isXAMode())
+}
+
+//multiTx: 是否允许一个事务使用多个节点
+func (c *ClientConn) getNodeConn(n *proxyBack.Node, fromSlave bool, multiTx bool) (co *proxyBack.BackendConn, err error) {
+	if !c.isInTransaction() {
+		if fromSlave {
+			co, err = c.getConsistentSlaveConn(n)
+			if err != nil {
+				co, err = n.GetMasterConn()
+			}
+		} else {
+			co, err = n.GetMasterConn()
+			if err == nil {
+				c.writeConns[co] = n
+			}
+		}
+		if err != nil {
+			golog.Error("server", "getBackendConn", err.Error(), c.connectionId, "node", n.String())
+			return
+		}
+	} else {
+		var ok bool
+		co, ok = c.txConns[n]
+
+		if !ok {
+			//未开启XA时不支持跨节点的事务
+			if len(c.txConns) > 0 && !multiTx {
+				err = errors.ErrTransInMulti
+				return
+			}
+
+			if co, err = n.GetMasterConn(); err != nil {
+				golog.Error("server", "getBackendConn", err.Error(), c.connectionId, "node", n.String())
+				return
+			}
+
+			if c.proxy.isXAMode() {
+				err = c.startXA(n, co)
+			} else if !c.isAutoCommit() {
+				err = co.SetAutoCommit(0)
+			} else {
+				err = co.Begin()
+			}
+			if err != nil {
+				co.Close()
+				co = nil
+				return
+			}
+
+			c.txConns[n] = co
+		}
+	}
+
+	err = c.initBackendConn(co)
+	return
+}
+
+//把客户端的会话状态同步到后端连接上
+func (c *ClientConn) initBackendConn(co *proxyBack.BackendConn) error {
+	if err := co.UseDB(c.db); err != nil {
+		//reset the client database to null
+		c.db = ""
+		return err
+	}
+
+	if err := co.SetCharset(c.charset, c.collation); err != nil {
+		return err
+	}
+
+	return co.SetSysVars(c.sysVars)
+}
+
+func (c *ClientConn) executeInNode(conn *proxyBack.BackendConn, sql string, args []interface{}) (*mysql.Result, error) {
+	var state string
+
+	startTime := time.Now().UnixNano()
+	r, err := conn.Execute(sql, args...)
+	if err != nil {
+		state = "ERROR"
+	} else {
+		state = "OK"
+	}
+	execTime := float64(time.Now().UnixNano() - startTime) / float64(time.Millisecond)
+
+	if c.proxy.logSql[c.proxy.logSqlIndex] != golog.LogSqlOff &&
+		execTime >= float64(c.proxy.slowLogTime[c.proxy.slowLogTimeIndex]) {
+		c.proxy.counter.IncrSlowLogTotal()
+		golog.OutputSql(state, "%.1fms - %s->%s:%s",
+			execTime,
+			c.c.RemoteAddr(),
+			conn.GetAddr(),
+			sql,
+		)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+//plan路由到的每个节点取一个连接, 以节点名为key
+func (c *ClientConn) getShardConns(fromSlave bool, plan *router.Plan) (map[string]*proxyBack.BackendConn, error) {
+	var err error
+	if plan == nil || len(plan.RouteNodeIndexs) == 0 {
+		return nil, errors.ErrNoRouteNode
+	}
+
+	nodesCount := len(plan.RouteNodeIndexs)
+	nodes := make([]*proxyBack.Node, 0, nodesCount)
+	for i := 0; i < nodesCount; i++ {
+		nodeIndex := plan.RouteNodeIndexs[i]
+		nodes = append(nodes, c.proxy.GetNode(plan.Rule.Nodes[nodeIndex]))
+	}
+
+	//全局表的写入在每个节点上开启事务, 不需要XA
+	multiTx := c.proxy.isXAMode() || plan.Rule.Type == router.GlobalRuleType
+	if c.isInTransaction() && nodesCount > 1 && !multiTx {
+		return nil, errors.ErrTransInMulti
+	}
+
+	conns := make(map[string]*proxyBack.BackendConn)
+	var co *proxyBack.BackendConn
+	for _, n := range nodes {
+		co, err = c.getNodeConn(n, fromSlave, multiTx)
+		if err != nil {
+			//初始化会话失败时连接已经取出, 需要归还
+			if co != nil {
+				c.closeConn(co, true)
+			}
+			break
+		}
+
+		conns[n.Cfg.Name] = co
+	}
 
-	return nil
+	return conns, err
+}
+
+//同一节点上多个子表的读取使用的最大连接数
+const maxSubTableConns = 8
+
+//不在事务中的读, 同一节点上的其他子表额外取连接并行执行; 取连接失败时由已有的连接顺序执行
+func (c *ClientConn) getSubTableConns(fromSlave bool, plan *router.Plan) map[string][]*proxyBack.BackendConn {
+	if c.isInTransaction() {
+		return nil
+	}
+
+	extraConns := make(map[string][]*proxyBack.BackendConn)
+	for name, sqls := range plan.RewrittenSqls {
+		n := c.proxy.GetNode(name)
+		if n == nil {
+			continue
+		}
+		for i := 1; i < len(sqls) && i < maxSubTableConns; i++ {
+			co, err := c.getNodeConn(n, fromSlave, false)
+			if err != nil {
+				golog.Warn("ClientConn", "getSubTableConns", err.Error(), c.connectionId, "node", name)
+				if co != nil {
+					c.closeConn(co, true)
+				}
+				break
+			}
+			extraConns[name] = append(extraConns[name], co)
+		}
+	}
+	return extraConns
+}
+
+func (c *ClientConn) closeSubTableConns(extraConns map[string][]*proxyBack.BackendConn) {
+	for _, conns := range extraConns {
+		for _, co := range conns {
+			c.closeConn(co, false)
+		}
+	}
+}
+
+//各节点并行执行; 同一节点上的多条sql分配到该节点的各个连接上, 每个连接上顺序执行
+func (c *ClientConn) executeInMultiNodes(conns map[string]*proxyBack.BackendConn, extraConns map[string][]*proxyBack.BackendConn,
+	sqls map[string][]string, args []interface{}) ([]*mysql.Result, error) {
+	if len(conns) != len(sqls) {
+		golog.Error("ClientConn", "executeInMultiNodes", errors.ErrConnNotEqual.Error(), c.connectionId,
+			"conns", conns,
+			"sqls", sqls,
+		)
+		return nil, errors.ErrConnNotEqual
+	}
+
+	var wg sync.WaitGroup
+	if len(conns) == 0 {
+		return nil, errors.ErrNoPlan
+	}
+
+	resultCount := 0
+	for _, sqlSlice := range sqls {
+		resultCount += len(sqlSlice)
+	}
+
+	rs := make([]interface{}, resultCount)
+
+	//rs是该节点的结果, 连接执行下标为i, i+step, ...的sql
+	exec := func(rs []interface{}, i int, step int, execSqls []string, co *proxyBack.BackendConn) {
+		for ; i < len(execSqls); i += step {
+			r, err := c.executeInNode(co, execSqls[i], args)
+			if err != nil {
+				rs[i] = err
+			} else {
+				rs[i] = r
+			}
+		}
+		wg.Done()
+	}
+
+	offset := 0
+	for nodeName, co := range conns {
+		s := sqls[nodeName] //[]string
+		nodeConns := append([]*proxyBack.BackendConn{co}, extraConns[nodeName]...)
+		for i, nodeConn := range nodeConns {
+			wg.Add(1)
+			go exec(rs[offset:offset+len(s)], i, len(nodeConns), s, nodeConn)
+		}
+		offset += len(s)
+	}
+
+	wg.Wait()
+
+	//返回第一个错误, 执行成功的结果仍然保留
+	var err error
+	r := make([]*mysql.Result, resultCount)
+	for i, v := range rs {
+		if e, ok := v.(error); ok {
+			if err == nil {
+				err = e
+			}
+			continue
+		}
+		r[i] = v.(*mysql.Result)
+	}
+
+	return r, err
+}
+
+//合并各分表的执行结果, 影响行数累加
+//insertId不为0时是proxy用序列生成的第一个id
+func (c *ClientConn) mergeExecResult(rs []*mysql.Result, insertId uint64) error {
+	r := new(mysql.Result)
+	for _, v := range rs {
+		r.Status |= v.Status
+		r.AffectedRows += v.AffectedRows
+		if r.InsertId == 0 {
+			r.InsertId = v.InsertId
+		} else if r.InsertId > v.InsertId && v.InsertId != 0 {
+			//last insert id is first gen id for multi row inserted
+			//see http://dev.mysql.com/doc/refman/5.6/en/information-functions.html#function_last-insert-id
+			r.InsertId = v.InsertId
+		}
+	}
+	if insertId != 0 {
+		r.InsertId = insertId
+	}
+
+	return c.writeResult(r)
+}
+
+func (c *ClientConn) closeShardConns(conns map[string]*proxyBack.BackendConn, rollback bool) {
+	if c.isInTransaction() {
+		return
+	}
+
+	for _, co := range conns {
+		if rollback {
+			co.Rollback()
+		}
+		c.releaseWriteConn(co, rollback)
+		co.Close()
+	}
 }
 
 func (c *ClientConn) closeConn(conn *proxyBack.BackendConn, rollback bool) {
@@ -76,5 +568,6 @@ func (c *ClientConn) closeConn(conn *proxyBack.BackendConn, rollback bool) {
 		conn.Rollback()
 	}
 
+	c.releaseWriteConn(conn, rollback)
 	conn.Close()
-}
\ No newline at end of file
+}
@@ -0,0 +1,320 @@
+package server
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"brother/config"
+	"brother/core/golog"
+	"brother/mysql"
+	"brother/proxyBack"
+	"brother/proxyFront/router"
+)
+
+//fake后端在COM_INIT_DB这个库、语句中有testBadValue时返回错误
+const (
+	testUnknownDB	= "unknown_db"
+	testBadValue	= "bad_value"
+)
+
+//只回复OK包的mysql, 记录收到的语句
+type testBackend struct {
+	l		net.Listener
+	lock		sync.Mutex
+	queries		[]string
+}
+
+func newTestBackend(t *testing.T) *testBackend {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBackend{l: l}
+	go func() {
+		for {
+			co, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(co)
+		}
+	}()
+	return b
+}
+
+func (b *testBackend) Addr() string {
+	return b.l.Addr().String()
+}
+
+func (b *testBackend) Close() {
+	b.l.Close()
+}
+
+func (b *testBackend) Queries() []string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	queries := make([]string, len(b.queries))
+	copy(queries, b.queries)
+	return queries
+}
+
+func (b *testBackend) serve(co net.Conn) {
+	defer co.Close()
+	pkg := mysql.NewPacketIO(co)
+	status := uint16(mysql.SERVER_STATUS_AUTOCOMMIT)
+	capability := uint32(mysql.CLIENT_PROTOCOL_41 | mysql.CLIENT_SECURE_CONNECTION | mysql.CLIENT_LONG_PASSWORD |
+		mysql.CLIENT_TRANSACTIONS | mysql.CLIENT_LONG_FLAG)
+
+	//protocol version, server version, connection id, salt, capability, charset, status
+	data := make([]byte, 4, 128)
+	data = append(data, 10)
+	data = append(data, "5.7.0-test"...)
+	data = append(data, 0, 1, 0, 0, 0)
+	data = append(data, "12345678"...)
+	data = append(data, 0, byte(capability), byte(capability>>8), 33, byte(status), byte(status>>8))
+	data = append(data, byte(capability>>16), byte(capability>>24), 21)
+	data = append(data, make([]byte, 10)...)
+	data = append(data, "123456789012"...)
+	data = append(data, 0)
+	if pkg.WritePacket(data) != nil {
+		return
+	}
+	if _, err := pkg.ReadPacket(); err != nil {
+		return
+	}
+
+	ok := func() error {
+		return pkg.WritePacket([]byte{0, 0, 0, 0, mysql.OK_HEADER, 0, 0, byte(status), byte(status >> 8), 0, 0})
+	}
+	fail := func(code uint16, state string, msg string) error {
+		data := []byte{0, 0, 0, 0, mysql.ERR_HEADER, byte(code), byte(code >> 8), '#'}
+		data = append(data, state...)
+		return pkg.WritePacket(append(data, msg...))
+	}
+	if ok() != nil {
+		return
+	}
+
+	for {
+		pkg.Sequence = 0
+		data, err := pkg.ReadPacket()
+		if err != nil || data[0] == mysql.COM_QUIT {
+			return
+		}
+
+		switch data[0] {
+		case mysql.COM_INIT_DB:
+			//不存在的库回复ERR包
+			if string(data[1:]) == testUnknownDB {
+				if fail(mysql.ER_BAD_DB_ERROR, "42000", "Unknown database") != nil {
+					return
+				}
+				continue
+			}
+		case mysql.COM_QUERY:
+			query := strings.ToLower(strings.TrimSpace(string(data[1:])))
+			switch query {
+			case "begin":
+				status |= mysql.SERVER_STATUS_IN_TRANS
+			case "commit", "rollback":
+				status &= ^uint16(mysql.SERVER_STATUS_IN_TRANS)
+			case "set autocommit = 0":
+				status &= ^uint16(mysql.SERVER_STATUS_AUTOCOMMIT)
+			case "set autocommit = 1":
+				status |= mysql.SERVER_STATUS_AUTOCOMMIT
+			}
+			b.lock.Lock()
+			b.queries = append(b.queries, query)
+			b.lock.Unlock()
+			if strings.Contains(query, testBadValue) {
+				if fail(mysql.ER_WRONG_VALUE_FOR_VAR, "42000", "Variable can't be set") != nil {
+					return
+				}
+				continue
+			}
+		}
+
+		if ok() != nil {
+			return
+		}
+	}
+}
+
+func hasQuery(queries []string, query string) bool {
+	for _, q := range queries {
+		if q == query {
+			return true
+		}
+	}
+	return false
+}
+
+//默认节点有一个主库和一个从库, 通过本地tcp连接创建客户端连接, 发给客户端的数据被丢弃
+func newTestQueryConn(t *testing.T, master, slave *testBackend) *ClientConn {
+	n := new(proxyBack.Node)
+	n.Cfg = config.NodeConfig{Name: "node1", User: "root"}
+	if err := n.ParseMaster(master.Addr()); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.ParseSlave(slave.Addr()); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Server{counter: new(Counter)}
+	s.logSql[0] = golog.LogSqlOff
+	s.readConsistency = readConsistency{mode: ReadConsistencyNone}
+	s.schema = &Schema{nodes: map[string]*proxyBack.Node{"node1": n}, defaultNode: n}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	client, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	co, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		io.Copy(ioutil.Discard, client)
+		client.Close()
+	}()
+	return s.newClientConn(co)
+}
+
+func closeTestQueryConn(c *ClientConn) {
+	c.Close()
+	n := c.schema.defaultNode
+	n.GetMaster().Close()
+	for _, db := range n.GetSlaves() {
+		db.Close()
+	}
+}
+
+func TestReadWriteSplit(t *testing.T) {
+	master, slave := newTestBackend(t), newTestBackend(t)
+	defer master.Close()
+	defer slave.Close()
+	c := newTestQueryConn(t, master, slave)
+	defer closeTestQueryConn(c)
+
+	//select走从库, 写走主库
+	if err := c.handleQuery("select * from test_table"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.handleQuery("insert into test_table values (1)"); err != nil {
+		t.Fatal(err)
+	}
+
+	if q := slave.Queries(); !hasQuery(q, "select * from test_table") || hasQuery(q, "insert into test_table values (1)") {
+		t.Fatal("slave", q)
+	}
+	if q := master.Queries(); hasQuery(q, "select * from test_table") || !hasQuery(q, "insert into test_table values (1)") {
+		t.Fatal("master", q)
+	}
+}
+
+func TestHintMasterRead(t *testing.T) {
+	master, slave := newTestBackend(t), newTestBackend(t)
+	defer master.Close()
+	defer slave.Close()
+	c := newTestQueryConn(t, master, slave)
+	defer closeTestQueryConn(c)
+
+	//master提示: 读也走主库
+	if err := c.handleQuery("select /*brother:master*/ id from test_table"); err != nil {
+		t.Fatal(err)
+	}
+	if q := master.Queries(); len(q) == 0 || !strings.Contains(q[len(q)-1], "from test_table") {
+		t.Fatal("master", q)
+	}
+	for _, q := range slave.Queries() {
+		if strings.Contains(q, "from test_table") {
+			t.Fatal("slave", q)
+		}
+	}
+}
+
+func TestReadAfterWrite(t *testing.T) {
+	master, slave := newTestBackend(t), newTestBackend(t)
+	defer master.Close()
+	defer slave.Close()
+	c := newTestQueryConn(t, master, slave)
+	defer closeTestQueryConn(c)
+
+	//window模式: 写入之后window内的读走主库
+	c.readConsistency = readConsistency{mode: ReadConsistencyWindow, window: time.Minute}
+	if err := c.handleQuery("insert into test_table values (1)"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.handleQuery("select * from test_table"); err != nil {
+		t.Fatal(err)
+	}
+	if !hasQuery(master.Queries(), "select * from test_table") || hasQuery(slave.Queries(), "select * from test_table") {
+		t.Fatal("read after write within window must go to master")
+	}
+
+	//超过window之后回到从库
+	c.nodeWrites[c.schema.defaultNode].time = time.Now().Add(-2 * time.Minute)
+	if err := c.handleQuery("select id from test_table"); err != nil {
+		t.Fatal(err)
+	}
+	if !hasQuery(slave.Queries(), "select id from test_table") {
+		t.Fatal("read after window must go to slave", slave.Queries())
+	}
+}
+
+func TestShardConnsInitFail(t *testing.T) {
+	master, slave := newTestBackend(t), newTestBackend(t)
+	defer master.Close()
+	defer slave.Close()
+	c := newTestQueryConn(t, master, slave)
+	defer closeTestQueryConn(c)
+
+	//切换库失败时已取出的连接要归还连接池
+	n := c.schema.defaultNode
+	c.proxy.nodes = map[string]*proxyBack.Node{"node1": n}
+	c.db = testUnknownDB
+	plan := &router.Plan{Rule: &router.Rule{Nodes: []string{"node1"}}, RouteNodeIndexs: []int{0}}
+	if _, err := c.getShardConns(false, plan); err == nil {
+		t.Fatal("expect init db error")
+	}
+	if b := n.GetMaster().Borrowed(); b != 0 {
+		t.Fatal("master conn leaked", b)
+	}
+	if len(c.writeConns) != 0 {
+		t.Fatal("write conn not released", len(c.writeConns))
+	}
+}
+
+func TestSubTableConnsInitFail(t *testing.T) {
+	master, slave := newTestBackend(t), newTestBackend(t)
+	defer master.Close()
+	defer slave.Close()
+	c := newTestQueryConn(t, master, slave)
+	defer closeTestQueryConn(c)
+
+	//额外的子表连接初始化失败时归还, 由已有的连接顺序执行
+	n := c.schema.defaultNode
+	c.proxy.nodes = map[string]*proxyBack.Node{"node1": n}
+	c.db = testUnknownDB
+	plan := &router.Plan{RewrittenSqls: map[string][]string{"node1": {"select 1", "select 2"}}}
+	extraConns := c.getSubTableConns(true, plan)
+	if len(extraConns["node1"]) != 0 {
+		t.Fatal("expect no extra conns", extraConns)
+	}
+	if b := n.GetSlaves()[0].Borrowed(); b != 0 {
+		t.Fatal("slave conn leaked", b)
+	}
+	if b := n.GetMaster().Borrowed(); b != 0 {
+		t.Fatal("master conn leaked", b)
+	}
+}
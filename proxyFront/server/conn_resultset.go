@@ -0,0 +1,123 @@
+package server
+
+import (
+	f"fmt"
+	"brother/mysql"
+	"brother/core/hack"
+)
+
+/**
+ * ################################### proxy -> client resultset events ###########################################
+ */
+
+//把后端返回的mysql.Result转发给客户端: OK包或者完整的结果集
+func (c *ClientConn) writeResult(r *mysql.Result) error {
+	if r.Resultset == nil {
+		c.affectedRows = int64(r.AffectedRows)
+		if r.InsertId > 0 {
+			c.lastInsertId = int64(r.InsertId)
+		}
+		return c.writeOK(&mysql.Result{
+			Status:       c.status,
+			AffectedRows: r.AffectedRows,
+			InsertId:     r.InsertId,
+		})
+	}
+
+	return c.writeResultset(c.status, r.Resultset)
+}
+
+//column count, fields, EOF, rows, EOF
+func (c *ClientConn) writeResultset(status uint16, r *mysql.Resultset) error {
+	c.affectedRows = int64(-1)
+	total := make([]byte, 0, 4096)
+	data := make([]byte, 4, 512)
+	var err error
+
+	columnLen := mysql.PutLengthEncodedInt(uint64(len(r.Fields)))
+
+	data = append(data, columnLen...)
+	total, err = c.writePacketBatch(total, data, false)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range r.Fields {
+		data = data[0:4]
+		data = append(data, v.Dump()...)
+		total, err = c.writePacketBatch(total, data, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	total, err = c.writeEOFBatch(total, status, false)
+	if err != nil {
+		return err
+	}
+
+	for _, v := range r.RowDatas {
+		data = data[0:4]
+		data = append(data, v...)
+		total, err = c.writePacketBatch(total, data, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	total, err = c.writeEOFBatch(total, status, true)
+	total = nil
+	return err
+}
+
+//proxy自己生成的结果集, 字段类型由每列第一个非NULL的值决定
+func (c *ClientConn) buildResultset(names []string, values [][]interface{}) (*mysql.Resultset, error) {
+	r := new(mysql.Resultset)
+	r.Fields = make([]*mysql.Field, len(names))
+	r.FieldNames = make(map[string]int, len(names))
+
+	for _, row := range values {
+		if len(row) != len(names) {
+			return nil, f.Errorf("row length %d not equal to field count %d", len(row), len(names))
+		}
+	}
+
+	for i, name := range names {
+		field := &mysql.Field{Name: hack.Slice(name), Type: mysql.MYSQL_TYPE_NULL, Charset: 63}
+		//列的类型由第一个非NULL的值决定, 都是NULL时为MYSQL_TYPE_NULL
+		var value interface{}
+		for _, row := range values {
+			if row[i] != nil {
+				value = row[i]
+				break
+			}
+		}
+		switch value.(type) {
+		case nil:
+		case int8, int16, int32, int64, int:
+			field.Type = mysql.MYSQL_TYPE_LONGLONG
+			field.Flag = mysql.BINARY_FLAG
+		case uint8, uint16, uint32, uint64, uint:
+			field.Type = mysql.MYSQL_TYPE_LONGLONG
+			field.Flag = mysql.BINARY_FLAG | mysql.UNSIGNED_FLAG
+		case float32, float64:
+			field.Type = mysql.MYSQL_TYPE_DOUBLE
+			field.Flag = mysql.BINARY_FLAG
+		case string, []byte:
+			field.Type = mysql.MYSQL_TYPE_VAR_STRING
+			field.Charset = uint16(mysql.DEFAULT_COLLATION_ID)
+		default:
+			return nil, f.Errorf("invalid value type %T for column %s", value, name)
+		}
+		r.Fields[i] = field
+		r.FieldNames[name] = i
+	}
+
+	r.Values = make([][]interface{}, len(values))
+	r.RowDatas = make([]mysql.RowData, len(values))
+	for i, row := range values {
+		r.Values[i] = row
+		r.RowDatas[i] = buildRowData(row)
+	}
+	return r, nil
+}
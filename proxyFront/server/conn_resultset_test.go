@@ -0,0 +1,42 @@
+package server
+
+import (
+	"testing"
+
+	"brother/mysql"
+)
+
+func TestBuildResultsetType(t *testing.T) {
+	c := new(ClientConn)
+	names := []string{"id", "unsigned", "ratio", "name", "empty"}
+	r, err := c.buildResultset(names, [][]interface{}{
+		{nil, nil, nil, nil, nil},
+		{int64(1), uint64(2), 0.5, "a", nil},
+		{int64(3), nil, nil, []byte("b"), nil},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//列的类型由第一个非NULL的值决定
+	types := []uint8{mysql.MYSQL_TYPE_LONGLONG, mysql.MYSQL_TYPE_LONGLONG, mysql.MYSQL_TYPE_DOUBLE,
+		mysql.MYSQL_TYPE_VAR_STRING, mysql.MYSQL_TYPE_NULL}
+	for i, field := range r.Fields {
+		if field.Type != types[i] {
+			t.Fatalf("column %s type %d", names[i], field.Type)
+		}
+	}
+	if r.Fields[1].Flag&mysql.UNSIGNED_FLAG == 0 {
+		t.Fatal(r.Fields[1].Flag)
+	}
+	if r.FieldNames["name"] != 3 || len(r.RowDatas) != 3 {
+		t.Fatal(r.FieldNames, len(r.RowDatas))
+	}
+
+	if _, err := c.buildResultset(names, [][]interface{}{{int64(1)}}); err == nil {
+		t.Fatal("row length must equal to field count")
+	}
+	if _, err := c.buildResultset([]string{"v"}, [][]interface{}{{struct{}{}}}); err == nil {
+		t.Fatal("invalid value type must fail")
+	}
+}
@@ -0,0 +1,141 @@
+package server
+
+import (
+	"strconv"
+	"strings"
+
+	"brother/core/errors"
+	"brother/core/hack"
+	"brother/mysql"
+	"brother/proxyFront/router"
+	"brother/sqlparser"
+)
+
+/**
+ * ################################### 跨分表select结果集合并 ###########################################
+ */
+
+//合并各子表的结果集, 再按order by排序, 最后截取limit
+func (c *ClientConn) mergeSelectResult(rs []*mysql.Result, stmt *sqlparser.Select, m *router.SelectMerge) error {
+	r, err := c.buildSelectResult(rs)
+	if err != nil {
+		return err
+	}
+
+	if m != nil {
+		return c.mergeAggregateResult(r, m)
+	}
+
+	if err = c.sortSelectResult(r.Resultset, stmt); err != nil {
+		return err
+	}
+
+	if err = c.limitSelectResult(r.Resultset, stmt); err != nil {
+		return err
+	}
+
+	return c.writeResultset(c.status|r.Status, r.Resultset)
+}
+
+//以第一个结果集的字段为准, 依次追加其他结果集的行
+func (c *ClientConn) buildSelectResult(rs []*mysql.Result) (*mysql.Result, error) {
+	if len(rs) == 0 || rs[0] == nil || rs[0].Resultset == nil {
+		return nil, errors.ErrResultNil
+	}
+
+	r := rs[0]
+	for i := 1; i < len(rs); i++ {
+		if rs[i] == nil || rs[i].Resultset == nil {
+			return nil, errors.ErrResultNil
+		}
+		r.Status |= rs[i].Status
+		r.Values = append(r.Values, rs[i].Values...)
+		r.RowDatas = append(r.RowDatas, rs[i].RowDatas...)
+	}
+
+	return r, nil
+}
+
+//select *时router没有生成合并信息, 按结果集的字段名(不区分大小写)或者位置找到排序列
+func (c *ClientConn) sortSelectResult(r *mysql.Resultset, stmt *sqlparser.Select) error {
+	if len(stmt.OrderBy) == 0 {
+		return nil
+	}
+
+	orderBy := make([]*router.OrderColumn, len(stmt.OrderBy))
+	for i, o := range stmt.OrderBy {
+		index, err := orderByIndex(r, o.Expr)
+		if err != nil {
+			return err
+		}
+		orderBy[i] = &router.OrderColumn{Index: index, Direction: o.Direction}
+	}
+
+	return c.sortResultset(r, orderBy)
+}
+
+func orderByIndex(r *mysql.Resultset, expr sqlparser.ValExpr) (int, error) {
+	if v, ok := expr.(sqlparser.NumVal); ok {
+		pos, err := strconv.Atoi(string(v))
+		if err != nil || pos < 1 || len(r.Fields) < pos {
+			return -1, errors.ErrOrderByColumn
+		}
+		return pos - 1, nil
+	}
+
+	//结果集中的字段名不带表名前缀
+	name := sqlparser.String(expr)
+	if col, ok := expr.(*sqlparser.ColName); ok {
+		name = string(col.Name)
+	}
+	for i, field := range r.Fields {
+		if strings.EqualFold(string(field.Name), name) {
+			return i, nil
+		}
+	}
+	return -1, errors.ErrOrderByColumn
+}
+
+func (c *ClientConn) limitSelectResult(r *mysql.Resultset, stmt *sqlparser.Select) error {
+	return c.limitResultset(r, stmt.Limit)
+}
+
+//按原始语句的limit截取合并之后的结果集
+func (c *ClientConn) limitResultset(r *mysql.Resultset, limit *sqlparser.Limit) error {
+	if limit == nil {
+		return nil
+	}
+
+	offset, err := limitValue(limit.Offset)
+	if err != nil {
+		return err
+	}
+	count, err := limitValue(limit.Rowcount)
+	if err != nil {
+		return err
+	}
+
+	total := int64(len(r.Values))
+	if offset > total {
+		offset = total
+	}
+	if offset+count > total {
+		count = total - offset
+	}
+
+	r.Values = r.Values[offset : offset+count]
+	r.RowDatas = r.RowDatas[offset : offset+count]
+	return nil
+}
+
+func limitValue(expr sqlparser.ValExpr) (int64, error) {
+	if expr == nil {
+		return 0, nil
+	}
+
+	v, ok := expr.(sqlparser.NumVal)
+	if !ok {
+		return 0, errors.ErrExprConvert
+	}
+	return strconv.ParseInt(hack.String([]byte(v)), 10, 64)
+}
@@ -0,0 +1,42 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"brother/mysql"
+	"brother/sqlparser"
+)
+
+func TestSortSelectResult(t *testing.T) {
+	stmt, err := sqlparser.Parse("select * from test_shard_hash order by ID desc limit 1, 2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sel := stmt.(*sqlparser.Select)
+
+	//两个子表的结果集按顺序拼接
+	r := testMergeResultset(t, []string{"id", "name"}, [][]interface{}{
+		{int64(3), "c"},
+		{int64(1), "a"},
+		{int64(4), "d"},
+		{int64(2), "b"},
+	})
+	c := new(ClientConn)
+	if err = c.sortSelectResult(r, sel); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.limitSelectResult(r, sel); err != nil {
+		t.Fatal(err)
+	}
+
+	values := [][]interface{}{{int64(3), "c"}, {int64(2), "b"}}
+	if !reflect.DeepEqual(r.Values, values) {
+		t.Fatal(r.Values)
+	}
+	//写回客户端的是RowDatas, 必须和Values一起排序
+	rowDatas := []mysql.RowData{buildRowData(values[0]), buildRowData(values[1])}
+	if !reflect.DeepEqual(r.RowDatas, rowDatas) {
+		t.Fatal(r.RowDatas)
+	}
+}
@@ -0,0 +1,137 @@
+package server
+
+import (
+	f "fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"brother/mysql"
+	"brother/sqlparser"
+)
+
+/**
+ * ################################### 全局序列 ###########################################
+ */
+
+//解析器不支持NEXT VALUE FOR语法, 按字符串匹配
+var nextValueRegexp = regexp.MustCompile(`(?i)^\s*select\s+(next\s+value\s+for\s+([\w$]+))\s*$`)
+
+func parseNextValue(sql string) (expr string, name string, ok bool) {
+	m := nextValueRegexp.FindStringSubmatch(sql)
+	if m == nil {
+		return "", "", false
+	}
+	return m[1], m[2], true
+}
+
+//SELECT NEXT VALUE FOR seq_name
+func (c *ClientConn) handleNextValue(expr string, name string) error {
+	seq := c.proxy.GetSequence(name)
+	if seq == nil {
+		return mysql.NewError(mysql.ER_UNKNOWN_ERROR, f.Sprintf("unknown sequence '%s'", name))
+	}
+
+	id, err := seq.Next()
+	if err != nil {
+		return err
+	}
+
+	r, err := c.buildResultset([]string{expr}, [][]interface{}{{id}})
+	if err != nil {
+		return err
+	}
+	return c.writeResultset(c.status, r)
+}
+
+//分表的insert/replace没有给出分片键时, 用规则配置的序列为每一行生成分片键
+//返回第一行生成的id, 没有生成时返回0
+func (c *ClientConn) fillSequence(stmt sqlparser.Statement) (uint64, error) {
+	if c.schema == nil || c.schema.rule == nil {
+		return 0, nil
+	}
+
+	var table *sqlparser.TableName
+	var columns *sqlparser.Columns
+	var rows sqlparser.InsertRows
+	switch v := stmt.(type) {
+	case *sqlparser.Insert:
+		table, columns, rows = v.Table, &v.Columns, v.Rows
+	case *sqlparser.Replace:
+		table, columns, rows = v.Table, &v.Columns, v.Rows
+	default:
+		return 0, nil
+	}
+
+	rule := c.schema.rule.GetRule(c.db, table)
+	if len(rule.Sequence) == 0 || *columns == nil {
+		return 0, nil
+	}
+	for _, col := range *columns {
+		expr, ok := col.(*sqlparser.NonStarExpr)
+		if ok && strings.ToLower(sqlparser.GetColName(expr.Expr)) == rule.Key {
+			return 0, nil
+		}
+	}
+	vals, ok := rows.(sqlparser.Values)
+	if !ok {
+		return 0, nil
+	}
+
+	seq := c.proxy.GetSequence(rule.Sequence)
+	if seq == nil {
+		return 0, mysql.NewError(mysql.ER_UNKNOWN_ERROR, f.Sprintf("unknown sequence '%s'", rule.Sequence))
+	}
+
+	var firstId uint64
+	for i := range vals {
+		tuple, ok := vals[i].(sqlparser.ValTuple)
+		if !ok {
+			return 0, nil
+		}
+		id, err := seq.Next()
+		if err != nil {
+			return 0, err
+		}
+		if i == 0 {
+			firstId = uint64(id)
+		}
+		vals[i] = append(tuple, sqlparser.NumVal(strconv.FormatInt(id, 10)))
+	}
+	*columns = append(*columns, &sqlparser.NonStarExpr{Expr: &sqlparser.ColName{Name: []byte(rule.Key)}})
+
+	return firstId, nil
+}
+
+//LAST_INSERT_ID()由proxy返回: 语句可能被发往不同的后端连接, 后端的值不可靠
+func (c *ClientConn) isLastInsertId(stmt *sqlparser.SimpleSelect) (string, bool) {
+	if len(stmt.SelectExprs) != 1 {
+		return "", false
+	}
+	expr, ok := stmt.SelectExprs[0].(*sqlparser.NonStarExpr)
+	if !ok {
+		return "", false
+	}
+	fun, ok := expr.Expr.(*sqlparser.FuncExpr)
+	if !ok || len(fun.Exprs) != 0 || strings.ToLower(string(fun.Name)) != "last_insert_id" {
+		return "", false
+	}
+
+	if expr.As != nil {
+		return string(expr.As), true
+	}
+	return "last_insert_id()", true
+}
+
+func (c *ClientConn) handleSimpleSelect(stmt *sqlparser.SimpleSelect, sql string) error {
+	name, ok := c.isLastInsertId(stmt)
+	if !ok {
+		return c.handleSelect(stmt, sql, nil)
+	}
+
+	r, err := c.buildResultset([]string{name}, [][]interface{}{{uint64(c.lastInsertId)}})
+	if err != nil {
+		return err
+	}
+	return c.writeResultset(c.status, r)
+}
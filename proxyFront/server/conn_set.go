@@ -0,0 +1,219 @@
+package server
+
+import (
+	"brother/core/golog"
+	"brother/mysql"
+	"brother/sqlparser"
+	f "fmt"
+	"strings"
+)
+
+//允许客户端设置并在后端连接上重放的会话变量
+var allowedSysVars = map[string]bool{
+	"sql_mode":			true,
+	"time_zone":			true,
+	"tx_isolation":			true,
+	"transaction_isolation":	true,
+	"tx_read_only":			true,
+	"transaction_read_only":	true,
+	"sql_safe_updates":		true,
+	"sql_select_limit":		true,
+	"sql_auto_is_null":		true,
+	"sql_big_selects":		true,
+	"max_join_size":		true,
+	"max_execution_time":		true,
+	"group_concat_max_len":		true,
+	"div_precision_increment":	true,
+	"foreign_key_checks":		true,
+	"unique_checks":		true,
+	"lc_time_names":		true,
+}
+
+/**
+ * ################################### handle SET statement ###########################################
+ */
+func (c *ClientConn) handleSet(stmt *sqlparser.Set, sql string) error {
+	if len(stmt.Exprs) == 0 {
+		return f.Errorf("must set one item at least, not %s", sqlparser.String(stmt))
+	}
+
+	//SET NAMES 'charset_name' COLLATE 'collation_name'
+	if len(stmt.Exprs) == 2 && string(stmt.Exprs[1].Name.Name) == "collate" {
+		if err := c.setNames(stmt.Exprs[0].Expr, stmt.Exprs[1].Expr); err != nil {
+			return err
+		}
+		return c.writeOK(nil)
+	}
+
+	//先检查所有变量, 有不支持的变量时整个SET都不执行
+	names := make([]string, 0, len(stmt.Exprs))
+	for _, expr := range stmt.Exprs {
+		name, err := sysVarName(expr.Name)
+		if err != nil {
+			return err
+		}
+		if !isSupportedVar(name) {
+			golog.Warn("ClientConn", "handleSet", "variable not supported", c.connectionId, "sql", sql)
+			return mysql.NewError(mysql.ER_NOT_SUPPORTED_YET,
+				f.Sprintf("variable %s can not be set through brother", name))
+		}
+		names = append(names, name)
+	}
+
+	//先修改可以恢复的会话状态, 出错时全部恢复; autocommit从0改为1会提交事务, 不能恢复, 所以最后设置
+	charset, collation, rc, oldVars := c.charset, c.collation, c.readConsistency, c.sysVars
+	restore := func() {
+		c.charset, c.collation, c.readConsistency, c.sysVars = charset, collation, rc, oldVars
+	}
+
+	vars := make(map[string]string)
+	for k, v := range c.sysVars {
+		vars[k] = v
+	}
+	varsChanged := false
+	var autoCommits []bool
+
+	for i, expr := range stmt.Exprs {
+		var err error
+		name := names[i]
+		switch name {
+		case "autocommit":
+			var on bool
+			if on, err = parseAutoCommit(expr.Expr); err == nil {
+				autoCommits = append(autoCommits, on)
+			}
+		case "names", "character_set_results", "character_set_client", "character_set_connection":
+			err = c.setNames(expr.Expr, nil)
+		case sessionReadConsistency, sessionReadWindow:
+			err = c.setReadConsistency(name, expr.Expr)
+		default:
+			vars[name] = sqlparser.String(expr.Expr)
+			varsChanged = true
+		}
+		if err != nil {
+			restore()
+			return err
+		}
+	}
+
+	if varsChanged {
+		if err := c.setSysVars(vars); err != nil {
+			restore()
+			return err
+		}
+	}
+
+	for _, on := range autoCommits {
+		if err := c.setAutoCommit(on); err != nil {
+			restore()
+			return err
+		}
+	}
+
+	return c.writeOK(nil)
+}
+
+//用户变量(@x)不会在后端连接上重放, 也不支持
+func isSupportedVar(name string) bool {
+	switch name {
+	case "autocommit", "names", "character_set_results", "character_set_client", "character_set_connection",
+		sessionReadConsistency, sessionReadWindow:
+		return true
+	}
+	return allowedSysVars[name]
+}
+
+//去掉@@、@@session.等前缀, 返回小写的变量名
+func sysVarName(col *sqlparser.ColName) (string, error) {
+	qualifier := strings.ToLower(string(col.Qualifier))
+	name := strings.ToLower(string(col.Name))
+
+	switch qualifier {
+	case "", "@@session", "@@local", "session", "local":
+	default:
+		return "", f.Errorf("can not set variable %s.%s through proxy", qualifier, name)
+	}
+
+	//user variable keeps the single @ prefix
+	return strings.TrimPrefix(name, "@@"), nil
+}
+
+func parseAutoCommit(val sqlparser.ValExpr) (bool, error) {
+	value := strings.ToLower(strings.Trim(sqlparser.String(val), "'`\""))
+
+	switch value {
+	case "1", "on", "true":
+		return true, nil
+	case "0", "off", "false":
+		return false, nil
+	default:
+		return false, mysql.NewDefaultError(mysql.ER_WRONG_VALUE_FOR_VAR, "autocommit", value)
+	}
+}
+
+func (c *ClientConn) setAutoCommit(on bool) error {
+	if !on {
+		c.status &= ^mysql.SERVER_STATUS_AUTOCOMMIT
+		return nil
+	}
+
+	//autocommit已经是1时不影响BEGIN开启的事务
+	if c.isAutoCommit() {
+		return nil
+	}
+	//从0改为1会隐式提交当前事务, 提交失败时autocommit保持不变
+	if err := c.commit(); err != nil {
+		return err
+	}
+	c.status |= mysql.SERVER_STATUS_AUTOCOMMIT
+	return nil
+}
+
+func (c *ClientConn) setNames(ch, ci sqlparser.ValExpr) error {
+	var cid mysql.CollationId
+	var ok bool
+
+	charset := strings.ToLower(strings.Trim(sqlparser.String(ch), "'`\""))
+	if charset == "null" {
+		return nil
+	}
+	if charset == "default" {
+		charset = mysql.DEFAULT_CHARSET
+	}
+
+	if ci == nil {
+		cid, ok = mysql.CharsetIds[charset]
+		if !ok {
+			return f.Errorf("invalid charset %s", charset)
+		}
+	} else {
+		collate := strings.ToLower(strings.Trim(sqlparser.String(ci), "'`\""))
+		cid, ok = mysql.CollationNames[collate]
+		if !ok {
+			return f.Errorf("invalid collation %s", collate)
+		}
+	}
+
+	c.charset = charset
+	c.collation = cid
+	return nil
+}
+
+//先在一个后端连接上执行一次, 值不合法时直接把错误返回给客户端
+func (c *ClientConn) setSysVars(vars map[string]string) error {
+	n, err := c.getDefaultNode()
+	if err != nil {
+		return err
+	}
+
+	old := c.sysVars
+	c.sysVars = vars
+
+	co, err := c.getBackendConn(n, true)
+	defer c.closeConn(co, false)
+	if err != nil {
+		c.sysVars = old
+		return err
+	}
+	return nil
+}
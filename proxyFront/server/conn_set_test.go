@@ -0,0 +1,40 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestSetAtomic(t *testing.T) {
+	master, slave := newTestBackend(t), newTestBackend(t)
+	defer master.Close()
+	defer slave.Close()
+	c := newTestQueryConn(t, master, slave)
+	defer closeTestQueryConn(c)
+
+	//有一项的值不合法时整个SET都不生效
+	charset := c.charset
+	if err := c.handleQuery("set character_set_client = 'latin1', autocommit = 'bad'"); err == nil {
+		t.Fatal("invalid autocommit must fail")
+	}
+	if c.charset != charset || !c.isAutoCommit() {
+		t.Fatal(c.charset, c.isAutoCommit())
+	}
+
+	//后端拒绝会话变量时, 之前的读一致性和autocommit也不修改
+	if err := c.handleQuery("set brother_read_consistency = 'window', autocommit = 0, sql_mode = '" + testBadValue + "'"); err == nil {
+		t.Fatal("invalid sql_mode must fail")
+	}
+	if c.readConsistency.mode != ReadConsistencyNone || !c.isAutoCommit() {
+		t.Fatal(c.readConsistency, c.isAutoCommit())
+	}
+	if _, ok := c.sysVars["sql_mode"]; ok {
+		t.Fatal(c.sysVars)
+	}
+
+	if err := c.handleQuery("set character_set_client = 'latin1', autocommit = 0, sql_mode = 'ansi'"); err != nil {
+		t.Fatal(err)
+	}
+	if c.charset != "latin1" || c.isAutoCommit() || c.sysVars["sql_mode"] != "'ansi'" {
+		t.Fatal(c.charset, c.isAutoCommit(), c.sysVars)
+	}
+}
@@ -1,7 +1,31 @@
 package server
 
-import "brother/sqlparser"
+import (
+	"brother/sqlparser"
+	"brother/mysql"
+	"brother/proxyBack"
+	"brother/core/errors"
+	"brother/core/golog"
+	"encoding/binary"
+	"strings"
+	"strconv"
+	"math"
+	"time"
+	f"fmt"
+)
 
+var paramFieldData []byte
+var columnFieldData []byte
+
+func init() {
+	var p = &mysql.Field{Name: []byte("?")}
+	var c = &mysql.Field{}
+
+	paramFieldData = p.Dump()
+	columnFieldData = c.Dump()
+}
+
+//client端到proxy的prepare语句, 执行时在后端重新prepare
 type Stmt struct {
 	id 				uint32
 
@@ -9,7 +33,591 @@ type Stmt struct {
 	columns				int
 
 	args				[]interface{}
+	//上一次execute绑定的参数类型, new-params-bound-flag为0时沿用
+	paramTypes			[]byte
+	//通过COM_STMT_SEND_LONG_DATA发送的参数
+	longData			[]bool
 
 	s				sqlparser.Statement
 	sql				string
+	//master提示: 读也走主库
+	master				bool
+}
+
+func (s *Stmt) ResetParams() {
+	s.args = make([]interface{}, s.params)
+	s.longData = make([]bool, s.params)
+}
+
+func stmtNotFound(id uint32, cmd string) error {
+	idStr := strconv.FormatUint(uint64(id), 10)
+	return mysql.NewDefaultError(mysql.ER_UNKNOWN_STMT_HANDLER, len(idStr), idStr, cmd)
+}
+
+/**
+ * ################################### COM_STMT_PREPARE ###########################################
+ */
+func (c *ClientConn) handleStmtPrepare(sql string) error {
+	if c.schema == nil {
+		return mysql.NewDefaultError(mysql.ER_NO_DB_ERROR)
+	}
+
+	s := new(Stmt)
+
+	sql = strings.TrimRight(sql, ";")
+
+	var err error
+	s.s, err = sqlparser.Parse(sql)
+	if err != nil {
+		return f.Errorf(`parse sql "%s" error`, sql)
+	}
+
+	if s.sql, s.master, err = c.checkStmtRoute(s.s, sql); err != nil {
+		return err
+	}
+
+	n, err := c.getDefaultNode()
+	if err != nil {
+		return err
+	}
+
+	co, err := c.getBackendConn(n, false)
+	defer c.closeConn(co, false)
+	if err != nil {
+		return f.Errorf("prepare error %s", err)
+	}
+
+	//后端的stmt缓存在连接上, execute时同一个连接不需要再次prepare
+	t, err := co.PrepareCached(s.sql)
+	if err != nil {
+		return err
+	}
+	s.params = t.ParamNum()
+	s.columns = t.ColumnNum()
+
+	s.id = c.stmtId
+	c.stmtId++
+
+	if err = c.writePrepare(s); err != nil {
+		return err
+	}
+
+	s.ResetParams()
+	c.stmts[s.id] = s
+
+	return nil
+}
+
+//prepare的语句在execute时才有参数, 无法按分表规则路由, 只支持默认节点上的表
+//返回去掉路由提示之后的sql
+func (c *ClientConn) checkStmtRoute(stmt sqlparser.Statement, sql string) (string, bool, error) {
+	hint, sql, err := c.parseHint(stmt, sql)
+	if err != nil {
+		return sql, false, err
+	}
+	if hint != nil && hint.IsDirect() {
+		return sql, false, errors.ErrStmtRoute
+	}
+
+	switch stmt.(type) {
+	case *sqlparser.Select, *sqlparser.Insert, *sqlparser.Update, *sqlparser.Delete, *sqlparser.Replace:
+		//默认规则的表直接返回, 出错说明语句用到了分表或全局表
+		plan, err := c.buildPlan(stmt)
+		if err != nil || plan != nil {
+			return sql, false, errors.ErrStmtRoute
+		}
+	}
+	return sql, hint != nil && hint.Master, nil
+}
+
+func (c *ClientConn) writePrepare(s *Stmt) error {
+	data := make([]byte, 4, 128)
+	total := make([]byte, 0, 1024)
+
+	//status ok
+	data = append(data, 0)
+	//stmt id
+	data = append(data, mysql.Uint32ToBytes(s.id)...)
+	//number columns
+	data = append(data, mysql.Uint16ToBytes(uint16(s.columns))...)
+	//number params
+	data = append(data, mysql.Uint16ToBytes(uint16(s.params))...)
+	//filter [00]
+	data = append(data, 0)
+	//warning count
+	data = append(data, 0, 0)
+
+	total, err := c.writePacketBatch(total, data, false)
+	if err != nil {
+		return err
+	}
+
+	if s.params > 0 {
+		for i := 0; i < s.params; i++ {
+			data = data[0:4]
+			data = append(data, paramFieldData...)
+
+			total, err = c.writePacketBatch(total, data, false)
+			if err != nil {
+				return err
+			}
+		}
+
+		total, err = c.writeEOFBatch(total, c.status, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	if s.columns > 0 {
+		for i := 0; i < s.columns; i++ {
+			data = data[0:4]
+			data = append(data, columnFieldData...)
+
+			total, err = c.writePacketBatch(total, data, false)
+			if err != nil {
+				return err
+			}
+		}
+
+		total, err = c.writeEOFBatch(total, c.status, false)
+		if err != nil {
+			return err
+		}
+	}
+
+	total, err = c.writePacketBatch(total, nil, true)
+	total = nil
+	return err
+}
+
+/**
+ * ################################### COM_STMT_EXECUTE ###########################################
+ */
+func (c *ClientConn) handleStmtExecute(data []byte) error {
+	s, err := c.parseStmtExecute(data)
+	if err != nil {
+		return err
+	}
+
+	switch stmt := s.s.(type) {
+	case *sqlparser.Select:
+		err = c.handlePrepareSelect(stmt, s.sql, s.args, !s.master)
+	case *sqlparser.SimpleSelect:
+		err = c.handlePrepareSelect(stmt, s.sql, s.args, !s.master)
+	case *sqlparser.Insert:
+		err = c.handlePrepareExec(stmt, s.sql, s.args)
+	case *sqlparser.Update:
+		err = c.handlePrepareExec(stmt, s.sql, s.args)
+	case *sqlparser.Delete:
+		err = c.handlePrepareExec(stmt, s.sql, s.args)
+	case *sqlparser.Replace:
+		err = c.handlePrepareExec(stmt, s.sql, s.args)
+	default:
+		err = f.Errorf("command %T not supported now", stmt)
+	}
+
+	s.ResetParams()
+
+	return err
+}
+
+//解析COM_STMT_EXECUTE包并绑定参数到s.args
+func (c *ClientConn) parseStmtExecute(data []byte) (*Stmt, error) {
+	if len(data) < 9 {
+		return nil, mysql.ErrMalformPacket
+	}
+
+	pos := 0
+	id := binary.LittleEndian.Uint32(data[0:4])
+	pos += 4
+
+	s, ok := c.stmts[id]
+	if !ok {
+		return nil, stmtNotFound(id, "stmt_execute")
+	}
+
+	flag := data[pos]
+	pos++
+	//now we only support CURSOR_TYPE_NO_CURSOR flag
+	if flag != 0 {
+		return nil, mysql.NewError(mysql.ER_UNKNOWN_ERROR, f.Sprintf("unsupported flag %d", flag))
+	}
+
+	//skip iteration-count, always 1
+	pos += 4
+
+	var nullBitmaps []byte
+	var paramValues []byte
+
+	paramNum := s.params
+
+	if paramNum > 0 {
+		nullBitmapLen := (paramNum + 7) >> 3
+		if len(data) < (pos + nullBitmapLen + 1) {
+			return nil, mysql.ErrMalformPacket
+		}
+		nullBitmaps = data[pos : pos + nullBitmapLen]
+		pos += nullBitmapLen
+
+		//new-params-bound-flag
+		if data[pos] == 1 {
+			pos++
+			if len(data) < (pos + (paramNum << 1)) {
+				return nil, mysql.ErrMalformPacket
+			}
+
+			s.paramTypes = append(s.paramTypes[:0], data[pos : pos + (paramNum << 1)]...)
+			pos += paramNum << 1
+		} else {
+			pos++
+			if len(s.paramTypes) != paramNum << 1 {
+				//第一次execute必须带上参数类型
+				return nil, mysql.ErrMalformPacket
+			}
+		}
+
+		paramValues = data[pos:]
+
+		if err := c.bindStmtArgs(s, nullBitmaps, s.paramTypes, paramValues); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+func (c *ClientConn) bindStmtArgs(s *Stmt, nullBitmap, paramTypes, paramValues []byte) error {
+	args := s.args
+
+	pos := 0
+
+	var v []byte
+	var n int = 0
+	var isNull bool
+	var err error
+
+	for i := 0; i < s.params; i++ {
+		//long data的值不在execute包中
+		if s.longData[i] {
+			continue
+		}
+
+		if nullBitmap[i>>3]&(1<<(uint(i)%8)) > 0 {
+			args[i] = nil
+			continue
+		}
+
+		tp := paramTypes[i<<1]
+		isUnsigned := (paramTypes[(i<<1)+1] & 0x80) > 0
+
+		switch tp {
+		case mysql.MYSQL_TYPE_NULL:
+			args[i] = nil
+			continue
+
+		case mysql.MYSQL_TYPE_TINY:
+			if len(paramValues) < (pos + 1) {
+				return mysql.ErrMalformPacket
+			}
+
+			if isUnsigned {
+				args[i] = uint8(paramValues[pos])
+			} else {
+				args[i] = int8(paramValues[pos])
+			}
+
+			pos++
+			continue
+
+		case mysql.MYSQL_TYPE_SHORT, mysql.MYSQL_TYPE_YEAR:
+			if len(paramValues) < (pos + 2) {
+				return mysql.ErrMalformPacket
+			}
+
+			if isUnsigned {
+				args[i] = uint16(binary.LittleEndian.Uint16(paramValues[pos : pos+2]))
+			} else {
+				args[i] = int16(binary.LittleEndian.Uint16(paramValues[pos : pos+2]))
+			}
+			pos += 2
+			continue
+
+		case mysql.MYSQL_TYPE_INT24, mysql.MYSQL_TYPE_LONG:
+			if len(paramValues) < (pos + 4) {
+				return mysql.ErrMalformPacket
+			}
+
+			if isUnsigned {
+				args[i] = uint32(binary.LittleEndian.Uint32(paramValues[pos : pos+4]))
+			} else {
+				args[i] = int32(binary.LittleEndian.Uint32(paramValues[pos : pos+4]))
+			}
+			pos += 4
+			continue
+
+		case mysql.MYSQL_TYPE_LONGLONG:
+			if len(paramValues) < (pos + 8) {
+				return mysql.ErrMalformPacket
+			}
+
+			if isUnsigned {
+				args[i] = binary.LittleEndian.Uint64(paramValues[pos : pos+8])
+			} else {
+				args[i] = int64(binary.LittleEndian.Uint64(paramValues[pos : pos+8]))
+			}
+			pos += 8
+			continue
+
+		case mysql.MYSQL_TYPE_FLOAT:
+			if len(paramValues) < (pos + 4) {
+				return mysql.ErrMalformPacket
+			}
+
+			args[i] = math.Float32frombits(binary.LittleEndian.Uint32(paramValues[pos : pos+4]))
+			pos += 4
+			continue
+
+		case mysql.MYSQL_TYPE_DOUBLE:
+			if len(paramValues) < (pos + 8) {
+				return mysql.ErrMalformPacket
+			}
+
+			args[i] = math.Float64frombits(binary.LittleEndian.Uint64(paramValues[pos : pos+8]))
+			pos += 8
+			continue
+
+		case mysql.MYSQL_TYPE_DECIMAL, mysql.MYSQL_TYPE_NEWDECIMAL, mysql.MYSQL_TYPE_VARCHAR,
+			mysql.MYSQL_TYPE_BIT, mysql.MYSQL_TYPE_ENUM, mysql.MYSQL_TYPE_SET, mysql.MYSQL_TYPE_TINY_BLOB,
+			mysql.MYSQL_TYPE_MEDIUM_BLOB, mysql.MYSQL_TYPE_LONG_BLOB, mysql.MYSQL_TYPE_BLOB,
+			mysql.MYSQL_TYPE_VAR_STRING, mysql.MYSQL_TYPE_STRING, mysql.MYSQL_TYPE_GEOMETRY:
+			v, isNull, n, err = stmtLengthEncodedString(paramValues[pos:])
+			if err != nil {
+				return err
+			}
+			pos += n
+
+			if !isNull {
+				args[i] = v
+			} else {
+				args[i] = nil
+			}
+			continue
+
+		case mysql.MYSQL_TYPE_DATE, mysql.MYSQL_TYPE_NEWDATE,
+			mysql.MYSQL_TYPE_TIMESTAMP, mysql.MYSQL_TYPE_DATETIME:
+			if len(paramValues) < (pos + 1) {
+				return mysql.ErrMalformPacket
+			}
+
+			//length [1 byte], value [length bytes]
+			num := int(paramValues[pos])
+			pos++
+			if len(paramValues) < (pos + num) {
+				return mysql.ErrMalformPacket
+			}
+
+			args[i], err = mysql.FormatBinaryDateTime(num, paramValues[pos:])
+			pos += num
+			if err != nil {
+				return err
+			}
+			continue
+
+		case mysql.MYSQL_TYPE_TIME:
+			if len(paramValues) < (pos + 1) {
+				return mysql.ErrMalformPacket
+			}
+
+			num := int(paramValues[pos])
+			pos++
+			if len(paramValues) < (pos + num) {
+				return mysql.ErrMalformPacket
+			}
+
+			args[i], err = mysql.FormatBinaryTime(num, paramValues[pos:])
+			pos += num
+			if err != nil {
+				return err
+			}
+			continue
+
+		default:
+			return f.Errorf("Stmt Unknown FieldType %d", tp)
+		}
+	}
+	return nil
+}
+
+//客户端发来的长度编码字符串, 长度或者数据不完整时返回错误, 不能越界
+func stmtLengthEncodedString(b []byte) ([]byte, bool, int, error) {
+	if len(b) < 1 {
+		return nil, false, 0, mysql.ErrMalformPacket
+	}
+
+	var size int
+	switch b[0] {
+	case 0xfb:
+		return nil, true, 1, nil
+	case 0xfc:
+		size = 3
+	case 0xfd:
+		size = 4
+	case 0xfe:
+		size = 9
+	default:
+		size = 1
+	}
+	if len(b) < size {
+		return nil, false, 0, mysql.ErrMalformPacket
+	}
+
+	num, _, n := mysql.LengthEncodedInt(b)
+	if num > uint64(len(b)-n) {
+		return nil, false, 0, mysql.ErrMalformPacket
+	}
+	return b[n : n+int(num)], false, n + int(num), nil
+}
+
+//prepare的select只走默认节点, 结果集以二进制协议返回
+func (c *ClientConn) handlePrepareSelect(stmt sqlparser.Statement, sql string, args []interface{}, fromSlave bool) error {
+	n, err := c.getDefaultNode()
+	if err != nil {
+		return err
+	}
+
+	//choose connection in slave DB first
+	conn, err := c.getBackendConn(n, fromSlave)
+	defer c.closeConn(conn, false)
+	if err != nil {
+		return err
+	}
+
+	r, err := c.executeStmtInNode(conn, sql, args)
+	if err != nil {
+		golog.Error("ClientConn", "handlePrepareSelect", err.Error(), c.connectionId)
+		return err
+	}
+
+	return c.writeResult(r)
+}
+
+func (c *ClientConn) handlePrepareExec(stmt sqlparser.Statement, sql string, args []interface{}) error {
+	n, err := c.getDefaultNode()
+	if err != nil {
+		return err
+	}
+
+	conn, err := c.getBackendConn(n, false)
+	defer c.closeConn(conn, false)
+	if err != nil {
+		return err
+	}
+
+	r, err := c.executeStmtInNode(conn, sql, args)
+	if err != nil {
+		golog.Error("ClientConn", "handlePrepareExec", err.Error(), c.connectionId)
+		return err
+	}
+
+	return c.writeResult(r)
+}
+
+//通过后端的Prepare/Execute执行, 保证返回的行是二进制协议; 连接上已经prepare过的语句直接execute
+func (c *ClientConn) executeStmtInNode(conn *proxyBack.BackendConn, sql string, args []interface{}) (*mysql.Result, error) {
+	var state string
+
+	startTime := time.Now().UnixNano()
+	s, err := conn.PrepareCached(sql)
+	var r *mysql.Result
+	if err == nil {
+		r, err = s.Execute(args...)
+	}
+	if err != nil {
+		state = "ERROR"
+	} else {
+		state = "OK"
+	}
+	execTime := float64(time.Now().UnixNano() - startTime) / float64(time.Millisecond)
+
+	if c.proxy.logSql[c.proxy.logSqlIndex] != golog.LogSqlOff &&
+		execTime >= float64(c.proxy.slowLogTime[c.proxy.slowLogTimeIndex]) {
+		c.proxy.counter.IncrSlowLogTotal()
+		golog.OutputSql(state, "%.1fms - %s->%s:%s",
+			execTime,
+			c.c.RemoteAddr(),
+			conn.GetAddr(),
+			sql,
+		)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+/**
+ * ################################### COM_STMT_SEND_LONG_DATA/RESET/CLOSE ###########################################
+ */
+func (c *ClientConn) handleStmtSendLongData(data []byte) error {
+	if len(data) < 6 {
+		return mysql.ErrMalformPacket
+	}
+
+	id := binary.LittleEndian.Uint32(data[0:4])
+
+	s, ok := c.stmts[id]
+	if !ok {
+		return stmtNotFound(id, "stmt_send_longdata")
+	}
+
+	paramId := binary.LittleEndian.Uint16(data[4:6])
+	if paramId >= uint16(s.params) {
+		return mysql.NewDefaultError(mysql.ER_WRONG_ARGUMENTS, "stmt_send_longdata")
+	}
+
+	if s.args[paramId] == nil {
+		//data是读包时新分配的, 可以直接引用
+		s.args[paramId] = data[6:]
+	} else {
+		if b, ok := s.args[paramId].([]byte); ok {
+			b = append(b, data[6:]...)
+			s.args[paramId] = b
+		} else {
+			return f.Errorf("invalid param long data type %T", s.args[paramId])
+		}
+	}
+	s.longData[paramId] = true
+
+	return nil
+}
+
+func (c *ClientConn) handleStmtReset(data []byte) error {
+	if len(data) < 4 {
+		return mysql.ErrMalformPacket
+	}
+
+	id := binary.LittleEndian.Uint32(data[0:4])
+
+	s, ok := c.stmts[id]
+	if !ok {
+		return stmtNotFound(id, "stmt_reset")
+	}
+
+	s.ResetParams()
+
+	return c.writeOK(nil)
+}
+
+func (c *ClientConn) handleStmtClose(data []byte) error {
+	if len(data) < 4 {
+		return nil
+	}
+
+	id := binary.LittleEndian.Uint32(data[0:4])
+
+	delete(c.stmts, id)
+
+	return nil
 }
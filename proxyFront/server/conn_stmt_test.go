@@ -0,0 +1,154 @@
+package server
+
+import (
+	"reflect"
+	"testing"
+
+	"brother/mysql"
+)
+
+func newTestStmtConn(params int) (*ClientConn, *Stmt) {
+	s := &Stmt{id: 1, params: params}
+	s.ResetParams()
+	c := new(ClientConn)
+	c.stmts = map[uint32]*Stmt{s.id: s}
+	return c, s
+}
+
+//stmt id 1, flag 0, iteration-count 1
+func testExecutePacket(body ...byte) []byte {
+	return append([]byte{1, 0, 0, 0, 0, 1, 0, 0, 0}, body...)
+}
+
+func TestParseStmtExecute(t *testing.T) {
+	tests := []struct {
+		name	string
+		params	int
+		data	[]byte
+		args	[]interface{}
+	}{
+		{"no params", 0, testExecutePacket(), []interface{}{}},
+		{
+			"long and string", 2,
+			testExecutePacket(0x00, 1, mysql.MYSQL_TYPE_LONGLONG, 0x80, mysql.MYSQL_TYPE_VAR_STRING, 0,
+				7, 0, 0, 0, 0, 0, 0, 0, 2, 'a', 'b'),
+			[]interface{}{uint64(7), []byte("ab")},
+		},
+		{
+			//第二个参数在NULL bitmap中, 没有值
+			"null bitmap", 3,
+			testExecutePacket(0x02, 1, mysql.MYSQL_TYPE_TINY, 0, mysql.MYSQL_TYPE_LONG, 0, mysql.MYSQL_TYPE_SHORT, 0,
+				0xff, 2, 0),
+			[]interface{}{int8(-1), nil, int16(2)},
+		},
+		{
+			"datetime", 1,
+			testExecutePacket(0x00, 1, mysql.MYSQL_TYPE_DATETIME, 0, 4, 0xe2, 0x07, 1, 2),
+			[]interface{}{[]byte("2018-01-02 00:00:00")},
+		},
+	}
+	for _, test := range tests {
+		c, s := newTestStmtConn(test.params)
+		if _, err := c.parseStmtExecute(test.data); err != nil {
+			t.Fatal(test.name, err)
+		}
+		if !reflect.DeepEqual(s.args, test.args) {
+			t.Fatal(test.name, s.args)
+		}
+	}
+}
+
+func TestParseStmtExecuteReuseTypes(t *testing.T) {
+	c, s := newTestStmtConn(1)
+
+	//第一次execute必须带上参数类型
+	if _, err := c.parseStmtExecute(testExecutePacket(0x00, 0, 5, 0, 0, 0)); err != mysql.ErrMalformPacket {
+		t.Fatal(err)
+	}
+
+	if _, err := c.parseStmtExecute(testExecutePacket(0x00, 1, mysql.MYSQL_TYPE_LONG, 0, 5, 0, 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	s.ResetParams()
+
+	//new-params-bound-flag为0时沿用上一次的类型
+	if _, err := c.parseStmtExecute(testExecutePacket(0x00, 0, 6, 0, 0, 0)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.args, []interface{}{int32(6)}) {
+		t.Fatal(s.args)
+	}
+}
+
+func TestStmtSendLongData(t *testing.T) {
+	c, s := newTestStmtConn(2)
+
+	//stmt id 1, param id 1
+	for _, chunk := range []string{"hello ", "world"} {
+		if err := c.handleStmtSendLongData(append([]byte{1, 0, 0, 0, 1, 0}, chunk...)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := c.handleStmtSendLongData([]byte{1, 0, 0, 0, 2, 0}); err == nil {
+		t.Fatal("param id out of range must fail")
+	}
+	if err := c.handleStmtSendLongData([]byte{1, 0, 0, 0, 1}); err != mysql.ErrMalformPacket {
+		t.Fatal(err)
+	}
+
+	//long data的参数不在execute包中, NULL bitmap也不影响它
+	data := testExecutePacket(0x02, 1, mysql.MYSQL_TYPE_LONG, 0, mysql.MYSQL_TYPE_BLOB, 0, 3, 0, 0, 0)
+	if _, err := c.parseStmtExecute(data); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.args, []interface{}{int32(3), []byte("hello world")}) {
+		t.Fatal(s.args)
+	}
+
+	//execute或者COM_STMT_RESET之后重新累积
+	s.ResetParams()
+	if err := c.handleStmtSendLongData(append([]byte{1, 0, 0, 0, 1, 0}, "again"...)); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(s.args[1], []byte("again")) || s.longData[0] {
+		t.Fatal(s.args, s.longData)
+	}
+}
+
+func TestParseStmtExecuteMalformed(t *testing.T) {
+	tests := []struct {
+		name	string
+		params	int
+		data	[]byte
+	}{
+		{"short header", 0, []byte{1, 0, 0, 0, 0}},
+		{"no null bitmap", 2, testExecutePacket()},
+		{"no bound flag", 9, testExecutePacket(0, 0)},
+		{"short types", 2, testExecutePacket(0, 1, mysql.MYSQL_TYPE_LONG, 0, mysql.MYSQL_TYPE_LONG)},
+		{"short long", 1, testExecutePacket(0, 1, mysql.MYSQL_TYPE_LONG, 0, 1, 2)},
+		{"short longlong", 1, testExecutePacket(0, 1, mysql.MYSQL_TYPE_LONGLONG, 0, 1, 2, 3, 4)},
+		{"short double", 1, testExecutePacket(0, 1, mysql.MYSQL_TYPE_DOUBLE, 0, 1)},
+		{"no string", 1, testExecutePacket(0, 1, mysql.MYSQL_TYPE_STRING, 0)},
+		{"short string", 1, testExecutePacket(0, 1, mysql.MYSQL_TYPE_STRING, 0, 5, 'a')},
+		{"short string length", 1, testExecutePacket(0, 1, mysql.MYSQL_TYPE_STRING, 0, 0xfc, 1)},
+		{"huge string length", 1, testExecutePacket(0, 1, mysql.MYSQL_TYPE_STRING, 0, 0xfe, 0, 0, 0, 0, 0, 0, 0, 0x80)},
+		{"short datetime", 1, testExecutePacket(0, 1, mysql.MYSQL_TYPE_DATETIME, 0, 7, 0xe2, 0x07)},
+		{"bad datetime length", 1, testExecutePacket(0, 1, mysql.MYSQL_TYPE_DATETIME, 0, 3, 0xe2, 0x07, 1)},
+		{"short time", 1, testExecutePacket(0, 1, mysql.MYSQL_TYPE_TIME, 0, 8, 0)},
+		{"unknown type", 1, testExecutePacket(0, 1, 0xf0, 0, 1)},
+	}
+	for _, test := range tests {
+		c, _ := newTestStmtConn(test.params)
+		if _, err := c.parseStmtExecute(test.data); err == nil {
+			t.Fatal(test.name, "must fail")
+		}
+	}
+
+	c, _ := newTestStmtConn(0)
+	if _, err := c.parseStmtExecute([]byte{2, 0, 0, 0, 0, 1, 0, 0, 0}); err == nil {
+		t.Fatal("unknown stmt must fail")
+	}
+	if _, err := c.parseStmtExecute([]byte{1, 0, 0, 0, 1, 1, 0, 0, 0}); err == nil {
+		t.Fatal("cursor flag must fail")
+	}
+}
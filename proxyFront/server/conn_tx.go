@@ -3,6 +3,7 @@ package server
 import (
 	"brother/mysql"
 	"brother/proxyBack"
+	"brother/core/golog"
 )
 
 func (c *ClientConn) isAutoCommit() bool {
@@ -15,9 +16,14 @@ func (c *ClientConn) isInTransaction() bool {
 
 func (c *ClientConn) commit() (err error) {
 	c.status &= ^mysql.SERVER_STATUS_IN_TRANS
-	for _, co := range c.txConns {
+	if len(c.xaGtrid) != 0 {
+		return c.commitXA()
+	}
+	for n, co := range c.txConns {
 		if e := co.Commit(); e != nil {
 			err = e
+		} else {
+			c.recordWrite(n, co)
 		}
 		co.Close()
 	}
@@ -28,6 +34,9 @@ func (c *ClientConn) commit() (err error) {
 
 func (c *ClientConn) rollback() (err error) {
 	c.status &= ^mysql.SERVER_STATUS_IN_TRANS
+	if len(c.xaGtrid) != 0 {
+		return c.rollbackXA()
+	}
 
 	for _, co := range c.txConns {
 		if e := co.Rollback(); e != nil {
@@ -41,6 +50,12 @@ func (c *ClientConn) rollback() (err error) {
 }
 
 func (c *ClientConn) handleBegin() error {
+	//XA事务不能被begin隐式提交, 需要先完成两阶段提交
+	if len(c.xaGtrid) != 0 {
+		if err := c.commit(); err != nil {
+			return err
+		}
+	}
 	for _, co := range c.txConns {
 		if err := co.Begin(); err != nil {
 			return err
@@ -65,3 +80,109 @@ func (c *ClientConn) handleRollback() (err error) {
 		return c.writeOK(nil)
 	}
 }
+
+/**
+ * ################################### XA two-phase commit ###########################################
+ */
+
+//事务第一次用到某个节点时, 在该节点上开启一个XA分支
+func (c *ClientConn) startXA(n *proxyBack.Node, co *proxyBack.BackendConn) error {
+	if len(c.xaGtrid) == 0 {
+		c.xaGtrid = c.proxy.newXAGtrid()
+	}
+	return co.XAStart(c.xaXID(n))
+}
+
+func (c *ClientConn) xaXID(n *proxyBack.Node) proxyBack.XID {
+	return proxyBack.XID{Gtrid: c.xaGtrid, Bqual: n.String()}
+}
+
+//所有分支prepare成功后先写恢复日志, 再逐个commit; 只有一个分支时直接one phase提交
+func (c *ClientConn) commitXA() (err error) {
+	gtrid := c.xaGtrid
+	defer c.resetXA()
+
+	for n, co := range c.txConns {
+		if err = co.XAEnd(c.xaXID(n)); err != nil {
+			golog.Error("ClientConn", "commitXA", err.Error(), c.connectionId, "node", n.String(), "gtrid", gtrid)
+			c.abortXA()
+			return
+		}
+	}
+
+	if len(c.txConns) == 1 {
+		for n, co := range c.txConns {
+			if err = co.XACommit(c.xaXID(n), true); err == nil {
+				c.recordWrite(n, co)
+			}
+		}
+		return
+	}
+
+	nodes := make([]string, 0, len(c.txConns))
+	for n, co := range c.txConns {
+		if err = co.XAPrepare(c.xaXID(n)); err != nil {
+			golog.Error("ClientConn", "commitXA", err.Error(), c.connectionId, "node", n.String(), "gtrid", gtrid)
+			c.abortXA()
+			return
+		}
+		nodes = append(nodes, n.String())
+	}
+
+	//日志写失败时还没有任何分支commit, 可以安全回滚
+	if err = c.proxy.xaLog.add(gtrid, nodes); err != nil {
+		golog.Error("ClientConn", "commitXA", err.Error(), c.connectionId, "gtrid", gtrid)
+		c.abortXA()
+		return
+	}
+
+	//已经决定commit, 失败的分支由恢复流程继续commit
+	failed := false
+	for n, co := range c.txConns {
+		if e := co.XACommit(c.xaXID(n), false); e != nil {
+			golog.Error("ClientConn", "commitXA", e.Error(), c.connectionId, "node", n.String(), "gtrid", gtrid)
+			failed = true
+		} else {
+			c.recordWrite(n, co)
+		}
+	}
+	if !failed {
+		if e := c.proxy.xaLog.remove(gtrid); e != nil {
+			golog.Error("ClientConn", "commitXA", e.Error(), c.connectionId, "gtrid", gtrid)
+		}
+	}
+	return nil
+}
+
+func (c *ClientConn) rollbackXA() (err error) {
+	defer c.resetXA()
+
+	for n, co := range c.txConns {
+		//XA END失败说明分支已经不处于active状态, 仍然尝试rollback
+		co.XAEnd(c.xaXID(n))
+		if e := co.XARollback(c.xaXID(n)); e != nil {
+			err = e
+		}
+	}
+	return
+}
+
+//两阶段提交失败时回滚所有分支, 分支可能处于active/idle/prepared状态
+func (c *ClientConn) abortXA() {
+	for n, co := range c.txConns {
+		xid := c.xaXID(n)
+		co.XAEnd(xid)
+		if e := co.XARollback(xid); e != nil {
+			golog.Error("ClientConn", "abortXA", e.Error(), c.connectionId, "node", n.String(), "xid", xid.String())
+		}
+	}
+}
+
+func (c *ClientConn) resetXA() {
+	for _, co := range c.txConns {
+		co.Close()
+	}
+	c.txConns = make(map[*proxyBack.Node]*proxyBack.BackendConn)
+	c.proxy.endXA(c.xaGtrid)
+	c.xaGtrid = ""
+}
@@ -0,0 +1,77 @@
+package server
+
+import (
+	"testing"
+)
+
+func TestTransactionPinMaster(t *testing.T) {
+	master, slave := newTestBackend(t), newTestBackend(t)
+	defer master.Close()
+	defer slave.Close()
+	c := newTestQueryConn(t, master, slave)
+	defer closeTestQueryConn(c)
+	n := c.schema.defaultNode
+
+	if err := c.handleQuery("begin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.handleQuery("select * from test_table"); err != nil {
+		t.Fatal(err)
+	}
+	co := c.txConns[n]
+	if co == nil {
+		t.Fatal("read in transaction must use a master connection")
+	}
+	//事务中的读写都在第一次取到的主库连接上
+	for _, sql := range []string{"insert into test_table values (1)", "select id from test_table"} {
+		if err := c.handleQuery(sql); err != nil {
+			t.Fatal(err)
+		}
+		if len(c.txConns) != 1 || c.txConns[n] != co {
+			t.Fatal(sql, "must stay on one master connection")
+		}
+	}
+	if q := slave.Queries(); hasQuery(q, "select * from test_table") || hasQuery(q, "select id from test_table") {
+		t.Fatal("slave", q)
+	}
+	if q := master.Queries(); !hasQuery(q, "begin") || !hasQuery(q, "select * from test_table") ||
+		!hasQuery(q, "select id from test_table") {
+		t.Fatal("master", q)
+	}
+
+	//commit之后归还连接
+	if err := c.handleQuery("commit"); err != nil {
+		t.Fatal(err)
+	}
+	if len(c.txConns) != 0 || co.Conn != nil || !hasQuery(master.Queries(), "commit") {
+		t.Fatal("commit must release the master connection")
+	}
+}
+
+func TestCloseRollback(t *testing.T) {
+	master, slave := newTestBackend(t), newTestBackend(t)
+	defer master.Close()
+	defer slave.Close()
+	c := newTestQueryConn(t, master, slave)
+	defer closeTestQueryConn(c)
+
+	if err := c.handleQuery("begin"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.handleQuery("insert into test_table values (1)"); err != nil {
+		t.Fatal(err)
+	}
+	co := c.txConns[c.schema.defaultNode]
+	if co == nil || hasQuery(master.Queries(), "rollback") {
+		t.Fatal("transaction must still be open")
+	}
+
+	//客户端在事务中断开, 回滚并归还连接
+	c.Close()
+	if !hasQuery(master.Queries(), "rollback") {
+		t.Fatal("open transaction must be rolled back on close", master.Queries())
+	}
+	if len(c.txConns) != 0 || co.Conn != nil {
+		t.Fatal("transaction connection must be released on close")
+	}
+}
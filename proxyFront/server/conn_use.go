@@ -17,16 +17,12 @@ func (c *ClientConn) handleUseDB(dbName string) error {
 		return mysql.NewDefaultError(mysql.ER_NO_DB_ERROR)
 	}
 
-	//TODO 找到默认的节点 此处先写死为 node1
-	//nodeName := c.schema.rule.DefaultRule.Nodes[0]
-	nodeName := "node1"
-
-	n := c.proxy.GetNode(nodeName)
-	//get the connection from slave preferentially
-	co, err = n.GetSlaveConn()
+	n, err := c.getDefaultNode()
 	if err != nil {
-		co, err = n.GetMasterConn()
+		return err
 	}
+	//get the connection from slave preferentially
+	co, err = c.getBackendConn(n, true)
 	defer c.closeConn(co, false)
 	if err != nil {
 		return err
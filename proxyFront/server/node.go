@@ -0,0 +1,155 @@
+package server
+
+import (
+	"time"
+
+	"brother/config"
+	"brother/core/errors"
+	"brother/core/golog"
+	"brother/proxyBack"
+)
+
+/**
+ * ################################### 运行时节点管理 ###########################################
+ */
+
+//移除节点时等待借出的连接归还的时间
+const DefaultNodeDrainTimeout = 30 * time.Second
+
+//save为true时写回配置文件; 新增的节点需要修改schema之后才会被路由使用
+func (s *Server) AddNode(cfg config.NodeConfig, save bool) error {
+	if len(cfg.Name) == 0 {
+		return errors.ErrInvalidArgument
+	}
+	if s.GetNode(cfg.Name) != nil {
+		return errors.ErrNodeExist
+	}
+
+	n, err := s.parseNode(cfg)
+	if err != nil {
+		return err
+	}
+	s.nodesLock.Lock()
+	if _, ok := s.nodes[cfg.Name]; ok {
+		s.nodesLock.Unlock()
+		go n.Close(0)
+		return errors.ErrNodeExist
+	}
+	s.nodes[cfg.Name] = n
+	s.nodesLock.Unlock()
+	golog.Info("server", "AddNode", "Node added", 0, "node", cfg.Name, "master", cfg.Master, "slave", cfg.Slave)
+
+	if !save {
+		return nil
+	}
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	s.cfg.Nodes = append(s.cfg.Nodes, cfg)
+	return config.WriteConfigFile(s.cfg)
+}
+
+//schema和序列使用的节点不能移除; 节点在后台等待连接归还之后关闭
+func (s *Server) RemoveNode(name string, save bool) error {
+	s.nodesLock.Lock()
+	if s.nodeInUse(name) {
+		s.nodesLock.Unlock()
+		return errors.ErrNodeInUse
+	}
+	n, ok := s.nodes[name]
+	if !ok {
+		s.nodesLock.Unlock()
+		return errors.ErrNodeNotExist
+	}
+	delete(s.nodes, name)
+	s.nodesLock.Unlock()
+	golog.Info("server", "RemoveNode", "Node removed, draining", 0, "node", name)
+	go n.Close(DefaultNodeDrainTimeout)
+
+	if !save {
+		return nil
+	}
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	for i := range s.cfg.Nodes {
+		if s.cfg.Nodes[i].Name == name {
+			s.cfg.Nodes = append(s.cfg.Nodes[:i], s.cfg.Nodes[i+1:]...)
+			break
+		}
+	}
+	return config.WriteConfigFile(s.cfg)
+}
+
+//调用方持有nodesLock; cfg在configLock中修改, 加锁顺序为nodesLock -> configLock
+func (s *Server) nodeInUse(name string) bool {
+	if s.schema != nil {
+		if _, ok := s.schema.nodes[name]; ok {
+			return true
+		}
+	}
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+	for _, seq := range s.cfg.Schema.Sequences {
+		if seq.Node == name {
+			return true
+		}
+	}
+	return false
+}
+
+//slaveStr为addr@weight
+func (s *Server) AddSlave(node, slaveStr string, save bool) error {
+	n := s.GetNode(node)
+	if n == nil {
+		return errors.ErrNodeNotExist
+	}
+	if err := n.AddSlave(slaveStr); err != nil {
+		return err
+	}
+	return s.persistNode(n, save)
+}
+
+func (s *Server) RemoveSlave(node, addr string, save bool) error {
+	n := s.GetNode(node)
+	if n == nil {
+		return errors.ErrNodeNotExist
+	}
+	if err := n.RemoveSlave(addr); err != nil {
+		return err
+	}
+	return s.persistNode(n, save)
+}
+
+func (s *Server) SetSlaveWeight(node, addr string, weight int, save bool) error {
+	n := s.GetNode(node)
+	if n == nil {
+		return errors.ErrNodeNotExist
+	}
+	if err := n.SetSlaveWeight(addr, weight); err != nil {
+		return err
+	}
+	return s.persistNode(n, save)
+}
+
+//DB的状态不在配置文件中, 不需要保存
+func (s *Server) UpDB(node, addr string) error {
+	n := s.GetNode(node)
+	if n == nil {
+		return errors.ErrNodeNotExist
+	}
+	return n.SetDBUp(addr)
+}
+
+func (s *Server) DownDB(node, addr string) error {
+	n := s.GetNode(node)
+	if n == nil {
+		return errors.ErrNodeNotExist
+	}
+	return n.SetDBManualDown(addr)
+}
+
+func (s *Server) persistNode(n *proxyBack.Node, save bool) error {
+	if !save {
+		return nil
+	}
+	return s.saveNodeConfig(n)
+}
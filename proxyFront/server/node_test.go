@@ -0,0 +1,32 @@
+package server
+
+import (
+	"testing"
+
+	"brother/config"
+	"brother/core/errors"
+	"brother/proxyBack"
+)
+
+func TestRemoveNodeInUse(t *testing.T) {
+	s := &Server{cfg: new(config.Config)}
+	s.nodes = map[string]*proxyBack.Node{"node1": new(proxyBack.Node), "node2": new(proxyBack.Node), "node3": new(proxyBack.Node)}
+	s.schema = &Schema{nodes: map[string]*proxyBack.Node{"node1": s.nodes["node1"]}}
+	s.cfg.Schema.Sequences = []config.SequenceConfig{{Name: "seq", Node: "node2"}}
+
+	//schema和序列使用的节点都不能移除
+	for _, name := range []string{"node1", "node2"} {
+		if err := s.RemoveNode(name, false); err != errors.ErrNodeInUse {
+			t.Fatal(name, err)
+		}
+		if s.GetNode(name) == nil {
+			t.Fatal(name, "must not be removed")
+		}
+	}
+	if s.nodeInUse("node3") {
+		t.Fatal("node3 is not in use")
+	}
+	if err := s.RemoveNode("node4", false); err != errors.ErrNodeNotExist {
+		t.Fatal(err)
+	}
+}
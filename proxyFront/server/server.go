@@ -5,6 +5,7 @@ import (
 	"net"
 	"brother/proxyBack"
 	f"fmt"
+	"sync"
 	"sync/atomic"
 	"strings"
 	"brother/mysql"
@@ -15,6 +16,8 @@ import (
 	"os"
 	"bufio"
 	"io"
+	"brother/proxyFront/router"
+	"brother/proxyFront/sequence"
 )
 
 /**
@@ -22,7 +25,10 @@ import (
  */
 type Schema struct {
 	nodes				map[string]*proxyBack.Node
-	//rule				*router
+	defaultNode			*proxyBack.Node
+	rule				*router.Router
+	//全局表读请求轮询节点的计数
+	globalIndex			uint32
 }
 
 type BlacklistSqls struct {
@@ -38,6 +44,7 @@ const (
 
 type Server struct {
 	cfg				*config.Config	//配置
+	configLock			sync.Mutex	//修改并保存cfg
 	addr				string
 	user				string
 	passwd				string
@@ -51,9 +58,29 @@ type Server struct {
 	allowipsIndex			int32
 	allowips			[2][]net.IP
 
+	logSqlIndex			int32
+	logSql				[2]string
+
+	slowLogTimeIndex		int32
+	slowLogTime			[2]int
+
 	counter				*Counter
+	nodesLock			sync.RWMutex	//运行时增删节点, 见node.go
 	nodes				map[string]*proxyBack.Node
 	schema				*Schema
+	sequences			map[string]sequence.Sequence
+
+	//XA两阶段提交, 未开启时xaLog为nil
+	xaLog				*xaLog
+	xaPrefix			string
+	xaStartTime			int64
+	xaSeq				uint64
+	xaActiveLock			sync.Mutex
+	xaActive			map[string]bool	//还没有结束的XA事务, 恢复时跳过
+	xaRecoverCh			chan struct{}
+
+	//配置的读一致性, 会话可以通过SET修改
+	readConsistency			readConsistency
 
 	listener			net.Listener
 	running				bool
@@ -142,12 +169,42 @@ func (s *Server) parseNode(cfg config.NodeConfig) (*proxyBack.Node, error) {
 	n.Cfg = cfg
 
 	n.DownAfterNoAlive = time.Duration(cfg.DownAfterNoAlive) * time.Second
+	n.CheckInterval = time.Duration(cfg.CheckInterval) * time.Second
+	n.CheckTimeout = time.Duration(cfg.CheckTimeout) * time.Second
+	n.MaxSlaveLag = int64(cfg.MaxSlaveLag)
+	n.Pool = proxyBack.PoolConfig{
+		MinIdle:     cfg.MinIdleConns,
+		MaxOpen:     cfg.MaxConnNum,
+		MaxIdleTime: time.Duration(cfg.MaxIdleTime) * time.Second,
+		MaxLifetime: time.Duration(cfg.MaxConnLifetime) * time.Second,
+		WaitTimeout: time.Duration(cfg.ConnWaitTimeout) * time.Millisecond,
+		Reset:       cfg.ConnReset,
+	}
+	if err = proxyBack.CheckResetMode(cfg.ConnReset); err != nil {
+		return nil, err
+	}
+	n.Breaker = proxyBack.BreakerConfig{
+		Failures:    cfg.BreakerFailures,
+		ErrorRatio:  cfg.BreakerErrorRatio,
+		Window:      time.Duration(cfg.BreakerWindow) * time.Second,
+		MinRequests: cfg.BreakerMinRequests,
+		Cooldown:    time.Duration(cfg.BreakerCooldown) * time.Second,
+	}
+	n.AutoFailover = cfg.AutoFailover
+	n.RepointSlaves = cfg.RepointSlaves
+	n.FailoverCooldown = time.Duration(cfg.FailoverCooldown) * time.Second
+	n.OnFailover = s.saveNodeConfig
+	if err = n.SetBalancer(cfg.Balancer); err != nil {
+		return nil, err
+	}
 	err = n.ParseMaster(cfg.Master)
 	if err != nil {
 		return nil, err
 	}
 	err = n.ParseSlave(cfg.Slave)
 	if err != nil {
+		//运行时添加节点失败时关闭已经打开的DB
+		n.Close(0)
 		return nil, err
 	}
 
@@ -174,6 +231,26 @@ func (s *Server) parseNodes() error {
 	return nil
 }
 
+//节点的主从发生变化之后写回配置文件
+func (s *Server) saveNodeConfig(n *proxyBack.Node) error {
+	s.configLock.Lock()
+	defer s.configLock.Unlock()
+
+	for i := range s.cfg.Nodes {
+		if s.cfg.Nodes[i].Name != n.String() {
+			continue
+		}
+		if master := n.GetMaster(); master != nil {
+			s.cfg.Nodes[i].Master = master.Addr()
+		}
+		s.cfg.Nodes[i].Slave = n.SlaveString()
+		n.Cfg.Master = s.cfg.Nodes[i].Master
+		n.Cfg.Slave = s.cfg.Nodes[i].Slave
+		return config.WriteConfigFile(s.cfg)
+	}
+	return f.Errorf("node [%s] config is not exists.", n.String())
+}
+
 func (s *Server) parseSchema() error {
 	schemaCfg := s.cfg.Schema
 	if len(schemaCfg.Nodes) == 0 {
@@ -192,7 +269,52 @@ func (s *Server) parseSchema() error {
 		nodes[n] = s.GetNode(n)
 	}
 
-	//TODO 暂时不实现路由
+	if len(schemaCfg.Default) == 0 {
+		return errors.ErrNoDefaultNode
+	}
+	defaultNode, ok := nodes[schemaCfg.Default]
+	if !ok {
+		return f.Errorf("schema default node [%s] is not in schema nodes.", schemaCfg.Default)
+	}
+
+	rule, err := router.NewRouter(&schemaCfg)
+	if err != nil {
+		return err
+	}
+
+	s.schema = &Schema{
+		nodes:       nodes,
+		defaultNode: defaultNode,
+		rule:        rule,
+	}
+
+	return nil
+}
+
+func (s *Server) parseSequences() error {
+	s.sequences = make(map[string]sequence.Sequence)
+	for i := range s.cfg.Schema.Sequences {
+		cfg := &s.cfg.Schema.Sequences[i]
+		if len(cfg.Name) == 0 {
+			return f.Errorf("sequence must have a name.")
+		}
+		if _, ok := s.sequences[cfg.Name]; ok {
+			return f.Errorf("sequence [%s] duplicated.", cfg.Name)
+		}
+
+		var n *proxyBack.Node
+		if len(cfg.Node) != 0 {
+			if n = s.GetNode(cfg.Node); n == nil {
+				return f.Errorf("sequence [%s] node [%s] config is not exists.", cfg.Name, cfg.Node)
+			}
+		}
+
+		seq, err := sequence.New(cfg, n)
+		if err != nil {
+			return err
+		}
+		s.sequences[cfg.Name] = seq
+	}
 
 	return nil
 }
@@ -205,12 +327,25 @@ func (s *Server) GetSchema() *Schema {
 	return s.schema
 }
 
+func (s *Server) GetSequence(name string) sequence.Sequence {
+	return s.sequences[name]
+}
+
 func (s *Server) GetNode(name string) *proxyBack.Node {
+	s.nodesLock.RLock()
+	defer s.nodesLock.RUnlock()
 	return s.nodes[name]
 }
 
+//返回副本, 调用方可以在遍历时增删节点
 func (s *Server) GetAllNodes() map[string]*proxyBack.Node {
-	return s.nodes
+	s.nodesLock.RLock()
+	defer s.nodesLock.RUnlock()
+	nodes := make(map[string]*proxyBack.Node, len(s.nodes))
+	for name, n := range s.nodes {
+		nodes[name] = n
+	}
+	return nodes
 }
 
 func (s *Server) GetAllowIps() []string {
@@ -237,10 +372,13 @@ func NewServer(cfg *config.Config) (*Server, error) {
 	s.passwd = cfg.Password
 	atomic.StoreInt32(&s.statusIndex, 0)
 	s.status[s.statusIndex] = Online
-	//atomic.StoreInt32(&s.logSqlIndex, 0)
-	//s.logSql[s.logSqlIndex] = cfg.LogSql
-	//atomic.StoreInt32(&s.slowLogTimeIndex, 0)
-	//s.slowLogTime[s.slowLogTimeIndex] = cfg.SlowLogTime
+	if len(cfg.LogSql) == 0 {
+		cfg.LogSql = golog.LogSqlOff
+	}
+	atomic.StoreInt32(&s.logSqlIndex, 0)
+	s.logSql[s.logSqlIndex] = cfg.LogSql
+	atomic.StoreInt32(&s.slowLogTimeIndex, 0)
+	s.slowLogTime[s.slowLogTimeIndex] = cfg.SlowLogTime
 
 	if len(cfg.Charset) == 0 {
 		cfg.Charset = mysql.DEFAULT_CHARSET //utf8
@@ -265,10 +403,18 @@ func NewServer(cfg *config.Config) (*Server, error) {
 	if err := s.parseNodes(); err != nil {
 		return nil, err
 	}
-	//忽略分表规则
-	//if err := s.parseSchema(); err != nil {
-	//	return nil, err
-	//}
+	if err := s.parseSchema(); err != nil {
+		return nil, err
+	}
+	if err := s.parseSequences(); err != nil {
+		return nil, err
+	}
+	if err := s.parseXA(); err != nil {
+		return nil, err
+	}
+	if err := s.parseReadConsistency(); err != nil {
+		return nil, err
+	}
 
 	var err error
 	netProto := "tcp"
@@ -322,6 +468,11 @@ func (s *Server) newClientConn(co net.Conn) *ClientConn  {
 
 	c.charset = mysql.DEFAULT_CHARSET
 	c.collation = mysql.DEFAULT_COLLATION_ID
+	c.sysVars = make(map[string]string)
+
+	c.readConsistency = s.readConsistency
+	c.writeConns = make(map[*proxyBack.BackendConn]*proxyBack.Node)
+	c.nodeWrites = make(map[*proxyBack.Node]*nodeWrite)
 
 	c.stmtId = 0
 	c.stmts = make(map[uint32]*Stmt)
@@ -344,6 +495,10 @@ func (s *Server) Run() error {
 	//flush counter
 	go s.flushCounter()
 
+	if s.isXAMode() {
+		go s.runXARecover()
+	}
+
 	for s.running {
 		conn, err := s.listener.Accept()
 		if err != nil {
@@ -0,0 +1,272 @@
+package server
+
+import (
+	"bufio"
+	f "fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"brother/core/golog"
+	"brother/proxyBack"
+)
+
+/**
+ * ################################### XA恢复日志 ###########################################
+ */
+
+const defaultXALogFile = "xa_recovery.log"
+
+//运行中定时处理commit失败或者遗留的prepared事务
+const xaRecoverInterval = time.Minute
+
+//记录所有分支都已经prepare、正在commit的XA事务, 每行: gtrid node1,node2
+//proxy重启之后, 日志中的事务继续commit, 其他prepared状态的事务回滚
+type xaLog struct {
+	sync.Mutex
+	path string
+	xids map[string][]string
+}
+
+func openXALog(path string) (*xaLog, error) {
+	l := &xaLog{
+		path: path,
+		xids: make(map[string][]string),
+	}
+
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return l, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 2 {
+			continue
+		}
+		l.xids[fields[0]] = strings.Split(fields[1], ",")
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+//commit之前写入日志, 落盘之后才能开始commit
+func (l *xaLog) add(gtrid string, nodes []string) error {
+	l.Lock()
+	defer l.Unlock()
+
+	l.xids[gtrid] = nodes
+	return l.flush()
+}
+
+func (l *xaLog) remove(gtrids ...string) error {
+	l.Lock()
+	defer l.Unlock()
+
+	for _, gtrid := range gtrids {
+		delete(l.xids, gtrid)
+	}
+	return l.flush()
+}
+
+func (l *xaLog) get(gtrid string) ([]string, bool) {
+	l.Lock()
+	defer l.Unlock()
+
+	nodes, ok := l.xids[gtrid]
+	return nodes, ok
+}
+
+func (l *xaLog) gtrids() []string {
+	l.Lock()
+	defer l.Unlock()
+
+	gtrids := make([]string, 0, len(l.xids))
+	for gtrid := range l.xids {
+		gtrids = append(gtrids, gtrid)
+	}
+	sort.Strings(gtrids)
+	return gtrids
+}
+
+//先写临时文件再rename, 保证日志文件不会写坏
+func (l *xaLog) flush() error {
+	tmp := l.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+
+	w := bufio.NewWriter(file)
+	for gtrid, nodes := range l.xids {
+		f.Fprintf(w, "%s %s\n", gtrid, strings.Join(nodes, ","))
+	}
+	if err = w.Flush(); err == nil {
+		err = file.Sync()
+	}
+	if e := file.Close(); err == nil {
+		err = e
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.path)
+}
+
+/**
+ * ################################### server XA ###########################################
+ */
+
+func (s *Server) isXAMode() bool {
+	return s.xaLog != nil
+}
+
+func (s *Server) parseXA() error {
+	if !s.cfg.XAMode {
+		return nil
+	}
+
+	path := s.cfg.XALogPath
+	if len(path) == 0 {
+		path = filepath.Join(s.cfg.LogPath, defaultXALogFile)
+	}
+
+	var err error
+	s.xaLog, err = openXALog(path)
+	if err != nil {
+		return err
+	}
+
+	//gtrid带上proxy地址的hash, 多个proxy共用mysql时只恢复自己的事务
+	s.xaPrefix = xaGtridPrefix(s.addr)
+	s.xaStartTime = time.Now().Unix()
+	s.xaActive = make(map[string]bool)
+	s.xaRecoverCh = make(chan struct{}, 1)
+	s.recoverXA()
+	return nil
+}
+
+//mysql的gtrid最长64字节, 地址用crc32缩短, gtrid最长为8+9+11+20字节
+func xaGtridPrefix(addr string) string {
+	return f.Sprintf("brother-%08x-", crc32.ChecksumIEEE([]byte(addr)))
+}
+
+//返回的gtrid在endXA之前不会被恢复流程处理
+func (s *Server) newXAGtrid() string {
+	seq := atomic.AddUint64(&s.xaSeq, 1)
+	gtrid := f.Sprintf("%s%d-%d", s.xaPrefix, s.xaStartTime, seq)
+
+	s.xaActiveLock.Lock()
+	s.xaActive[gtrid] = true
+	s.xaActiveLock.Unlock()
+	return gtrid
+}
+
+//XA事务结束, 日志中还有记录说明有分支commit失败, 立即触发一次恢复
+func (s *Server) endXA(gtrid string) {
+	s.xaActiveLock.Lock()
+	delete(s.xaActive, gtrid)
+	s.xaActiveLock.Unlock()
+
+	if _, ok := s.xaLog.get(gtrid); ok {
+		s.triggerXARecover()
+	}
+}
+
+func (s *Server) isXAActive(gtrid string) bool {
+	s.xaActiveLock.Lock()
+	defer s.xaActiveLock.Unlock()
+	return s.xaActive[gtrid]
+}
+
+func (s *Server) triggerXARecover() {
+	select {
+	case s.xaRecoverCh <- struct{}{}:
+	default:
+	}
+}
+
+func (s *Server) runXARecover() {
+	ticker := time.NewTicker(xaRecoverInterval)
+	defer ticker.Stop()
+	for s.running {
+		select {
+		case <-ticker.C:
+		case <-s.xaRecoverCh:
+		}
+		s.recoverXA()
+	}
+}
+
+//处理commit失败或者上次遗留的prepared事务: 日志中有记录的commit, 否则rollback
+//启动时和runXARecover中调用, 不会并发执行
+func (s *Server) recoverXA() {
+	failed := make(map[string]bool)
+	for name, n := range s.GetAllNodes() {
+		if err := s.recoverNodeXA(n, failed); err != nil {
+			golog.Error("server", "recoverXA", err.Error(), 0, "node", name)
+			//节点不可用时无法确认日志中的事务是否已经完成
+			for _, gtrid := range s.xaLog.gtrids() {
+				failed[gtrid] = true
+			}
+		}
+	}
+
+	done := make([]string, 0)
+	for _, gtrid := range s.xaLog.gtrids() {
+		if !failed[gtrid] && !s.isXAActive(gtrid) {
+			done = append(done, gtrid)
+		}
+	}
+	if len(done) == 0 {
+		return
+	}
+	if err := s.xaLog.remove(done...); err != nil {
+		golog.Error("server", "recoverXA", err.Error(), 0)
+	}
+}
+
+func (s *Server) recoverNodeXA(n *proxyBack.Node, failed map[string]bool) error {
+	co, err := n.GetMasterConn()
+	if err != nil {
+		return err
+	}
+	defer co.Close()
+
+	xids, err := co.XARecover()
+	if err != nil {
+		return err
+	}
+
+	for _, xid := range xids {
+		//正在prepare或者commit的事务由连接自己完成
+		if !strings.HasPrefix(xid.Gtrid, s.xaPrefix) || s.isXAActive(xid.Gtrid) {
+			continue
+		}
+
+		if _, ok := s.xaLog.get(xid.Gtrid); ok {
+			err = co.XACommit(xid, false)
+			golog.Info("server", "recoverXA", "commit in-doubt xa transaction", 0,
+				"node", n.String(), "xid", xid.String(), "err", err)
+		} else {
+			err = co.XARollback(xid)
+			golog.Info("server", "recoverXA", "rollback in-doubt xa transaction", 0,
+				"node", n.String(), "xid", xid.String(), "err", err)
+		}
+		if err != nil {
+			failed[xid.Gtrid] = true
+		}
+	}
+	return nil
+}
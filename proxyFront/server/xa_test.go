@@ -0,0 +1,59 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestXALogReplay(t *testing.T) {
+	dir, err := os.MkdirTemp("", "brother_xa")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, defaultXALogFile)
+
+	l, err := openXALog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = l.add("g1", []string{"node1", "node2"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = l.add("g2", []string{"node2", "node3"}); err != nil {
+		t.Fatal(err)
+	}
+	if err = l.remove("g1"); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err = openXALog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gtrids := l.gtrids(); !reflect.DeepEqual(gtrids, []string{"g2"}) {
+		t.Fatalf("gtrids %v", gtrids)
+	}
+	if nodes, ok := l.get("g2"); !ok || !reflect.DeepEqual(nodes, []string{"node2", "node3"}) {
+		t.Fatalf("nodes %v %v", nodes, ok)
+	}
+}
+
+func TestXAGtridLength(t *testing.T) {
+	s := &Server{
+		addr:        "very-long-hostname-of-the-proxy.internal.example.com:9696",
+		xaStartTime: 1 << 40,
+		xaSeq:       1<<64 - 2,
+		xaActive:    make(map[string]bool),
+	}
+	s.xaPrefix = xaGtridPrefix(s.addr)
+	gtrid := s.newXAGtrid()
+	if len(gtrid) > 64 {
+		t.Fatalf("gtrid %s too long", gtrid)
+	}
+	if !s.isXAActive(gtrid) {
+		t.Fatalf("gtrid %s not active", gtrid)
+	}
+}